@@ -0,0 +1,360 @@
+// Package admin serves a small JSON API over HTTP for inspecting the
+// sessions of a tftp.Server and managing the files it serves.
+//
+//	GET    /sessions           list active sessions
+//	DELETE /sessions/<id>      cancel a session by its ID, or by its client "host:port"
+//	GET    /files?prefix=<p>   list files
+//	GET    /files/<name>       download a file
+//	GET    /stat/<name>        metadata of a file, including its digests
+//	PUT    /files/<name>       upload a file
+//	DELETE /files/<name>       delete a file
+//	GET    /ports              transfer port range utilization
+//	GET    /limits             list rate limits
+//	PUT    /limits             replace rate limits, e.g. [{"file":"*.img","scope":"session","rate":1000000}]
+//
+// Every request must carry the shared token as "Authorization: Bearer <token>".
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp"
+)
+
+// Limits on admin requests, so that a slow or misbehaving client can't tie
+// up the server
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 5 * time.Minute
+	writeTimeout      = 5 * time.Minute
+)
+
+// Largest file accepted by PUT /files/<name>
+var maxUploadBytes int64 = 256 << 20
+
+type handler struct {
+	server *tftp.Server
+	token  string
+}
+
+type sessionJson struct {
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	File        string    `json:"file"`
+	Direction   string    `json:"direction"`
+	Start       time.Time `json:"start"`
+	State       string    `json:"state"`
+	Block       uint16    `json:"block"`
+	Bytes       int       `json:"bytes"`
+	Size        int       `json:"size,omitempty"`
+	Retransmits int       `json:"retransmits"`
+}
+
+type fileJson struct {
+	Name     string            `json:"name"`
+	Size     int               `json:"size"`
+	ModTime  time.Time         `json:"mod_time"`
+	Checksum string            `json:"checksum"`
+	Digests  map[string]string `json:"digests,omitempty"`
+}
+
+type portsJson struct {
+	InUse int `json:"in_use"`
+	Total int `json:"total"`
+}
+
+// Implemented by transports which allocate ports from a range
+type portUser interface {
+	PortUsage() (int, int)
+}
+
+type limitJson struct {
+	Client string `json:"client,omitempty"`
+	File   string `json:"file,omitempty"`
+	Scope  string `json:"scope,omitempty"`
+	Rate   int    `json:"rate"`
+	Burst  int    `json:"burst,omitempty"`
+}
+
+type errorJson struct {
+	Error string `json:"error"`
+}
+
+func NewHandler(server *tftp.Server, token string) http.Handler {
+	h := &handler{
+		server: server,
+		token:  token,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", h.sessions)
+	mux.HandleFunc("/sessions/", h.session)
+	mux.HandleFunc("/files", h.files)
+	mux.HandleFunc("/files/", h.file)
+	mux.HandleFunc("/stat/", h.stat)
+	mux.HandleFunc("/ports", h.ports)
+	mux.HandleFunc("/limits", h.limits)
+	return h.authorize(mux)
+}
+
+// ListenAndServe runs the admin API on addr until it fails
+func ListenAndServe(addr string, server *tftp.Server, token string) error {
+	if token == "" {
+		return errors.New("The admin API requires a non-empty token")
+	}
+
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           NewHandler(server, token),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+	}
+
+	logrus.Infof("[Admin]: Listening on %v", addr)
+	return httpServer.ListenAndServe()
+}
+
+func (h *handler) authorize(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + h.token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if h.token == "" || subtle.ConstantTimeCompare(given, expected) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("Missing or invalid token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) sessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Method %v not allowed", r.Method)))
+		return
+	}
+
+	sessions := []sessionJson{}
+	for _, s := range h.server.Sessions() {
+		sessions = append(sessions, sessionJson{
+			ID:          s.ID,
+			Client:      s.Client,
+			File:        s.File,
+			Direction:   s.Direction,
+			Start:       s.Start,
+			State:       s.State,
+			Block:       s.Block,
+			Bytes:       s.Bytes,
+			Size:        s.Size,
+			Retransmits: s.Retransmits,
+		})
+	}
+
+	writeJson(w, http.StatusOK, sessions)
+}
+
+func (h *handler) session(w http.ResponseWriter, r *http.Request) {
+	session := strings.TrimPrefix(r.URL.Path, "/sessions/")
+
+	if r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Method %v not allowed", r.Method)))
+		return
+	}
+
+	// Clients always have a port, so can't be mistaken for IDs
+	var err error
+	if id, parseErr := strconv.ParseUint(session, 10, 64); parseErr == nil {
+		err = h.server.CancelSessionByID(id)
+	} else {
+		err = h.server.CancelSession(session)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	logrus.Infof("[Admin]: Cancelled session %v", session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) files(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Method %v not allowed", r.Method)))
+		return
+	}
+
+	infos, err := h.server.FileServer().List(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	files := []fileJson{}
+	for _, info := range infos {
+		files = append(files, newFileJson(info))
+	}
+
+	writeJson(w, http.StatusOK, files)
+}
+
+func (h *handler) stat(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/stat/")
+
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Method %v not allowed", r.Method)))
+		return
+	}
+
+	info, err := h.server.FileServer().Stat(name)
+	if errors.Is(err, fileserv.ErrNotExist) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, newFileJson(info))
+}
+
+func (h *handler) file(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	fileServ := h.server.FileServer()
+
+	if name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("Missing file name"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		file, err := fileServ.Read(name)
+		if errors.Is(err, fileserv.ErrNotExist) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(file.Data)
+	case "PUT":
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, errors.New(fmt.Sprintf("File larger than %v bytes", maxUploadBytes)))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// Staged uploads count as existing, so a name being written by a
+		// client is refused too
+		err = fileServ.Write(&fileserv.File{Name: name, Data: data})
+		if errors.Is(err, fileserv.ErrExist) {
+			writeError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		logrus.Infof("[Admin]: Uploaded '%v' with %v bytes", name, len(data))
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		err := fileServ.Delete(name)
+		if errors.Is(err, fileserv.ErrNotExist) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		logrus.Infof("[Admin]: Deleted '%v'", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Method %v not allowed", r.Method)))
+	}
+}
+
+func (h *handler) ports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Method %v not allowed", r.Method)))
+		return
+	}
+
+	ports := portsJson{}
+	if user, ok := h.server.Transport().(portUser); ok {
+		ports.InUse, ports.Total = user.PortUsage()
+	}
+
+	writeJson(w, http.StatusOK, ports)
+}
+
+func (h *handler) limits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		limits := []limitJson{}
+		for _, l := range h.server.RateLimits() {
+			limits = append(limits, limitJson{Client: l.Client, File: l.File, Scope: l.Scope, Rate: l.Rate, Burst: l.Burst})
+		}
+
+		writeJson(w, http.StatusOK, limits)
+	case "PUT":
+		var body []limitJson
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		limits := []tftp.RateLimit{}
+		for _, l := range body {
+			limits = append(limits, tftp.RateLimit{Client: l.Client, File: l.File, Scope: l.Scope, Rate: l.Rate, Burst: l.Burst})
+		}
+
+		if err := h.server.SetRateLimits(limits); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		logrus.Infof("[Admin]: Set %v rate limits", len(limits))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New(fmt.Sprintf("Method %v not allowed", r.Method)))
+	}
+}
+
+func newFileJson(info *fileserv.FileInfo) fileJson {
+	return fileJson{
+		Name:     info.Name,
+		Size:     info.Size,
+		ModTime:  info.ModTime,
+		Checksum: info.Checksum,
+		Digests:  info.Digests,
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, errorJson{Error: err.Error()})
+}
@@ -0,0 +1,175 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp"
+)
+
+const testToken = "secret"
+
+func doRequest(t *testing.T, h http.Handler, method string, path string, token string, body []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	h := NewHandler(tftp.NewServer(fileserv.NewMemFileServer()), testToken)
+
+	if rec := doRequest(t, h, "GET", "/files", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %v without a token, received %v", http.StatusUnauthorized, rec.Code)
+	}
+
+	if rec := doRequest(t, h, "GET", "/files", "wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %v with a wrong token, received %v", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestAdminFileLifecycle(t *testing.T) {
+	server := tftp.NewServer(fileserv.NewMemFileServer())
+	h := NewHandler(server, testToken)
+	data := []byte{0, 1, 2, 3, 4}
+
+	if rec := doRequest(t, h, "PUT", "/files/boot/kernel", testToken, data); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status %v on upload, received %v: %v", http.StatusCreated, rec.Code, rec.Body)
+	}
+
+	if rec := doRequest(t, h, "PUT", "/files/boot/kernel", testToken, data); rec.Code != http.StatusConflict {
+		t.Errorf("Expected status %v on second upload, received %v", http.StatusConflict, rec.Code)
+	}
+
+	rec := doRequest(t, h, "GET", "/files?prefix=boot/", testToken, nil)
+	var files []fileJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &files); err != nil {
+		t.Fatalf("Failed to decode file list %v: %v", rec.Body, err)
+	}
+
+	if len(files) != 1 || files[0].Name != "boot/kernel" || files[0].Size != len(data) {
+		t.Errorf("Expected boot/kernel with %v bytes, received %v", len(data), files)
+	}
+
+	rec = doRequest(t, h, "GET", "/files/boot/kernel", testToken, nil)
+	if body, _ := ioutil.ReadAll(rec.Body); !bytes.Equal(body, data) {
+		t.Errorf("Expected downloaded data %v, received %v", data, body)
+	}
+
+	rec = doRequest(t, h, "GET", "/stat/boot/kernel", testToken, nil)
+	var stat fileJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &stat); err != nil || stat.Digests[fileserv.SHA256] != fileserv.Checksum(data) {
+		t.Errorf("Expected the SHA-256 digest of boot/kernel, received %v, %v", rec.Body, err)
+	}
+
+	if rec = doRequest(t, h, "DELETE", "/files/boot/kernel", testToken, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status %v on delete, received %v", http.StatusNoContent, rec.Code)
+	}
+
+	if rec = doRequest(t, h, "GET", "/files/boot/kernel", testToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v after delete, received %v", http.StatusNotFound, rec.Code)
+	}
+
+	if rec = doRequest(t, h, "GET", "/stat/boot/kernel", testToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v for the stat of a deleted file, received %v", http.StatusNotFound, rec.Code)
+	}
+	if rec = doRequest(t, h, "DELETE", "/files/boot/kernel", testToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v deleting a deleted file, received %v", http.StatusNotFound, rec.Code)
+	}
+
+	// A file being uploaded over TFTP is staged under its name
+	server.FileServer().Stage("boot/initrd")
+	if rec = doRequest(t, h, "PUT", "/files/boot/initrd", testToken, data); rec.Code != http.StatusConflict {
+		t.Errorf("Expected status %v uploading a staged file, received %v", http.StatusConflict, rec.Code)
+	}
+}
+
+func TestAdminUploadTooLarge(t *testing.T) {
+	defer func(max int64) { maxUploadBytes = max }(maxUploadBytes)
+	maxUploadBytes = 4
+
+	server := tftp.NewServer(fileserv.NewMemFileServer())
+	h := NewHandler(server, testToken)
+
+	if rec := doRequest(t, h, "PUT", "/files/big", testToken, []byte{0, 1, 2, 3, 4}); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %v uploading more than %v bytes, received %v", http.StatusRequestEntityTooLarge, maxUploadBytes, rec.Code)
+	}
+
+	if server.FileServer().FileExists("big") {
+		t.Errorf("Expected a refused upload not to be stored")
+	}
+
+	if rec := doRequest(t, h, "PUT", "/files/small", testToken, []byte{0, 1, 2, 3}); rec.Code != http.StatusCreated {
+		t.Errorf("Expected status %v uploading %v bytes, received %v", http.StatusCreated, maxUploadBytes, rec.Code)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	h := NewHandler(tftp.NewServer(fileserv.NewMemFileServer()), testToken)
+
+	rec := doRequest(t, h, "GET", "/sessions", testToken, nil)
+	var sessions []sessionJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil || len(sessions) != 0 {
+		t.Errorf("Expected an empty session list, received %v, %v", rec.Body, err)
+	}
+
+	if rec = doRequest(t, h, "DELETE", "/sessions/127.0.0.1:69", testToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v cancelling an unknown session, received %v", http.StatusNotFound, rec.Code)
+	}
+
+	if rec = doRequest(t, h, "DELETE", "/sessions/7", testToken, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v cancelling an unknown session ID, received %v", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestAdminPorts(t *testing.T) {
+	transport := tftp.NewMuxTransport(&tftp.UDPTransport{MinPort: 50000, MaxPort: 50009})
+	h := NewHandler(tftp.NewServerWithTransport(fileserv.NewMemFileServer(), transport), testToken)
+
+	rec := doRequest(t, h, "GET", "/ports", testToken, nil)
+	var ports portsJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &ports); err != nil || ports.InUse != 0 || ports.Total != 10 {
+		t.Errorf("Expected 0 of 10 ports in use in single port mode, received %v, %v", rec.Body, err)
+	}
+}
+
+func TestAdminLimits(t *testing.T) {
+	server := tftp.NewServer(fileserv.NewMemFileServer())
+	h := NewHandler(server, testToken)
+
+	body := []byte(`[{"file":"*.img","rate":1000000},{"client":"10.0.0.0/8","scope":"client","rate":5000,"burst":10000}]`)
+	if rec := doRequest(t, h, "PUT", "/limits", testToken, body); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %v setting limits, received %v: %v", http.StatusNoContent, rec.Code, rec.Body)
+	}
+
+	if limits := server.RateLimits(); len(limits) != 2 || limits[1].Client != "10.0.0.0/8" || limits[1].Scope != tftp.ScopeClient || limits[1].Burst != 10000 {
+		t.Errorf("Unexpected limits set: %v", limits)
+	}
+
+	rec := doRequest(t, h, "GET", "/limits", testToken, nil)
+	var limits []limitJson
+	if err := json.Unmarshal(rec.Body.Bytes(), &limits); err != nil || len(limits) != 2 || limits[0].File != "*.img" || limits[1].Scope != tftp.ScopeClient {
+		t.Errorf("Unexpected limits listed: %v, %v", rec.Body, err)
+	}
+
+	if rec := doRequest(t, h, "PUT", "/limits", testToken, []byte(`[{"client":"bogus","rate":1}]`)); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %v for an invalid limit, received %v", http.StatusBadRequest, rec.Code)
+	}
+
+	if len(server.RateLimits()) != 2 {
+		t.Errorf("An invalid limit mustn't replace the limits")
+	}
+}
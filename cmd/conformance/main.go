@@ -0,0 +1,53 @@
+// Command conformance runs the conformance checks against a TFTP server
+//
+//	$ go run cmd/conformance/main.go -server localhost:69
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gabrielhartmann/tftp/conformance"
+)
+
+func main() {
+	server := flag.String("server", "", "Address of the TFTP server to check, e.g. localhost:69")
+	timeout := flag.Duration("timeout", 5*time.Second, "How long to wait for replies, longer than the server's retransmission timeout")
+	prefix := flag.String("prefix", "conformance-", "Prefix of the names of the files written to the server")
+	flag.Parse()
+
+	if *server == "" {
+		fmt.Fprintln(os.Stderr, "The -server flag is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid server address '%v': %v\n", *server, err)
+		os.Exit(2)
+	}
+
+	passed, skipped, failed := 0, 0, 0
+	for _, result := range conformance.Run(conformance.Config{Server: addr, Timeout: *timeout, Prefix: *prefix}) {
+		switch {
+		case !result.Passed():
+			failed++
+			fmt.Printf("FAIL  %-20v %v\n      %v\n", result.Name, result.Description, result.Err)
+		case result.Skipped != "":
+			skipped++
+			fmt.Printf("SKIP  %-20v %v (%v)\n", result.Name, result.Description, result.Skipped)
+		default:
+			passed++
+			fmt.Printf("PASS  %-20v %v\n", result.Name, result.Description)
+		}
+	}
+
+	fmt.Printf("%v passed, %v skipped, %v failed\n", passed, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,526 @@
+// Package config loads the settings of a TFTP server from a YAML file:
+//
+//	listen: [":69"]
+//	port_range: 50000-50100
+//	timeout: 3s
+//	retries: 3
+//	mounts:
+//	  - path: /
+//	  - path: /uploads
+//	    max_bytes: 104857600
+//	    ttl: 24h
+//	  - path: /backups
+//	    dedup: true
+//	access:
+//	  - client: 10.0.0.0/8
+//	    file: "uploads/*"
+//	    direction: write
+//	    action: allow
+//	  - direction: write
+//	    action: deny
+//	limits:
+//	  - file: "*.img"
+//	    scope: session
+//	    rate: 2000000
+//	integrity:
+//	  digests: [md5]
+//	  require_sidecar: true
+//	  quarantine: quarantine/
+//	log:
+//	  level: info
+//	  file: /var/log/tftp.log
+//	admin:
+//	  addr: localhost:8069
+//	  token: secret
+//
+// Access rules, rate limits and logging can be changed by reloading the
+// file while the server runs.  The other settings need a restart.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// Addresses to listen for requests on, ":69" when not set
+	Listen []string `yaml:"listen"`
+
+	// Inclusive range of ports for transfers, e.g. 50000-50100
+	PortRange string `yaml:"port_range"`
+
+	// Run every session over the listening port
+	SinglePort bool `yaml:"single_port"`
+
+	// How long to wait for a reply, 3s when not set
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retransmissions before giving up on a client, 3 when not set
+	Retries int `yaml:"retries"`
+
+	// In memory file servers mounted at path prefixes, a single one at
+	// "/" when not set
+	Mounts []Mount `yaml:"mounts"`
+
+	Access    []Access  `yaml:"access"`
+	Limits    []Limit   `yaml:"limits"`
+	Integrity Integrity `yaml:"integrity"`
+	Log       Log       `yaml:"log"`
+	Admin     Admin     `yaml:"admin"`
+}
+
+type Mount struct {
+	Path     string        `yaml:"path"`
+	MaxBytes int           `yaml:"max_bytes"`
+	TTL      time.Duration `yaml:"ttl"`
+
+	// Store files with the same contents once, without a size limit or ttl
+	Dedup bool `yaml:"dedup"`
+}
+
+// How often deduplicating mounts collect unreferenced contents
+const dedupGCInterval = time.Minute
+
+// Access rules are checked in order and the first matching one decides
+type Access struct {
+	Client    string `yaml:"client"`
+	File      string `yaml:"file"`
+	Direction string `yaml:"direction"`
+	Action    string `yaml:"action"`
+}
+
+type Limit struct {
+	Client string `yaml:"client"`
+	File   string `yaml:"file"`
+
+	// global, client or session, global when not set
+	Scope string `yaml:"scope"`
+
+	Rate  int `yaml:"rate"`
+	Burst int `yaml:"burst"`
+}
+
+type Integrity struct {
+	// Digests of uploads computed besides sha256: md5 or crc32
+	Digests []string `yaml:"digests"`
+
+	// Uploads must be preceded by a <name>.sha256 file
+	RequireSidecar bool `yaml:"require_sidecar"`
+
+	// Prefix uploads failing the check are kept under, dropped when not set
+	Quarantine string `yaml:"quarantine"`
+}
+
+type Log struct {
+	// debug, info, warn or error, info when not set
+	Level string `yaml:"level"`
+
+	// Logs go to stderr when not set
+	File string `yaml:"file"`
+
+	// text or json, text when not set
+	Format string `yaml:"format"`
+}
+
+type Admin struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token"`
+}
+
+// Load reads and validates a configuration file
+func Load(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := Parse(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%v: %v", file, err))
+	}
+
+	return c, nil
+}
+
+// Parse decodes and validates a configuration.  Unknown settings are
+// errors, so that typos don't go unnoticed.
+func Parse(data []byte) (*Config, error) {
+	c := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	c.setDefaults()
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Listen) == 0 {
+		c.Listen = []string{":69"}
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = 3 * time.Second
+	}
+
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+
+	if len(c.Mounts) == 0 {
+		c.Mounts = []Mount{{Path: "/"}}
+	}
+
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+
+	if c.Log.Format == "" {
+		c.Log.Format = "text"
+	}
+}
+
+// Validate checks every setting, naming the first invalid one in the error
+func (c *Config) Validate() error {
+	for i, addr := range c.Listen {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			return fieldError("listen[%v]", i, "Invalid address '%v', expected e.g. :69 or 0.0.0.0:69", addr)
+		} else if err := checkPort(port); err != nil {
+			return fieldError("listen[%v]", i, "Invalid port in '%v'", addr)
+		}
+	}
+
+	if c.PortRange != "" {
+		if _, _, err := tftp.ParsePortRange(c.PortRange); err != nil {
+			return fieldError("port_range", nil, "%v", err)
+		}
+	}
+
+	if c.Timeout < 0 {
+		return fieldError("timeout", nil, "Invalid timeout %v, expected e.g. 3s", c.Timeout)
+	}
+
+	if c.Retries < 0 {
+		return fieldError("retries", nil, "Invalid number of retries %v", c.Retries)
+	}
+
+	paths := make(map[string]int)
+	for i, mount := range c.Mounts {
+		name := strings.Trim(mount.Path, "/")
+		if first, ok := paths[name]; ok {
+			return fieldError("mounts[%v].path", i, "'%v' is already mounted by mounts[%v]", mount.Path, first)
+		}
+		paths[name] = i
+
+		if mount.MaxBytes < 0 {
+			return fieldError("mounts[%v].max_bytes", i, "Invalid size %v", mount.MaxBytes)
+		}
+
+		if mount.TTL < 0 {
+			return fieldError("mounts[%v].ttl", i, "Invalid ttl %v", mount.TTL)
+		}
+
+		if mount.Dedup && (mount.MaxBytes != 0 || mount.TTL != 0) {
+			return fieldError("mounts[%v].dedup", i, "Deduplicating mounts can't have a max_bytes or ttl")
+		}
+	}
+
+	for i, rule := range c.Access {
+		if err := checkClient(rule.Client); err != nil {
+			return fieldError("access[%v].client", i, "%v", err)
+		}
+
+		if err := checkPattern(rule.File); err != nil {
+			return fieldError("access[%v].file", i, "%v", err)
+		}
+
+		if rule.Direction != "" && rule.Direction != tftp.DirectionRead && rule.Direction != tftp.DirectionWrite {
+			return fieldError("access[%v].direction", i, "Invalid direction '%v', expected read or write", rule.Direction)
+		}
+
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return fieldError("access[%v].action", i, "Invalid action '%v', expected allow or deny", rule.Action)
+		}
+	}
+
+	for i, limit := range c.Limits {
+		if err := checkClient(limit.Client); err != nil {
+			return fieldError("limits[%v].client", i, "%v", err)
+		}
+
+		if err := checkPattern(limit.File); err != nil {
+			return fieldError("limits[%v].file", i, "%v", err)
+		}
+
+		if limit.Scope != "" && limit.Scope != tftp.ScopeGlobal && limit.Scope != tftp.ScopeClient && limit.Scope != tftp.ScopeSession {
+			return fieldError("limits[%v].scope", i, "Invalid scope '%v', expected global, client or session", limit.Scope)
+		}
+
+		if limit.Rate <= 0 {
+			return fieldError("limits[%v].rate", i, "Invalid rate %v, expected a positive number of bytes per second", limit.Rate)
+		}
+
+		if limit.Burst < 0 {
+			return fieldError("limits[%v].burst", i, "Invalid burst %v", limit.Burst)
+		}
+	}
+
+	for i, algorithm := range c.Integrity.Digests {
+		if _, err := fileserv.NewHash(algorithm); err != nil {
+			return fieldError("integrity.digests[%v]", i, "%v", err)
+		}
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		return fieldError("log.level", nil, "Invalid level '%v', expected debug, info, warn or error", c.Log.Level)
+	}
+
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return fieldError("log.format", nil, "Invalid format '%v', expected text or json", c.Log.Format)
+	}
+
+	if c.Admin.Addr != "" && c.Admin.Token == "" {
+		return fieldError("admin.token", nil, "The admin API requires a non-empty token")
+	}
+
+	return nil
+}
+
+// NewServer creates a server with the transport, file servers and
+// rules of the configuration
+func (c *Config) NewServer() (*tftp.Server, error) {
+	udpTransport := &tftp.UDPTransport{}
+	if c.PortRange != "" {
+		udpTransport.MinPort, udpTransport.MaxPort, _ = tftp.ParsePortRange(c.PortRange)
+	}
+
+	var transport tftp.Transport = udpTransport
+	if c.SinglePort {
+		transport = tftp.NewMuxTransport(transport)
+	}
+
+	router := fileserv.NewRouterFileServer()
+	for _, mount := range c.Mounts {
+		if mount.Dedup {
+			router.Mount(mount.Path, fileserv.NewDedupFileServer(dedupGCInterval))
+		} else {
+			router.Mount(mount.Path, fileserv.NewBoundedMemFileServer(mount.MaxBytes, mount.TTL))
+		}
+	}
+
+	server := tftp.NewServerWithTransport(router, transport)
+	if err := server.SetTimeouts(c.Timeout, c.Retries); err != nil {
+		return nil, err
+	}
+
+	err := server.SetIntegrity(tftp.IntegrityConfig{
+		Digests:        c.Integrity.Digests,
+		RequireSidecar: c.Integrity.RequireSidecar,
+		Quarantine:     c.Integrity.Quarantine,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return server, c.Apply(server)
+}
+
+// Apply sets the settings which may change while server runs: access
+// rules, rate limits and logging.  The log file is reopened, so that
+// reloading also picks up a rotated log.  Everything is checked and the
+// log file opened before anything is set, so a failure changes nothing.
+func (c *Config) Apply(server *tftp.Server) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	rules := []tftp.AccessRule{}
+	for _, rule := range c.Access {
+		rules = append(rules, tftp.AccessRule{
+			Client:    rule.Client,
+			File:      rule.File,
+			Direction: rule.Direction,
+			Allow:     rule.Action == "allow",
+		})
+	}
+
+	limits := []tftp.RateLimit{}
+	for _, limit := range c.Limits {
+		limits = append(limits, tftp.RateLimit{
+			Client: limit.Client,
+			File:   limit.File,
+			Scope:  limit.Scope,
+			Rate:   limit.Rate,
+			Burst:  limit.Burst,
+		})
+	}
+
+	out, file, err := c.openLog()
+	if err != nil {
+		return err
+	}
+
+	oldRules := server.AccessRules()
+	if err := server.SetAccessRules(rules); err != nil {
+		closeLog(file)
+		return err
+	}
+
+	if err := server.SetRateLimits(limits); err != nil {
+		server.SetAccessRules(oldRules)
+		closeLog(file)
+		return err
+	}
+
+	c.setLog(out, file)
+	return nil
+}
+
+// Reload loads file and applies it to server, which runs with current.
+// An invalid file leaves everything as it was.  Changes to settings that
+// need a restart are logged and otherwise ignored.
+func Reload(file string, server *tftp.Server, current *Config) (*Config, error) {
+	c, err := Load(file)
+	if err != nil {
+		return current, err
+	}
+
+	for _, setting := range c.RestartNeeded(current) {
+		logrus.Warnf("[Config]: Ignoring the changed %v until restart", setting)
+	}
+
+	if err := c.Apply(server); err != nil {
+		return current, err
+	}
+
+	logrus.Infof("[Config]: Reloaded %v", file)
+	return c, nil
+}
+
+// RestartNeeded lists the settings that differ from old and only take
+// effect when the server starts
+func (c *Config) RestartNeeded(old *Config) []string {
+	settings := []string{}
+	for _, setting := range []struct {
+		name     string
+		now, was interface{}
+	}{
+		{"listen", c.Listen, old.Listen},
+		{"port_range", c.PortRange, old.PortRange},
+		{"single_port", c.SinglePort, old.SinglePort},
+		{"timeout", c.Timeout, old.Timeout},
+		{"retries", c.Retries, old.Retries},
+		{"mounts", c.Mounts, old.Mounts},
+		{"integrity", c.Integrity, old.Integrity},
+		{"admin", c.Admin, old.Admin},
+	} {
+		if !reflect.DeepEqual(setting.now, setting.was) {
+			settings = append(settings, setting.name)
+		}
+	}
+
+	return settings
+}
+
+var logFile struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// Open the log file, returning where to log and the file to close once
+// logging goes elsewhere, nil for stderr
+func (c *Config) openLog() (io.Writer, *os.File, error) {
+	if c.Log.File == "" {
+		return os.Stderr, nil, nil
+	}
+
+	f, err := os.OpenFile(c.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, f, nil
+}
+
+func closeLog(file *os.File) {
+	if file != nil {
+		file.Close()
+	}
+}
+
+func (c *Config) setLog(out io.Writer, file *os.File) {
+	level, _ := logrus.ParseLevel(c.Log.Level)
+	if c.Log.Format == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+	logrus.SetLevel(level)
+	logrus.SetOutput(out)
+
+	defer logFile.mutex.Unlock()
+	logFile.mutex.Lock()
+
+	closeLog(logFile.file)
+	logFile.file = file
+}
+
+// An error naming the setting, where index fills in the position of
+// list entries
+func fieldError(field string, index interface{}, format string, args ...interface{}) error {
+	if index != nil {
+		field = fmt.Sprintf(field, index)
+	}
+
+	return errors.New(fmt.Sprintf("%v: %v", field, fmt.Sprintf(format, args...)))
+}
+
+func checkPort(port string) error {
+	var n int
+	if _, err := fmt.Sscanf(port, "%d", &n); err != nil || n < 0 || n > 65535 || fmt.Sprint(n) != port {
+		return errors.New(fmt.Sprintf("Invalid port '%v'", port))
+	}
+
+	return nil
+}
+
+func checkClient(client string) error {
+	if client == "" || net.ParseIP(client) != nil {
+		return nil
+	}
+
+	if _, _, err := net.ParseCIDR(client); err != nil {
+		return errors.New(fmt.Sprintf("Invalid client '%v', expected an IP address or CIDR subnet", client))
+	}
+
+	return nil
+}
+
+func checkPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errors.New(fmt.Sprintf("Invalid file pattern '%v': %v", pattern, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp"
+)
+
+const example = `
+listen: ["0.0.0.0:69", "[::]:69"]
+port_range: 50000-50100
+timeout: 5s
+retries: 4
+mounts:
+  - path: /
+  - path: /uploads
+    max_bytes: 1000
+    ttl: 24h
+access:
+  - client: 10.0.0.0/8
+    file: "uploads/*"
+    direction: write
+    action: allow
+  - direction: write
+    action: deny
+limits:
+  - file: "*.img"
+    scope: session
+    rate: 2000000
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if len(c.Listen) != 2 || c.Timeout != 5*time.Second || c.Retries != 4 || c.Mounts[1].TTL != 24*time.Hour {
+		t.Errorf("Unexpected settings: %+v", c)
+	}
+
+	if c.Log.Level != "info" || c.Log.Format != "text" {
+		t.Errorf("Expected the default log settings, received %+v", c.Log)
+	}
+
+	server, err := c.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	rules := server.AccessRules()
+	if len(rules) != 2 || !rules[0].Allow || rules[1].Allow || rules[1].Direction != tftp.DirectionWrite {
+		t.Errorf("Unexpected access rules: %v", rules)
+	}
+
+	if limits := server.RateLimits(); len(limits) != 1 || limits[0].Rate != 2000000 || limits[0].Scope != tftp.ScopeSession {
+		t.Errorf("Unexpected rate limits: %v", limits)
+	}
+
+	// The uploads mount is bounded
+	err = server.FileServer().Write(&fileserv.File{Name: "uploads/big", Data: make([]byte, 1001)})
+	if err == nil {
+		t.Errorf("Expected the uploads mount to reject a file over its size limit")
+	}
+
+	if err := server.FileServer().Write(&fileserv.File{Name: "boot/big", Data: make([]byte, 1001)}); err != nil {
+		t.Errorf("Failed to write to the root mount: %v", err)
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	c, err := Parse([]byte{})
+	if err != nil {
+		t.Fatalf("Failed to parse an empty configuration: %v", err)
+	}
+
+	if len(c.Listen) != 1 || c.Listen[0] != ":69" || len(c.Mounts) != 1 || c.Timeout != 3*time.Second || c.Retries != 3 {
+		t.Errorf("Unexpected defaults: %+v", c)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"limit: []", "field limit not found"},
+		{"listen: [localhost]", "listen[0]: Invalid address 'localhost'"},
+		{"listen: [':69', ':70000']", "listen[1]: Invalid port in ':70000'"},
+		{"port_range: 100-50", "port_range: Invalid port range '100-50'"},
+		{"timeout: 3", "cannot unmarshal"},
+		{"timeout: -1s", "timeout: Invalid timeout"},
+		{"mounts: [{path: /boot}, {path: boot/}]", "mounts[1].path: 'boot/' is already mounted by mounts[0]"},
+		{"mounts: [{path: /, max_bytes: -1}]", "mounts[0].max_bytes: Invalid size -1"},
+		{"mounts: [{path: /, dedup: true, ttl: 1h}]", "mounts[0].dedup: Deduplicating mounts can't have a max_bytes or ttl"},
+		{"access: [{client: 10.0.0.0/8}]", "access[0].action: Invalid action ''"},
+		{"access: [{action: allow}, {client: 10.0.0.0/33, action: deny}]", "access[1].client: Invalid client '10.0.0.0/33'"},
+		{"access: [{direction: both, action: deny}]", "access[0].direction: Invalid direction 'both'"},
+		{"limits: [{file: '[', rate: 1}]", "limits[0].file: Invalid file pattern '['"},
+		{"limits: [{rate: 0}]", "limits[0].rate: Invalid rate 0"},
+		{"limits: [{scope: host, rate: 1}]", "limits[0].scope: Invalid scope 'host'"},
+		{"integrity: {digests: [sha1]}", "integrity.digests[0]: Unknown digest algorithm 'sha1'"},
+		{"log: {level: loud}", "log.level: Invalid level 'loud'"},
+		{"log: {format: xml}", "log.format: Invalid format 'xml'"},
+		{"admin: {addr: localhost:8069}", "admin.token: The admin API requires a non-empty token"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse([]byte(test.config))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected '%v' to fail with '%v', received: %v", test.config, test.err, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer logrus.SetOutput(os.Stderr)
+
+	file := filepath.Join(dir, "tftp.yaml")
+	ioutil.WriteFile(file, []byte(example), 0644)
+
+	current, err := Load(file)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	server, err := current.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	changed := strings.Replace(example, "rate: 2000000", "rate: 1000", 1) + "log: {file: " + filepath.Join(dir, "tftp.log") + "}\nretries: 10\n"
+	changed = strings.Replace(changed, "retries: 4\n", "", 1)
+	ioutil.WriteFile(file, []byte(changed), 0644)
+
+	reloaded, err := Reload(file, server, current)
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	if limits := server.RateLimits(); len(limits) != 1 || limits[0].Rate != 1000 {
+		t.Errorf("Expected the new rate limit to apply, received %v", limits)
+	}
+
+	if settings := reloaded.RestartNeeded(current); len(settings) != 1 || settings[0] != "retries" {
+		t.Errorf("Expected retries to need a restart, received %v", settings)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "tftp.log")); err != nil {
+		t.Errorf("Expected the log file to be opened: %v", err)
+	}
+
+	// An invalid file changes nothing
+	ioutil.WriteFile(file, []byte("limits: [{rate: -1}]"), 0644)
+	if c, err := Reload(file, server, reloaded); err == nil || c != reloaded || !strings.Contains(err.Error(), "tftp.yaml: limits[0].rate") {
+		t.Errorf("Expected the invalid file to be rejected, received %v", err)
+	}
+
+	if limits := server.RateLimits(); len(limits) != 1 || limits[0].Rate != 1000 {
+		t.Errorf("Expected the rate limit to be kept, received %v", limits)
+	}
+
+	// As does a file whose log can't be opened
+	unopenable := "limits: [{rate: 5}]\naccess: [{action: deny}]\nlog: {file: " + filepath.Join(dir, "missing", "tftp.log") + "}\n"
+	ioutil.WriteFile(file, []byte(unopenable), 0644)
+	if c, err := Reload(file, server, reloaded); err == nil || c != reloaded {
+		t.Errorf("Expected the unopenable log to be rejected, received %v", err)
+	}
+
+	if limits := server.RateLimits(); len(limits) != 1 || limits[0].Rate != 1000 {
+		t.Errorf("Expected the rate limit to be kept, received %v", limits)
+	}
+
+	if rules := server.AccessRules(); len(rules) != 2 {
+		t.Errorf("Expected the access rules to be kept, received %v", rules)
+	}
+}
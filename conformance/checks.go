@@ -0,0 +1,417 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gabrielhartmann/tftp/tftp"
+)
+
+func checkWriteRead(t *tester, file string) error {
+	data := pattern(1300)
+	if err := t.put(file, data); err != nil {
+		return err
+	}
+
+	return t.verify(file, data)
+}
+
+// verify only succeeds when the empty third block ends the transfer
+func checkExactMultiple(t *tester, file string) error {
+	data := pattern(2 * blockSize)
+	if err := t.put(file, data); err != nil {
+		return err
+	}
+
+	return t.verify(file, data)
+}
+
+func checkMissingFile(t *tester, file string) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet"})
+	return c.expectError(tftp.FileNotFound)
+}
+
+func checkExistingFile(t *tester, file string) error {
+	if err := t.put(file, pattern(100)); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.WriteRequest{Filename: file, Mode: "octet"})
+	return c.expectError(tftp.FileExists)
+}
+
+func checkLostAckRead(t *tester, file string) error {
+	data := pattern(1300)
+	if err := t.put(file, data); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet"})
+	if _, err := c.expectData(1); err != nil {
+		return err
+	}
+
+	// Act as if the ACK was lost by not sending it
+	first, err := c.expectData(1)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Block 1 wasn't retransmitted: %v", err))
+	}
+
+	return readAndCompare(c, first, blockSize, data)
+}
+
+// Answering every DATA twice must not double the DATA sent back, which
+// would then double again with every block (Sorcerer's Apprentice)
+func checkDuplicateAck(t *tester, file string) error {
+	data := pattern(3 * blockSize)
+	if err := t.put(file, data); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet"})
+	for block := uint16(1); block <= 3; block++ {
+		if _, err := c.expectData(block); err != nil {
+			return err
+		}
+
+		if block > 1 {
+			if err := c.expectSilence(t.quiet(), "the ACK was a duplicate"); err != nil {
+				return err
+			}
+		}
+
+		c.send(&tftp.Ack{Block: block})
+		c.send(&tftp.Ack{Block: block})
+	}
+
+	last, err := c.expectData(4)
+	if err != nil {
+		return err
+	}
+
+	return readAndCompare(c, last, blockSize, data[3*blockSize:])
+}
+
+func checkLostDataWrite(t *tester, file string) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.WriteRequest{Filename: file, Mode: "octet"})
+	if err := c.expectAck(0); err != nil {
+		return err
+	}
+
+	// Act as if the first block was lost by not sending it
+	if err := c.expectAck(0); err != nil {
+		return errors.New(fmt.Sprintf("ACK 0 wasn't retransmitted: %v", err))
+	}
+
+	data := pattern(1300)
+	if err := c.writeFrom(data, 1); err != nil {
+		return err
+	}
+
+	return t.verify(file, data)
+}
+
+func checkDuplicateData(t *tester, file string) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.WriteRequest{Filename: file, Mode: "octet"})
+	if err := c.expectAck(0); err != nil {
+		return err
+	}
+
+	data := pattern(blockSize + 100)
+	first := &tftp.Data{Block: 1, Data: data[:blockSize]}
+	c.send(first)
+	if err := c.expectAck(1); err != nil {
+		return err
+	}
+
+	c.send(first)
+	if err := c.expectAck(1); err != nil {
+		return errors.New(fmt.Sprintf("Duplicate block 1 wasn't ACKed again: %v", err))
+	}
+
+	if err := c.writeFrom(data, 2); err != nil {
+		return err
+	}
+
+	return t.verify(file, data)
+}
+
+// The server has to linger after the final ACK in case it was lost
+func checkLostFinalAck(t *tester, file string) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.WriteRequest{Filename: file, Mode: "octet"})
+	if err := c.expectAck(0); err != nil {
+		return err
+	}
+
+	data := pattern(100)
+	c.send(&tftp.Data{Block: 1, Data: data})
+	if err := c.expectAck(1); err != nil {
+		return err
+	}
+
+	c.send(&tftp.Data{Block: 1, Data: data})
+	if err := c.expectAck(1); err != nil {
+		return errors.New(fmt.Sprintf("Final block wasn't ACKed again: %v", err))
+	}
+
+	return t.verify(file, data)
+}
+
+func checkUnknownTid(t *tester, file string) error {
+	data := pattern(1300)
+	if err := t.put(file, data); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet"})
+	first, err := c.expectData(1)
+	if err != nil {
+		return err
+	}
+
+	// A second socket sends to the transfer ID of the first
+	intruder, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer intruder.Close()
+
+	intruder.tid = c.tid
+	intruder.send(&tftp.Ack{Block: 1})
+	if err := intruder.expectError(tftp.UnknownTid); err != nil {
+		return errors.New(fmt.Sprintf("Unknown transfer ID: %v", err))
+	}
+
+	return readAndCompare(c, first, blockSize, data)
+}
+
+func checkOversizedData(t *tester, file string) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.WriteRequest{Filename: file, Mode: "octet"})
+	if err := c.expectAck(0); err != nil {
+		return err
+	}
+
+	// Data.MarshalBinary refuses oversized blocks
+	c.sendBytes(append([]byte{0, tftp.DATA, 0, 1}, pattern(blockSize+100)...))
+	return c.expectError()
+}
+
+func checkBadOpcodeRequest(t *tester, file string) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.sendBytes(append([]byte{0, 42}, file+"\x00octet\x00"...))
+	return c.expectError(tftp.IllegalOperation)
+}
+
+func checkBadOpcodeTransfer(t *tester, file string) error {
+	if err := t.put(file, pattern(1300)); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet"})
+	if _, err := c.expectData(1); err != nil {
+		return err
+	}
+
+	c.sendBytes([]byte{0, 42, 0, 1})
+	return c.expectError(tftp.IllegalOperation)
+}
+
+// A server may ignore options and answer with DATA 1, or acknowledge
+// those it supports with values it can honour
+func checkOptionNegotiation(t *tester, file string) error {
+	data := pattern(1300)
+	if err := t.put(file, data); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet", Options: map[string]string{
+		"blksize": "1024",
+		"tsize":   "0",
+	}})
+
+	p, err := c.expect("OACK or DATA 1", func(p tftp.Packet) bool {
+		data, isData := p.(*tftp.Data)
+		_, isOack := p.(*tftp.OptionAck)
+		return isOack || isData && data.Block == 1
+	})
+	if err != nil {
+		return err
+	}
+
+	if first, ok := p.(*tftp.Data); ok {
+		return readAndCompare(c, first, blockSize, data)
+	}
+
+	size := blockSize
+	for name, value := range p.(*tftp.OptionAck).Options {
+		switch strings.ToLower(name) {
+		case "blksize":
+			if size, err = strconv.Atoi(value); err != nil || size < 8 || size > 1024 {
+				return errors.New(fmt.Sprintf("Acknowledged blksize %v outside of 8 to the 1024 requested", value))
+			}
+		case "tsize":
+			if value != strconv.Itoa(len(data)) {
+				return errors.New(fmt.Sprintf("Acknowledged tsize %v for a file of %v bytes", value, len(data)))
+			}
+		default:
+			return errors.New(fmt.Sprintf("Acknowledged option '%v' which wasn't requested", name))
+		}
+	}
+
+	c.send(&tftp.Ack{Block: 0})
+	first, err := c.expectData(1)
+	if err != nil {
+		return err
+	}
+
+	return readAndCompare(c, first, size, data)
+}
+
+func checkUnknownOption(t *tester, file string) error {
+	data := pattern(100)
+	if err := t.put(file, data); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet", Options: map[string]string{"x-conformance": "1"}})
+	p, err := c.expect("OACK or DATA 1", func(p tftp.Packet) bool {
+		data, isData := p.(*tftp.Data)
+		_, isOack := p.(*tftp.OptionAck)
+		return isOack || isData && data.Block == 1
+	})
+	if err != nil {
+		return err
+	}
+
+	if oack, ok := p.(*tftp.OptionAck); ok {
+		if len(oack.Options) > 0 {
+			return errors.New(fmt.Sprintf("Acknowledged unknown options %v", oack.Options))
+		}
+
+		c.send(&tftp.Ack{Block: 0})
+		if p, err = c.expectData(1); err != nil {
+			return err
+		}
+	}
+
+	return readAndCompare(c, p.(*tftp.Data), blockSize, data)
+}
+
+func checkOptionRefusal(t *tester, file string) error {
+	if err := t.put(file, pattern(1300)); err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.send(&tftp.ReadRequest{Filename: file, Mode: "octet", Options: map[string]string{"blksize": "1024"}})
+	p, err := c.receive(c.timeout)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := p.(*tftp.OptionAck); !ok {
+		c.send(&tftp.Error{Code: tftp.UndefinedError, Msg: "Conformance check done"})
+		return &skipError{"The server doesn't negotiate options"}
+	}
+
+	c.send(&tftp.Error{Code: tftp.OptionRefused, Msg: "Options refused"})
+	return c.expectSilence(c.timeout, "the options were refused")
+}
+
+func readAndCompare(c *client, first *tftp.Data, size int, expected []byte) error {
+	received, err := c.readFrom(first, size)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(received, expected) {
+		return errors.New(fmt.Sprintf("Received %v bytes which differ from the %v bytes written", len(received), len(expected)))
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gabrielhartmann/tftp/tftp"
+)
+
+const blockSize = 512
+
+type tester struct {
+	config Config
+	run    int64
+}
+
+// A lockstep client for one transfer.  It never retransmits on its own,
+// the checks decide what to send.
+type client struct {
+	conn    net.PacketConn
+	server  net.Addr
+	tid     net.Addr
+	timeout time.Duration
+	buf     []byte
+}
+
+func (t *tester) dial() (*client, error) {
+	conn, err := t.config.Listen()
+	if err != nil {
+		return nil, err
+	}
+
+	return &client{
+		conn:    conn,
+		server:  t.config.Server,
+		timeout: t.config.Timeout,
+		buf:     make([]byte, 65536),
+	}, nil
+}
+
+// Long enough for a reply to arrive, short enough not to include a
+// retransmission by the server
+func (t *tester) quiet() time.Duration {
+	return t.config.Timeout / 5
+}
+
+func (c *client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *client) send(p tftp.Packet) error {
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return c.sendBytes(b)
+}
+
+// Send to the transfer ID, or to the server before the first reply
+func (c *client) sendBytes(b []byte) error {
+	dest := c.tid
+	if dest == nil {
+		dest = c.server
+	}
+
+	_, err := c.conn.WriteTo(b, dest)
+	return err
+}
+
+// Receive the next packet.  The first reply sets the transfer ID, after
+// which replies from any other address are an error.
+func (c *client) receive(timeout time.Duration) (tftp.Packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := c.conn.ReadFrom(c.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.tid == nil {
+		c.tid = addr
+	} else if addr.String() != c.tid.String() {
+		return nil, errors.New(fmt.Sprintf("Reply from %v instead of the transfer ID %v", addr, c.tid))
+	}
+
+	p, err := tftp.ParsePacket(c.buf[:n])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Malformed reply %q: %v", c.buf[:n], err))
+	}
+
+	return p, nil
+}
+
+func (c *client) expect(want string, match func(p tftp.Packet) bool) (tftp.Packet, error) {
+	p, err := c.receive(c.timeout)
+	if isTimeout(err) {
+		return nil, errors.New(fmt.Sprintf("No reply within %v, expected %v", c.timeout, want))
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !match(p) {
+		return nil, errors.New(fmt.Sprintf("Received %v, expected %v", p, want))
+	}
+
+	return p, nil
+}
+
+func (c *client) expectData(block uint16) (*tftp.Data, error) {
+	p, err := c.expect(fmt.Sprintf("DATA %v", block), func(p tftp.Packet) bool {
+		data, ok := p.(*tftp.Data)
+		return ok && data.Block == block
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p.(*tftp.Data), nil
+}
+
+func (c *client) expectAck(block uint16) error {
+	_, err := c.expect(fmt.Sprintf("ACK %v", block), func(p tftp.Packet) bool {
+		ack, ok := p.(*tftp.Ack)
+		return ok && ack.Block == block
+	})
+
+	return err
+}
+
+// Expect an error packet with one of codes, or any code when none are given
+func (c *client) expectError(codes ...uint16) error {
+	want := fmt.Sprintf("ERROR %v", codes)
+	if len(codes) == 0 {
+		want = "ERROR"
+	}
+
+	_, err := c.expect(want, func(p tftp.Packet) bool {
+		e, ok := p.(*tftp.Error)
+		if !ok {
+			return false
+		}
+
+		for _, code := range codes {
+			if e.Code == code {
+				return true
+			}
+		}
+
+		return len(codes) == 0
+	})
+
+	return err
+}
+
+// Expect no packet for a while, because of what the client did last
+func (c *client) expectSilence(wait time.Duration, because string) error {
+	p, err := c.receive(wait)
+	if isTimeout(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return errors.New(fmt.Sprintf("Received %v, expected nothing as %v", p, because))
+}
+
+// ACK the block received and every following one until the transfer ends
+func (c *client) readFrom(data *tftp.Data, size int) ([]byte, error) {
+	received := []byte{}
+	for {
+		received = append(received, data.Data...)
+		if err := c.send(&tftp.Ack{Block: data.Block}); err != nil {
+			return nil, err
+		}
+
+		if len(data.Data) < size {
+			return received, nil
+		}
+
+		var err error
+		if data, err = c.expectData(data.Block + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Send data from block onwards, after the server ACKed the block before
+func (c *client) writeFrom(data []byte, block uint16) error {
+	for ; ; block++ {
+		start := int(block-1) * blockSize
+		end := start + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := c.send(&tftp.Data{Block: block, Data: data[start:end]}); err != nil {
+			return err
+		}
+
+		if err := c.expectAck(block); err != nil {
+			return err
+		}
+
+		if end-start < blockSize {
+			return nil
+		}
+	}
+}
+
+func (t *tester) get(file string) ([]byte, error) {
+	c, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.send(&tftp.ReadRequest{Filename: file, Mode: "octet"}); err != nil {
+		return nil, err
+	}
+
+	data, err := c.expectData(1)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readFrom(data, blockSize)
+}
+
+func (t *tester) put(file string, data []byte) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.send(&tftp.WriteRequest{Filename: file, Mode: "octet"}); err != nil {
+		return err
+	}
+
+	if err := c.expectAck(0); err != nil {
+		return err
+	}
+
+	return c.writeFrom(data, 1)
+}
+
+// Check the server holds exactly data for file
+func (t *tester) verify(file string, data []byte) error {
+	received, err := t.get(file)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Reading back '%v' failed: %v", file, err))
+	}
+
+	if !bytes.Equal(received, data) {
+		return errors.New(fmt.Sprintf("Read back %v bytes of '%v' which differ from the %v bytes written", len(received), file, len(data)))
+	}
+
+	return nil
+}
+
+func pattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	return data
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
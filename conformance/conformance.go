@@ -0,0 +1,109 @@
+// Package conformance checks a TFTP server against RFC 1350 and the
+// option extensions of RFC 2347-2349.  It acts as a scripted client that
+// loses, repeats and mangles packets on purpose and checks every reply.
+package conformance
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+type Config struct {
+	// Address the server under test listens on
+	Server net.Addr
+
+	// Opens a client socket.  UDP on an ephemeral port when nil.
+	Listen func() (net.PacketConn, error)
+
+	// How long to wait for any reply, including retransmissions by the
+	// server.  Must be longer than the server's own timeout.  5 seconds
+	// when not set.
+	Timeout time.Duration
+
+	// Files written by the checks are named with this prefix
+	Prefix string
+}
+
+type Result struct {
+	Name        string
+	Description string
+
+	// Why the check didn't apply to the server, empty when it ran
+	Skipped string
+
+	// Why the check failed, nil when it passed or was skipped
+	Err error
+}
+
+func (r *Result) Passed() bool {
+	return r.Err == nil
+}
+
+type check struct {
+	name        string
+	description string
+	run         func(t *tester, file string) error
+}
+
+var checks = []check{
+	{"write-read", "A file written with WRQ reads back unchanged", checkWriteRead},
+	{"exact-multiple", "A file of a multiple of 512 bytes ends with an empty DATA block", checkExactMultiple},
+	{"missing-file", "Reading a missing file gets error 1", checkMissingFile},
+	{"existing-file", "Writing an existing file gets error 6", checkExistingFile},
+	{"lost-ack-read", "DATA is retransmitted when its ACK is lost", checkLostAckRead},
+	{"duplicate-ack", "Duplicate ACKs don't cause duplicate DATA", checkDuplicateAck},
+	{"lost-data-write", "An ACK is retransmitted when the next DATA is lost", checkLostDataWrite},
+	{"duplicate-data", "A duplicate DATA block is ACKed again and stored once", checkDuplicateData},
+	{"lost-final-ack", "The final DATA is ACKed again when the final ACK is lost", checkLostFinalAck},
+	{"unknown-tid", "A packet from an unknown TID gets error 5 without ending the transfer", checkUnknownTid},
+	{"oversized-data", "A DATA block longer than 512 bytes gets an error", checkOversizedData},
+	{"bad-opcode-request", "An unknown opcode sent to the server port gets error 4", checkBadOpcodeRequest},
+	{"bad-opcode-transfer", "An unknown opcode during a transfer gets error 4", checkBadOpcodeTransfer},
+	{"option-negotiation", "Requested options are acknowledged correctly or ignored", checkOptionNegotiation},
+	{"unknown-option", "Unknown options are left out of the OACK", checkUnknownOption},
+	{"option-refusal", "A client refusing the OACK with error 8 ends the transfer", checkOptionRefusal},
+}
+
+// Run every check in turn against the server
+func Run(config Config) []Result {
+	if config.Listen == nil {
+		config.Listen = func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", ":0")
+		}
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	t := &tester{
+		config: config,
+		run:    time.Now().UnixNano(),
+	}
+
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		result := Result{Name: c.name, Description: c.description}
+		if err := c.run(t, fmt.Sprintf("%v%v-%v", config.Prefix, c.name, t.run)); err != nil {
+			if skip, ok := err.(*skipError); ok {
+				result.Skipped = skip.reason
+			} else {
+				result.Err = err
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Returned by checks that don't apply to the server
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
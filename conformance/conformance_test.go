@@ -0,0 +1,61 @@
+package conformance
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+func TestServerConforms(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	server := tftp.NewServerWithTransport(NewMemFileServer(), network)
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(conn)
+
+	results := Run(Config{
+		Server: conn.LocalAddr(),
+		Listen: func() (net.PacketConn, error) {
+			return network.ListenUDP(nil)
+		},
+	})
+
+	if len(results) != len(checks) {
+		t.Errorf("Expected %v results, received %v", len(checks), len(results))
+	}
+
+	for _, result := range results {
+		if !result.Passed() {
+			t.Errorf("%v: %v", result.Name, result.Err)
+		} else if result.Skipped != "" {
+			t.Logf("%v skipped: %v", result.Name, result.Skipped)
+		}
+	}
+}
+
+func TestNoServerFailsEveryCheck(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	results := Run(Config{
+		Server: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69},
+		Listen: func() (net.PacketConn, error) {
+			return network.ListenUDP(nil)
+		},
+		Timeout: time.Second,
+	})
+
+	for _, result := range results {
+		if result.Passed() {
+			t.Errorf("Expected %v to fail without a server", result.Name)
+		}
+	}
+}
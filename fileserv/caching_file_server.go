@@ -0,0 +1,134 @@
+package fileserv
+
+import (
+	. "sync"
+	"time"
+)
+
+// CachingFileServer serves hot files from memory in front of a slower
+// backend.  Concurrent reads of a file missing from the cache share a
+// single backend fetch, and every change made through the caching server
+// invalidates the cached copy.
+type CachingFileServer struct {
+	backend FileServer
+	cache   *InMemFileServer
+	mutex   *Mutex
+	fetches map[string]*fetch
+}
+
+// A backend read shared by every reader of the same file
+type fetch struct {
+	done        chan struct{}
+	file        *File
+	err         error
+	invalidated bool
+}
+
+// NewCachingFileServer wraps backend with a cache holding at most maxBytes,
+// evicting the least recently used files first.  A positive ttl bounds how
+// long a file is served from memory before being fetched again, which
+// matters when the backend is also changed by other means.
+func NewCachingFileServer(backend FileServer, maxBytes int, ttl time.Duration) *CachingFileServer {
+	return &CachingFileServer{
+		backend: backend,
+		cache:   NewBoundedMemFileServer(maxBytes, ttl),
+		mutex:   &Mutex{},
+		fetches: make(map[string]*fetch),
+	}
+}
+
+func (s *CachingFileServer) Write(file *File) error {
+	defer s.invalidate(file.Name)
+	return s.backend.Write(file)
+}
+
+func (s *CachingFileServer) Read(file string) (*File, error) {
+	if f, err := s.cache.Read(file); err == nil {
+		return f, nil
+	}
+
+	s.mutex.Lock()
+	if f, ok := s.fetches[file]; ok {
+		s.mutex.Unlock()
+		<-f.done
+		return f.file, f.err
+	}
+
+	f := &fetch{done: make(chan struct{})}
+	s.fetches[file] = f
+	s.mutex.Unlock()
+
+	f.file, f.err = s.backend.Read(file)
+
+	s.mutex.Lock()
+	delete(s.fetches, file)
+	if f.err == nil && !f.invalidated {
+		// Files too large for the cache are simply served uncached
+		s.cache.Delete(file)
+		s.cache.Write(f.file)
+	}
+	s.mutex.Unlock()
+
+	close(f.done)
+	return f.file, f.err
+}
+
+func (s *CachingFileServer) FileExists(file string) bool {
+	return s.cache.FileExists(file) || s.backend.FileExists(file)
+}
+
+func (s *CachingFileServer) Stat(file string) (*FileInfo, error) {
+	return s.backend.Stat(file)
+}
+
+func (s *CachingFileServer) List(prefix string) ([]*FileInfo, error) {
+	return s.backend.List(prefix)
+}
+
+func (s *CachingFileServer) Delete(file string) error {
+	defer s.invalidate(file)
+	return s.backend.Delete(file)
+}
+
+func (s *CachingFileServer) Rename(from string, to string) error {
+	defer s.invalidate(to)
+	defer s.invalidate(from)
+	return s.backend.Rename(from, to)
+}
+
+func (s *CachingFileServer) Stage(file string) (Upload, error) {
+	u, err := s.backend.Stage(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachingUpload{Upload: u, server: s}, nil
+}
+
+func (s *CachingFileServer) Reap() int {
+	return s.backend.Reap()
+}
+
+// Committing an upload changes the backend like a write
+type cachingUpload struct {
+	Upload
+	server *CachingFileServer
+}
+
+func (u *cachingUpload) Commit(name string, digests map[string]string) error {
+	defer u.server.invalidate(name)
+	return u.Upload.Commit(name, digests)
+}
+
+// Drop the cached copy of a file and keep any fetch in flight from
+// caching what may now be stale data
+func (s *CachingFileServer) invalidate(file string) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if f, ok := s.fetches[file]; ok {
+		f.invalidated = true
+	}
+
+	s.cache.Delete(file)
+}
@@ -0,0 +1,94 @@
+package fileserv
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A backend which counts reads and makes them slow enough to overlap
+type slowFileServer struct {
+	*InMemFileServer
+	reads int32
+}
+
+func (s *slowFileServer) Read(file string) (*File, error) {
+	atomic.AddInt32(&s.reads, 1)
+	time.Sleep(50 * time.Millisecond)
+	return s.InMemFileServer.Read(file)
+}
+
+func TestCacheServesHotFiles(t *testing.T) {
+	backend := &slowFileServer{InMemFileServer: NewMemFileServer()}
+	serv := NewCachingFileServer(backend, 1024, 0)
+	file := File{
+		Name: "foo",
+		Data: []byte{0, 1, 2, 3, 4},
+	}
+
+	if err := serv.Write(&file); err != nil {
+		t.Errorf("Failed to write %v, returned %v", file.Name, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		recvFile, err := serv.Read(file.Name)
+		if err != nil || !bytes.Equal(recvFile.Data, file.Data) {
+			t.Errorf("Expected data %v, received %v with err %v", file.Data, recvFile.Data, err)
+		}
+	}
+
+	if backend.reads != 1 {
+		t.Errorf("Expected 1 backend read, received: %v", backend.reads)
+	}
+}
+
+func TestCacheCoalescesConcurrentReads(t *testing.T) {
+	backend := &slowFileServer{InMemFileServer: NewMemFileServer()}
+	backend.Write(&File{Name: "kernel", Data: []byte{0, 1, 2, 3, 4}})
+	serv := NewCachingFileServer(backend, 1024, 0)
+	done := make(chan error)
+
+	for i := 0; i < 200; i++ {
+		go func() {
+			_, err := serv.Read("kernel")
+			done <- err
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Failed to read kernel, returned %v", err)
+		}
+	}
+
+	if backend.reads != 1 {
+		t.Errorf("Expected 1 backend read, received: %v", backend.reads)
+	}
+}
+
+func TestCacheInvalidatesOnChange(t *testing.T) {
+	backend := &slowFileServer{InMemFileServer: NewMemFileServer()}
+	serv := NewCachingFileServer(backend, 1024, 0)
+
+	serv.Write(&File{Name: "foo", Data: []byte{1}})
+	serv.Read("foo")
+
+	if err := serv.Delete("foo"); err != nil {
+		t.Errorf("Failed to delete foo, returned %v", err)
+	}
+
+	if serv.FileExists("foo") {
+		t.Errorf("File 'foo' should not exist after delete")
+	}
+
+	serv.Write(&File{Name: "foo", Data: []byte{2}})
+	if f, err := serv.Read("foo"); err != nil || !bytes.Equal(f.Data, []byte{2}) {
+		t.Errorf("Expected data [2] after rewrite, received %v with err %v", f, err)
+	}
+
+	serv.Rename("foo", "bar")
+	if _, err := serv.Read("foo"); err == nil {
+		t.Errorf("Read of renamed file 'foo' should have failed")
+	}
+}
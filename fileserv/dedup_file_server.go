@@ -0,0 +1,306 @@
+package fileserv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	. "sync"
+	"time"
+)
+
+// DedupFileServer stores the contents of files once per SHA-256 digest,
+// so files with the same contents share one blob however many names they
+// are written under.  As a blob may be read under any of its names, the
+// data of files is copied when written and when read.  Blobs are reference counted by the names pointing
+// at them, and blobs no longer referenced are kept until collected by GC,
+// so deleting and writing the same contents again costs nothing.
+// Renames only change the index of names.
+type DedupFileServer struct {
+	names  map[string]*dedupEntry
+	blobs  map[string]*blob
+	staged map[string]*memUpload
+	mutex  *RWMutex
+	now    func() time.Time
+	stop   chan struct{}
+}
+
+// A name in the index
+type dedupEntry struct {
+	sum     string
+	modTime time.Time
+	digests map[string]string
+}
+
+type blob struct {
+	data []byte
+	refs int
+}
+
+// NewDedupFileServer creates a deduplicating in memory file server.  When
+// gcInterval is positive unreferenced blobs are collected that often until
+// Close is called.
+func NewDedupFileServer(gcInterval time.Duration) *DedupFileServer {
+	s := &DedupFileServer{
+		names:  make(map[string]*dedupEntry),
+		blobs:  make(map[string]*blob),
+		staged: make(map[string]*memUpload),
+		mutex:  &RWMutex{},
+		now:    time.Now,
+		stop:   make(chan struct{}),
+	}
+
+	if gcInterval > 0 {
+		go s.collect(gcInterval)
+	}
+
+	return s
+}
+
+func (s *DedupFileServer) Write(file *File) error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	return s.write(file, true)
+}
+
+// The caller must hold the write lock.  As blobs are keyed by their
+// SHA-256 digest, that digest is always computed rather than trusted.
+// Unless copyData is false, as for the data of an upload, which nothing
+// else holds, the data of a new blob is copied.
+func (s *DedupFileServer) write(file *File, copyData bool) error {
+	sum := Checksum(file.Data)
+	if given, ok := file.Digests[SHA256]; ok && given != sum {
+		return errors.New(fmt.Sprintf("File '%v' doesn't match its SHA-256 digest %v", file.Name, given))
+	}
+
+	digests := copyDigests(file.Digests)
+	digests[SHA256] = sum
+
+	if _, ok := s.names[file.Name]; ok || s.staged[file.Name] != nil {
+		return existError(file.Name)
+	}
+
+	b, ok := s.blobs[sum]
+	if !ok {
+		b = &blob{data: file.Data}
+		if copyData {
+			b.data = append([]byte(nil), file.Data...)
+		}
+		s.blobs[sum] = b
+	}
+	b.refs++
+
+	s.names[file.Name] = &dedupEntry{
+		sum:     sum,
+		modTime: s.now(),
+		digests: digests,
+	}
+	return nil
+}
+
+func (s *DedupFileServer) Read(file string) (*File, error) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	e, ok := s.names[file]
+	if !ok {
+		return &File{}, notExistError(file)
+	}
+
+	data := append([]byte(nil), s.blobs[e.sum].data...)
+	return &File{Name: file, Data: data, Digests: copyDigests(e.digests)}, nil
+}
+
+func (s *DedupFileServer) FileExists(file string) bool {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	_, ok := s.names[file]
+	return ok
+}
+
+func (s *DedupFileServer) Stat(file string) (*FileInfo, error) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	e, ok := s.names[file]
+	if !ok {
+		return nil, notExistError(file)
+	}
+
+	return s.info(file, e), nil
+}
+
+func (s *DedupFileServer) List(prefix string) ([]*FileInfo, error) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	infos := []*FileInfo{}
+	for name, e := range s.names {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, s.info(name, e))
+		}
+	}
+
+	sort.Sort(byName(infos))
+	return infos, nil
+}
+
+func (s *DedupFileServer) Delete(file string) error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	e, ok := s.names[file]
+	if !ok {
+		return notExistError(file)
+	}
+
+	delete(s.names, file)
+	s.blobs[e.sum].refs--
+	return nil
+}
+
+func (s *DedupFileServer) Rename(from string, to string) error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	e, ok := s.names[from]
+	if !ok {
+		return notExistError(from)
+	}
+
+	if _, ok := s.names[to]; ok || s.staged[to] != nil {
+		return existError(to)
+	}
+
+	delete(s.names, from)
+	s.names[to] = e
+	return nil
+}
+
+func (s *DedupFileServer) Stage(file string) (Upload, error) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if _, ok := s.names[file]; ok || s.staged[file] != nil {
+		return nil, existError(file)
+	}
+
+	u := &memUpload{
+		name:   file,
+		commit: s.commit,
+		abort:  s.abort,
+	}
+	s.staged[file] = u
+	return u, nil
+}
+
+func (s *DedupFileServer) Reap() int {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	n := len(s.staged)
+	s.staged = make(map[string]*memUpload)
+	return n
+}
+
+func (s *DedupFileServer) commit(u *memUpload, name string, digests map[string]string) error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if s.staged[u.name] != u {
+		return abortedError(u.name)
+	}
+	delete(s.staged, u.name)
+
+	return s.write(&File{Name: name, Data: u.data, Digests: digests}, false)
+}
+
+func (s *DedupFileServer) abort(u *memUpload) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if s.staged[u.name] == u {
+		delete(s.staged, u.name)
+	}
+}
+
+// GC drops the blobs no name refers to, returning how many were dropped
+// and the bytes freed
+func (s *DedupFileServer) GC() (int, int) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	blobs, bytes := 0, 0
+	for sum, b := range s.blobs {
+		if b.refs <= 0 {
+			delete(s.blobs, sum)
+			blobs++
+			bytes += len(b.data)
+		}
+	}
+
+	return blobs, bytes
+}
+
+// Usage returns the bytes held in blobs, including those waiting to be
+// collected, and the bytes of every file as if stored separately
+func (s *DedupFileServer) Usage() (int, int) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	stored, logical := 0, 0
+	for _, b := range s.blobs {
+		stored += len(b.data)
+		logical += b.refs * len(b.data)
+	}
+
+	return stored, logical
+}
+
+// Close stops collecting garbage in the background
+func (s *DedupFileServer) Close() {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+func (s *DedupFileServer) collect(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.GC()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// The caller must hold the mutex
+func (s *DedupFileServer) info(name string, e *dedupEntry) *FileInfo {
+	return &FileInfo{
+		Name:     name,
+		Size:     len(s.blobs[e.sum].data),
+		ModTime:  e.modTime,
+		Checksum: e.sum,
+		Digests:  copyDigests(e.digests),
+	}
+}
+
+func copyDigests(digests map[string]string) map[string]string {
+	c := make(map[string]string)
+	for algorithm, digest := range digests {
+		c[algorithm] = digest
+	}
+
+	return c
+}
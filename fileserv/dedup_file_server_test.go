@@ -0,0 +1,156 @@
+package fileserv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDedupSharesContents(t *testing.T) {
+	serv := NewDedupFileServer(0)
+	kernel := []byte{1, 2, 3, 4}
+
+	for _, name := range []string{"a/kernel", "b/kernel", "c/kernel"} {
+		if err := serv.Write(&File{Name: name, Data: kernel}); err != nil {
+			t.Fatalf("Failed to write %v, returned %v", name, err)
+		}
+	}
+	serv.Write(&File{Name: "config", Data: []byte{5}})
+
+	if stored, logical := serv.Usage(); stored != 5 || logical != 13 {
+		t.Errorf("Expected 5 bytes stored for 13 written, received %v and %v", stored, logical)
+	}
+
+	if err := serv.Write(&File{Name: "config", Data: []byte{6}}); err == nil {
+		t.Errorf("Overwriting a file should have failed")
+	}
+
+	f, err := serv.Read("b/kernel")
+	if err != nil || f.Name != "b/kernel" || !bytes.Equal(f.Data, kernel) {
+		t.Errorf("Expected b/kernel with data %v, received %v, %v", kernel, f, err)
+	}
+
+	infos, _ := serv.List("b/")
+	if len(infos) != 1 || infos[0].Size != len(kernel) || infos[0].Checksum != Checksum(kernel) {
+		t.Errorf("Unexpected listing %v", infos)
+	}
+}
+
+// Blobs are only collected once no name refers to them
+func TestDedupGC(t *testing.T) {
+	serv := NewDedupFileServer(0)
+	kernel := []byte{1, 2, 3, 4}
+	serv.Write(&File{Name: "a", Data: kernel})
+	serv.Write(&File{Name: "b", Data: kernel})
+
+	if err := serv.Rename("a", "c"); err != nil {
+		t.Fatalf("Failed to rename, returned %v", err)
+	}
+
+	serv.Delete("b")
+	if blobs, _ := serv.GC(); blobs != 0 {
+		t.Errorf("Collected %v blobs still referred to by c", blobs)
+	}
+
+	serv.Delete("c")
+	if _, err := serv.Read("c"); err == nil {
+		t.Errorf("Reading a deleted file should have failed")
+	}
+
+	if blobs, freed := serv.GC(); blobs != 1 || freed != len(kernel) {
+		t.Errorf("Expected one blob of %v bytes collected, received %v of %v bytes", len(kernel), blobs, freed)
+	}
+
+	if stored, logical := serv.Usage(); stored != 0 || logical != 0 {
+		t.Errorf("Expected nothing stored, received %v and %v", stored, logical)
+	}
+}
+
+func TestDedupStaging(t *testing.T) {
+	serv := NewDedupFileServer(0)
+	serv.Write(&File{Name: "a", Data: []byte{1, 2}})
+
+	u, err := serv.Stage("b")
+	if err != nil {
+		t.Fatalf("Failed to stage, returned %v", err)
+	}
+	u.Write([]byte{1, 2})
+
+	if serv.FileExists("b") {
+		t.Errorf("A staged file should be invisible")
+	}
+
+	if err := u.Commit("b", nil); err != nil {
+		t.Fatalf("Failed to commit, returned %v", err)
+	}
+
+	if stored, logical := serv.Usage(); stored != 2 || logical != 4 {
+		t.Errorf("Expected the committed upload to share its blob, stored %v for %v bytes", stored, logical)
+	}
+}
+
+// A wrong digest mustn't make a file share the blob of other contents
+func TestDedupChecksDigest(t *testing.T) {
+	serv := NewDedupFileServer(0)
+	kernel := []byte{1, 2, 3, 4}
+	serv.Write(&File{Name: "kernel", Data: kernel})
+
+	err := serv.Write(&File{Name: "evil", Data: []byte{6, 6, 6}, Digests: map[string]string{SHA256: Checksum(kernel)}})
+	if err == nil || serv.FileExists("evil") {
+		t.Errorf("Expected a file with a wrong digest to be rejected, returned %v", err)
+	}
+
+	u, _ := serv.Stage("evil")
+	u.Write([]byte{6, 6, 6})
+	if err := u.Commit("evil", map[string]string{SHA256: Checksum(kernel)}); err == nil {
+		t.Errorf("Expected an upload with a wrong digest to be rejected")
+	}
+
+	if err := serv.Write(&File{Name: "copy", Data: kernel, Digests: map[string]string{SHA256: Checksum(kernel)}}); err != nil {
+		t.Errorf("Failed to write with the right digest, returned %v", err)
+	}
+
+	if f, _ := serv.Read("kernel"); !bytes.Equal(f.Data, kernel) {
+		t.Errorf("Expected kernel to keep its data %v, received %v", kernel, f.Data)
+	}
+}
+
+// Changing the data or digests written or read mustn't change the files
+// sharing a blob
+func TestDedupCopiesFiles(t *testing.T) {
+	serv := NewDedupFileServer(0)
+	kernel := []byte{1, 2, 3, 4}
+	serv.Write(&File{Name: "a", Data: kernel})
+	serv.Write(&File{Name: "b", Data: []byte{1, 2, 3, 4}})
+	kernel[0] = 9
+
+	f, _ := serv.Read("a")
+	f.Data[1] = 9
+	f.Digests[SHA256] = "bad"
+
+	info, _ := serv.Stat("a")
+	info.Digests[SHA256] = "bad"
+
+	for _, name := range []string{"a", "b"} {
+		f, _ := serv.Read(name)
+		if !bytes.Equal(f.Data, []byte{1, 2, 3, 4}) || f.Digests[SHA256] != Checksum(f.Data) {
+			t.Errorf("Expected %v to keep its data and digest, received %v", name, f)
+		}
+	}
+}
+
+func TestDedupBackgroundGC(t *testing.T) {
+	serv := NewDedupFileServer(time.Millisecond)
+	defer serv.Close()
+
+	serv.Write(&File{Name: "a", Data: []byte{1}})
+	serv.Delete("a")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stored, _ := serv.Usage(); stored != 0; stored, _ = serv.Usage() {
+		if time.Now().After(deadline) {
+			t.Fatalf("The unreferenced blob was never collected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
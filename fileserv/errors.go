@@ -0,0 +1,38 @@
+package fileserv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by file servers match one of these with errors.Is, so
+// that callers such as the TFTP sessions can tell failures apart
+var (
+	ErrNotExist   = errors.New("File doesn't exist")
+	ErrExist      = errors.New("File already exists")
+	ErrPermission = errors.New("Permission denied")
+	ErrNoSpace    = errors.New("No space left")
+)
+
+// An error with its own message matching a sentinel error
+type fileError struct {
+	sentinel error
+	msg      string
+}
+
+func (e *fileError) Error() string { return e.msg }
+func (e *fileError) Unwrap() error { return e.sentinel }
+
+// NewError returns an error with the message msg matching sentinel, for
+// file servers outside this package reporting the same failures
+func NewError(sentinel error, msg string) error {
+	return &fileError{sentinel: sentinel, msg: msg}
+}
+
+func notExistError(file string) error {
+	return NewError(ErrNotExist, fmt.Sprintf("File '%v' doesn't exist", file))
+}
+
+func existError(file string) error {
+	return NewError(ErrExist, fmt.Sprintf("File '%v' already exists", file))
+}
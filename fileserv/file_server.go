@@ -1,12 +1,104 @@
 package fileserv
 
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"time"
+)
+
+// Digest algorithms, the keys of File.Digests and FileInfo.Digests
+const (
+	SHA256 = "sha256"
+	MD5    = "md5"
+	CRC32  = "crc32"
+)
+
 type FileServer interface {
 	Write(file *File) error
 	Read(file string) (*File, error)
 	FileExists(file string) bool
+
+	// Stat returns the metadata of a file without its contents
+	Stat(file string) (*FileInfo, error)
+
+	// List returns the metadata of every file whose name starts
+	// with prefix, ordered by name.  An empty prefix lists everything.
+	List(prefix string) ([]*FileInfo, error)
+
+	Delete(file string) error
+
+	// Rename moves a file to a new name.  Like Write it refuses
+	// to replace an existing file.
+	Rename(from string, to string) error
+
+	// Stage starts an upload which readers can't see until it is
+	// committed.  Like Write it refuses the name of an existing file,
+	// and also a name already staged by another upload.
+	Stage(file string) (Upload, error)
+
+	// Reap aborts every staged upload, returning how many there were.
+	// It is meant for startup, to clean up uploads abandoned by a
+	// previous run.
+	Reap() int
+}
+
+// Upload is a file being written, used by a single goroutine.  It is
+// over once committed or aborted, whether or not the commit succeeded.
+type Upload interface {
+	// Write appends data to the upload
+	Write(data []byte) error
+
+	// Commit atomically makes the upload visible as a file, normally
+	// under the name it was staged as.  Another name moves the upload
+	// elsewhere, e.g. into quarantine.  Digests are as in File.
+	Commit(name string, digests map[string]string) error
+
+	// Abort drops the upload.  It does nothing once the upload is over.
+	Abort()
 }
 
 type File struct {
 	Name string
 	Data []byte
+
+	// Hex encoded digests of Data by algorithm.  Writers may pass digests
+	// they computed, which are trusted, and a SHA-256 digest is computed
+	// for files written without one.  DedupFileServer checks the SHA-256
+	// digest, as it stores contents by it.
+	Digests map[string]string
+}
+
+type FileInfo struct {
+	Name     string
+	Size     int
+	ModTime  time.Time
+	Checksum string
+	Digests  map[string]string
+}
+
+// Checksum returns the hex encoded SHA-256 digest of data, the form
+// used for FileInfo.Checksum
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewHash returns a hash computing digests of algorithm, which are hex
+// encoded for File.Digests
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case SHA256:
+		return sha256.New(), nil
+	case MD5:
+		return md5.New(), nil
+	case CRC32:
+		return crc32.NewIEEE(), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown digest algorithm '%v'", algorithm))
 }
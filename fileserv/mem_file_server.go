@@ -1,21 +1,51 @@
 package fileserv
 
 import (
-	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	. "sync"
+	"sync/atomic"
+	"time"
 )
 
 type InMemFileServer struct {
-	fileDir map[string]*File
-	mutex   *Mutex
+	// Access counter used to order files for LRU eviction.  Kept
+	// first for 64-bit alignment of atomic operations.
+	ticks    uint64
+	fileDir  map[string]*memFile
+	staged   map[string]*memUpload
+	mutex    *RWMutex
+	now      func() time.Time
+	maxBytes int
+	ttl      time.Duration
+	size     int
+}
+
+// A stored file along with the metadata reported by Stat
+type memFile struct {
+	lastUse uint64
+	file    *File
+	modTime time.Time
 }
 
 func NewMemFileServer() *InMemFileServer {
-	dir := make(map[string]*File)
+	return NewBoundedMemFileServer(0, 0)
+}
+
+// NewBoundedMemFileServer creates an in memory file server usable as a
+// cache.  When maxBytes is positive the least recently used files are
+// evicted to keep the total size of stored files within it.  When ttl is
+// positive files expire that long after they were written.
+func NewBoundedMemFileServer(maxBytes int, ttl time.Duration) *InMemFileServer {
+	dir := make(map[string]*memFile)
 	return &InMemFileServer{
-		fileDir: dir,
-		mutex:   &Mutex{},
+		fileDir:  dir,
+		staged:   make(map[string]*memUpload),
+		mutex:    &RWMutex{},
+		now:      time.Now,
+		maxBytes: maxBytes,
+		ttl:      ttl,
 	}
 }
 
@@ -23,26 +53,240 @@ func (s *InMemFileServer) Write(file *File) error {
 	defer s.mutex.Unlock()
 	s.mutex.Lock()
 
-	if s.FileExists(file.Name) {
-		return errors.New(fmt.Sprintf("File '%v' already exists", file.Name))
+	s.removeExpired()
+	return s.write(file)
+}
+
+// The caller must hold the write lock
+func (s *InMemFileServer) write(file *File) error {
+	if s.lookup(file.Name) != nil || s.staged[file.Name] != nil {
+		return existError(file.Name)
+	}
+
+	if s.maxBytes > 0 && len(file.Data) > s.maxBytes {
+		return NewError(ErrNoSpace, fmt.Sprintf("File '%v' with %v bytes exceeds the %v byte limit", file.Name, len(file.Data), s.maxBytes))
+	}
+
+	digests := make(map[string]string)
+	for algorithm, digest := range file.Digests {
+		digests[algorithm] = digest
+	}
+	if _, ok := digests[SHA256]; !ok {
+		digests[SHA256] = Checksum(file.Data)
+	}
+
+	f := &memFile{
+		file:    &File{Name: file.Name, Data: file.Data, Digests: digests},
+		modTime: s.now(),
 	}
+	s.touch(f)
+	s.fileDir[file.Name] = f
+	s.size += len(file.Data)
 
-	s.fileDir[file.Name] = file
+	s.evict()
 	return nil
 }
 
 func (s *InMemFileServer) Read(file string) (*File, error) {
-	if f, ok := s.fileDir[file]; ok {
-		return f, nil
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	if f := s.lookup(file); f != nil {
+		s.touch(f)
+		return f.file, nil
 	}
 
-	return &File{}, errors.New(fmt.Sprintf("File '%v' doesn't exist", file))
+	return &File{}, notExistError(file)
 }
 
 func (s *InMemFileServer) FileExists(file string) bool {
-	if _, ok := s.fileDir[file]; ok {
-		return true
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	return s.lookup(file) != nil
+}
+
+func (s *InMemFileServer) Stat(file string) (*FileInfo, error) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	if f := s.lookup(file); f != nil {
+		return f.info(), nil
 	}
 
-	return false
+	return nil, notExistError(file)
 }
+
+func (s *InMemFileServer) List(prefix string) ([]*FileInfo, error) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	infos := []*FileInfo{}
+	for name := range s.fileDir {
+		if f := s.lookup(name); f != nil && strings.HasPrefix(name, prefix) {
+			infos = append(infos, f.info())
+		}
+	}
+
+	sort.Sort(byName(infos))
+	return infos, nil
+}
+
+func (s *InMemFileServer) Delete(file string) error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	s.removeExpired()
+
+	if s.lookup(file) == nil {
+		return notExistError(file)
+	}
+
+	s.remove(file)
+	return nil
+}
+
+func (s *InMemFileServer) Rename(from string, to string) error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	s.removeExpired()
+
+	f := s.lookup(from)
+	if f == nil {
+		return notExistError(from)
+	}
+
+	if s.lookup(to) != nil || s.staged[to] != nil {
+		return existError(to)
+	}
+
+	delete(s.fileDir, from)
+	f.file = &File{Name: to, Data: f.file.Data, Digests: f.file.Digests}
+	s.fileDir[to] = f
+	return nil
+}
+
+func (s *InMemFileServer) Stage(file string) (Upload, error) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	s.removeExpired()
+
+	if s.lookup(file) != nil || s.staged[file] != nil {
+		return nil, existError(file)
+	}
+
+	u := &memUpload{
+		name:     file,
+		maxBytes: s.maxBytes,
+		commit:   s.commit,
+		abort:    s.abort,
+	}
+	s.staged[file] = u
+	return u, nil
+}
+
+func (s *InMemFileServer) Reap() int {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	n := len(s.staged)
+	s.staged = make(map[string]*memUpload)
+	return n
+}
+
+func (s *InMemFileServer) commit(u *memUpload, name string, digests map[string]string) error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if s.staged[u.name] != u {
+		return abortedError(u.name)
+	}
+	delete(s.staged, u.name)
+
+	s.removeExpired()
+	return s.write(&File{Name: name, Data: u.data, Digests: digests})
+}
+
+func (s *InMemFileServer) abort(u *memUpload) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if s.staged[u.name] == u {
+		delete(s.staged, u.name)
+	}
+}
+
+// Find an unexpired file.  The caller must hold the mutex.
+func (s *InMemFileServer) lookup(file string) *memFile {
+	f, ok := s.fileDir[file]
+	if !ok || s.expired(f) {
+		return nil
+	}
+
+	return f
+}
+
+func (s *InMemFileServer) expired(f *memFile) bool {
+	return s.ttl > 0 && s.now().Sub(f.modTime) >= s.ttl
+}
+
+// Mark a file as the most recently used.  Only needs the read lock.
+func (s *InMemFileServer) touch(f *memFile) {
+	atomic.StoreUint64(&f.lastUse, atomic.AddUint64(&s.ticks, 1))
+}
+
+// The caller must hold the write lock
+func (s *InMemFileServer) remove(file string) {
+	if f, ok := s.fileDir[file]; ok {
+		s.size -= len(f.file.Data)
+		delete(s.fileDir, file)
+	}
+}
+
+// The caller must hold the write lock
+func (s *InMemFileServer) removeExpired() {
+	if s.ttl <= 0 {
+		return
+	}
+
+	for name, f := range s.fileDir {
+		if s.expired(f) {
+			s.remove(name)
+		}
+	}
+}
+
+// Drop least recently used files until the size limit is respected.
+// The caller must hold the write lock.
+func (s *InMemFileServer) evict() {
+	for s.maxBytes > 0 && s.size > s.maxBytes {
+		var oldest string
+		var oldestUse uint64
+		found := false
+		for name, f := range s.fileDir {
+			if use := atomic.LoadUint64(&f.lastUse); !found || use < oldestUse {
+				oldest, oldestUse, found = name, use, true
+			}
+		}
+
+		s.remove(oldest)
+	}
+}
+
+func (f *memFile) info() *FileInfo {
+	return &FileInfo{
+		Name:     f.file.Name,
+		Size:     len(f.file.Data),
+		ModTime:  f.modTime,
+		Checksum: f.file.Digests[SHA256],
+		Digests:  f.file.Digests,
+	}
+}
+
+type byName []*FileInfo
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
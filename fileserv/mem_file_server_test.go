@@ -2,6 +2,8 @@ package fileserv
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -79,6 +81,28 @@ func TestFileReadFailure(t *testing.T) {
 	}
 }
 
+func TestFileErrors(t *testing.T) {
+	serv := NewBoundedMemFileServer(10, 0)
+	serv.Write(&File{Name: "foo", Data: []byte{1}})
+
+	_, err := serv.Read("missing")
+	if !errors.Is(err, ErrNotExist) || err.Error() != "File 'missing' doesn't exist" {
+		t.Errorf("Expected a file not found error, returned %v", err)
+	}
+
+	if err := serv.Write(&File{Name: "foo", Data: []byte{2}}); !errors.Is(err, ErrExist) {
+		t.Errorf("Expected a file exists error, returned %v", err)
+	}
+
+	if err := serv.Write(&File{Name: "bar", Data: make([]byte, 11)}); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Expected a no space error, returned %v", err)
+	}
+
+	if err := serv.Rename("missing", "bar"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Expected a file not found error, returned %v", err)
+	}
+}
+
 func TestFileParallelWriteTest(t *testing.T) {
 	serv := NewMemFileServer()
 	file := File{
@@ -96,3 +120,263 @@ func TestFileParallelWriteTest(t *testing.T) {
 		t.Errorf("Expected fileDir size to be 1, received: %v", len(serv.fileDir))
 	}
 }
+
+func TestFileStat(t *testing.T) {
+	serv := NewMemFileServer()
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	serv.now = func() time.Time { return now }
+	file := File{
+		Name: "foo",
+		Data: []byte{0, 1, 2, 3, 4},
+	}
+
+	if err := serv.Write(&file); err != nil {
+		t.Errorf("Failed to write %v, returned %v", file.Name, err)
+	}
+
+	info, err := serv.Stat(file.Name)
+	if err != nil {
+		t.Fatalf("Failed to stat %v, returned %v", file.Name, err)
+	}
+
+	if info.Name != file.Name || info.Size != len(file.Data) {
+		t.Errorf("Expected name '%v' and size %v, received '%v' and %v", file.Name, len(file.Data), info.Name, info.Size)
+	}
+
+	if !info.ModTime.Equal(now) {
+		t.Errorf("Expected modification time %v, received %v", now, info.ModTime)
+	}
+
+	if info.Checksum != Checksum(file.Data) {
+		t.Errorf("Expected checksum %v, received %v", Checksum(file.Data), info.Checksum)
+	}
+
+	if _, err = serv.Stat("bar"); err == nil {
+		t.Errorf("Should have failed to stat a missing file")
+	}
+}
+
+// Digests passed by the writer are kept, and survive a rename
+func TestFileDigests(t *testing.T) {
+	serv := NewMemFileServer()
+	serv.Write(&File{Name: "foo", Data: []byte{1}, Digests: map[string]string{CRC32: "a505df1b"}})
+
+	if err := serv.Rename("foo", "bar"); err != nil {
+		t.Fatalf("Failed to rename, returned %v", err)
+	}
+
+	info, err := serv.Stat("bar")
+	if err != nil || info.Digests[CRC32] != "a505df1b" || info.Digests[SHA256] != Checksum([]byte{1}) {
+		t.Errorf("Unexpected digests %v, %v", info, err)
+	}
+
+	if f, _ := serv.Read("bar"); f.Digests[SHA256] != info.Checksum {
+		t.Errorf("Expected the digests to be read with the file, received %v", f.Digests)
+	}
+
+	if _, err := NewHash("sha1"); err == nil {
+		t.Errorf("Expected an unknown algorithm to be rejected")
+	}
+}
+
+func TestFileStaging(t *testing.T) {
+	serv := NewBoundedMemFileServer(10, 0)
+
+	u, err := serv.Stage("foo")
+	if err != nil {
+		t.Fatalf("Failed to stage, returned %v", err)
+	}
+	u.Write([]byte{1, 2})
+	u.Write([]byte{3})
+
+	if _, err := serv.Stage("foo"); !errors.Is(err, ErrExist) {
+		t.Errorf("Expected staging foo twice to fail with ErrExist, returned %v", err)
+	}
+
+	if err := serv.Write(&File{Name: "foo", Data: []byte{4}}); !errors.Is(err, ErrExist) {
+		t.Errorf("Expected writing the staged foo to fail with ErrExist, returned %v", err)
+	}
+
+	if infos, _ := serv.List(""); serv.FileExists("foo") || len(infos) != 0 {
+		t.Errorf("A staged file should be invisible, listed %v", infos)
+	}
+
+	if err := u.Commit("foo", nil); err != nil {
+		t.Fatalf("Failed to commit, returned %v", err)
+	}
+
+	f, err := serv.Read("foo")
+	if err != nil || !bytes.Equal(f.Data, []byte{1, 2, 3}) || f.Digests[SHA256] != Checksum(f.Data) {
+		t.Errorf("Expected the committed foo with data [1 2 3], received %v, %v", f, err)
+	}
+
+	// Aborted and reaped uploads leave nothing behind
+	aborted, _ := serv.Stage("bar")
+	aborted.Abort()
+	reaped, _ := serv.Stage("baz")
+	if n := serv.Reap(); n != 1 {
+		t.Errorf("Expected one upload reaped, reaped %v", n)
+	}
+
+	if err := reaped.Commit("baz", nil); err == nil || serv.FileExists("baz") {
+		t.Errorf("Committing a reaped upload should have failed")
+	}
+
+	if u, err := serv.Stage("bar"); err != nil || !errors.Is(u.Write(make([]byte, 11)), ErrNoSpace) {
+		t.Errorf("Expected an upload over the size limit to fail with ErrNoSpace, staged with %v", err)
+	}
+}
+
+func TestFileList(t *testing.T) {
+	serv := NewMemFileServer()
+	for _, name := range []string{"boot/b", "boot/a", "uploads/c"} {
+		if err := serv.Write(&File{Name: name}); err != nil {
+			t.Errorf("Failed to write %v, returned %v", name, err)
+		}
+	}
+
+	infos, err := serv.List("boot/")
+	if err != nil {
+		t.Fatalf("Failed to list, returned %v", err)
+	}
+
+	if len(infos) != 2 || infos[0].Name != "boot/a" || infos[1].Name != "boot/b" {
+		t.Errorf("Expected [boot/a boot/b], received %v", infos)
+	}
+
+	if infos, _ = serv.List(""); len(infos) != 3 {
+		t.Errorf("Expected 3 files, received %v", len(infos))
+	}
+}
+
+func TestFileDelete(t *testing.T) {
+	serv := NewMemFileServer()
+	file := File{
+		Name: "foo",
+		Data: []byte{0, 1, 2, 3, 4},
+	}
+
+	serv.Write(&file)
+	if err := serv.Delete(file.Name); err != nil {
+		t.Errorf("Failed to delete %v, returned %v", file.Name, err)
+	}
+
+	if serv.FileExists(file.Name) {
+		t.Errorf("File '%v' should not exist after delete", file.Name)
+	}
+
+	if err := serv.Delete(file.Name); err == nil {
+		t.Errorf("Second delete of '%v' should have failed", file.Name)
+	}
+
+	if err := serv.Write(&file); err != nil {
+		t.Errorf("Failed to write %v after delete, returned %v", file.Name, err)
+	}
+}
+
+func TestFileRename(t *testing.T) {
+	serv := NewMemFileServer()
+	serv.Write(&File{Name: "foo", Data: []byte{1}})
+	serv.Write(&File{Name: "bar", Data: []byte{2}})
+
+	if err := serv.Rename("foo", "bar"); err == nil {
+		t.Errorf("Rename onto an existing file should have failed")
+	}
+
+	if err := serv.Rename("foo", "baz"); err != nil {
+		t.Errorf("Failed to rename foo to baz, returned %v", err)
+	}
+
+	if serv.FileExists("foo") {
+		t.Errorf("File 'foo' should not exist after rename")
+	}
+
+	f, err := serv.Read("baz")
+	if err != nil || f.Name != "baz" || !bytes.Equal(f.Data, []byte{1}) {
+		t.Errorf("Expected renamed file baz with data [1], received %v, %v", f, err)
+	}
+}
+
+func TestFileParallelReadWriteTest(t *testing.T) {
+	serv := NewMemFileServer()
+	done := make(chan bool)
+
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("foo%v", i)
+		go func() {
+			serv.Write(&File{Name: name, Data: []byte{0, 1, 2}})
+			done <- true
+		}()
+		go func() {
+			serv.FileExists(name)
+			serv.Read(name)
+			serv.List("")
+			done <- true
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		<-done
+	}
+
+	if infos, _ := serv.List(""); len(infos) != 100 {
+		t.Errorf("Expected 100 files, received: %v", len(infos))
+	}
+}
+
+func TestFileLruEviction(t *testing.T) {
+	serv := NewBoundedMemFileServer(10, 0)
+	serv.Write(&File{Name: "a", Data: make([]byte, 4)})
+	serv.Write(&File{Name: "b", Data: make([]byte, 4)})
+
+	// Reading 'a' makes 'b' the least recently used file
+	serv.Read("a")
+	serv.Write(&File{Name: "c", Data: make([]byte, 4)})
+
+	if !serv.FileExists("a") || !serv.FileExists("c") {
+		t.Errorf("Expected files 'a' and 'c' to remain")
+	}
+
+	if serv.FileExists("b") {
+		t.Errorf("Expected file 'b' to be evicted")
+	}
+
+	if serv.size != 8 {
+		t.Errorf("Expected total size 8, received: %v", serv.size)
+	}
+
+	if err := serv.Write(&File{Name: "d", Data: make([]byte, 11)}); err == nil {
+		t.Errorf("Write of a file larger than the limit should have failed")
+	}
+}
+
+func TestFileTtlExpiry(t *testing.T) {
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	serv := NewBoundedMemFileServer(0, time.Minute)
+	serv.now = func() time.Time { return now }
+
+	serv.Write(&File{Name: "foo", Data: []byte{0, 1, 2}})
+	now = now.Add(59 * time.Second)
+
+	if !serv.FileExists("foo") {
+		t.Errorf("File 'foo' should not have expired yet")
+	}
+
+	now = now.Add(time.Second)
+
+	if serv.FileExists("foo") {
+		t.Errorf("File 'foo' should have expired")
+	}
+
+	if _, err := serv.Read("foo"); err == nil {
+		t.Errorf("Read of an expired file should have failed")
+	}
+
+	if err := serv.Write(&File{Name: "foo", Data: []byte{3}}); err != nil {
+		t.Errorf("Write over an expired file failed with: %v", err)
+	}
+
+	if serv.size != 1 {
+		t.Errorf("Expected total size 1 after expiry, received: %v", serv.size)
+	}
+}
@@ -0,0 +1,147 @@
+package fileserv
+
+import (
+	"fmt"
+	"sort"
+)
+
+// OverlayFileServer stacks file servers into a single view.  Reads are
+// served by the first layer holding the file while writes always go to
+// the first layer, so a writable scratch layer can sit on top of read-only
+// base layers.  Files in lower layers can't be deleted or renamed.
+type OverlayFileServer struct {
+	layers []FileServer
+}
+
+// The first layer is the top, writable one
+func NewOverlayFileServer(top FileServer, lower ...FileServer) *OverlayFileServer {
+	return &OverlayFileServer{
+		layers: append([]FileServer{top}, lower...),
+	}
+}
+
+func (s *OverlayFileServer) Write(file *File) error {
+	if s.FileExists(file.Name) {
+		return existError(file.Name)
+	}
+
+	return s.layers[0].Write(file)
+}
+
+func (s *OverlayFileServer) Read(file string) (*File, error) {
+	if layer := s.find(file); layer != nil {
+		return layer.Read(file)
+	}
+
+	return &File{}, notExistError(file)
+}
+
+func (s *OverlayFileServer) FileExists(file string) bool {
+	return s.find(file) != nil
+}
+
+func (s *OverlayFileServer) Stat(file string) (*FileInfo, error) {
+	if layer := s.find(file); layer != nil {
+		return layer.Stat(file)
+	}
+
+	return nil, notExistError(file)
+}
+
+// Files in upper layers hide files of the same name in lower layers
+func (s *OverlayFileServer) List(prefix string) ([]*FileInfo, error) {
+	seen := make(map[string]bool)
+	infos := []*FileInfo{}
+
+	for _, layer := range s.layers {
+		layerInfos, err := layer.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range layerInfos {
+			if !seen[info.Name] {
+				seen[info.Name] = true
+				infos = append(infos, info)
+			}
+		}
+	}
+
+	sort.Sort(byName(infos))
+	return infos, nil
+}
+
+func (s *OverlayFileServer) Delete(file string) error {
+	if err := s.checkWritable(file); err != nil {
+		return err
+	}
+
+	return s.layers[0].Delete(file)
+}
+
+func (s *OverlayFileServer) Rename(from string, to string) error {
+	if err := s.checkWritable(from); err != nil {
+		return err
+	}
+
+	if s.FileExists(to) {
+		return existError(to)
+	}
+
+	return s.layers[0].Rename(from, to)
+}
+
+func (s *OverlayFileServer) Stage(file string) (Upload, error) {
+	if s.FileExists(file) {
+		return nil, existError(file)
+	}
+
+	u, err := s.layers[0].Stage(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &overlayUpload{Upload: u, server: s}, nil
+}
+
+// Lower layers are read-only, so only the top one has staged uploads
+func (s *OverlayFileServer) Reap() int {
+	return s.layers[0].Reap()
+}
+
+// A file may have appeared in a lower layer while the upload was staged
+type overlayUpload struct {
+	Upload
+	server *OverlayFileServer
+}
+
+func (u *overlayUpload) Commit(name string, digests map[string]string) error {
+	if u.server.FileExists(name) {
+		u.Upload.Abort()
+		return existError(name)
+	}
+
+	return u.Upload.Commit(name, digests)
+}
+
+// Find the highest layer holding a file
+func (s *OverlayFileServer) find(file string) FileServer {
+	for _, layer := range s.layers {
+		if layer.FileExists(file) {
+			return layer
+		}
+	}
+
+	return nil
+}
+
+func (s *OverlayFileServer) checkWritable(file string) error {
+	switch layer := s.find(file); {
+	case layer == nil:
+		return notExistError(file)
+	case layer != s.layers[0]:
+		return NewError(ErrPermission, fmt.Sprintf("File '%v' is in a read-only layer", file))
+	}
+
+	return nil
+}
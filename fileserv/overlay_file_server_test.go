@@ -0,0 +1,78 @@
+package fileserv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newTestOverlay() (*OverlayFileServer, *InMemFileServer, *InMemFileServer) {
+	top := NewMemFileServer()
+	base := NewMemFileServer()
+	base.Write(&File{Name: "kernel", Data: []byte{1}})
+	base.Write(&File{Name: "initrd", Data: []byte{2}})
+	return NewOverlayFileServer(top, base), top, base
+}
+
+func TestOverlayReadsFirstHit(t *testing.T) {
+	serv, top, _ := newTestOverlay()
+	top.Write(&File{Name: "initrd", Data: []byte{3}})
+
+	if f, err := serv.Read("kernel"); err != nil || !bytes.Equal(f.Data, []byte{1}) {
+		t.Errorf("Expected kernel from the base layer, received %v with err %v", f, err)
+	}
+
+	if f, err := serv.Read("initrd"); err != nil || !bytes.Equal(f.Data, []byte{3}) {
+		t.Errorf("Expected initrd from the top layer, received %v with err %v", f, err)
+	}
+
+	infos, _ := serv.List("")
+	if len(infos) != 2 || infos[0].Size != 1 {
+		t.Errorf("Expected 2 files with the top initrd shadowing the base one, received %v", infos)
+	}
+}
+
+func TestOverlayWritesGoToTop(t *testing.T) {
+	serv, top, base := newTestOverlay()
+
+	if err := serv.Write(&File{Name: "dump", Data: []byte{4}}); err != nil {
+		t.Errorf("Failed to write dump, returned %v", err)
+	}
+
+	if !top.FileExists("dump") || base.FileExists("dump") {
+		t.Errorf("Expected dump to be written to the top layer only")
+	}
+
+	if err := serv.Write(&File{Name: "kernel", Data: []byte{4}}); err == nil {
+		t.Errorf("Write over a base layer file should have failed")
+	}
+}
+
+func TestOverlayLowerLayersAreReadOnly(t *testing.T) {
+	serv, _, base := newTestOverlay()
+	serv.Write(&File{Name: "dump", Data: []byte{4}})
+
+	if err := serv.Delete("kernel"); !errors.Is(err, ErrPermission) {
+		t.Errorf("Delete of a base layer file should have been denied, returned %v", err)
+	}
+
+	if err := serv.Rename("kernel", "vmlinuz"); err == nil {
+		t.Errorf("Rename of a base layer file should have failed")
+	}
+
+	if err := serv.Rename("dump", "dump.old"); err != nil {
+		t.Errorf("Failed to rename a top layer file, returned %v", err)
+	}
+
+	if err := serv.Delete("dump.old"); err != nil {
+		t.Errorf("Failed to delete a top layer file, returned %v", err)
+	}
+
+	if _, err := serv.Stage("kernel"); !errors.Is(err, ErrExist) {
+		t.Errorf("Staging over a base layer file should have failed with ErrExist, returned %v", err)
+	}
+
+	if !base.FileExists("kernel") {
+		t.Errorf("Base layer should be untouched")
+	}
+}
@@ -0,0 +1,240 @@
+package fileserv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	. "sync"
+)
+
+// RouterFileServer routes files to backends mounted at path prefixes,
+// e.g. "/boot" to a read-only image store and "/uploads" to scratch
+// space.  Like a file system mount the prefix is stripped before the
+// backend sees the name, and the longest matching prefix wins.  Leading
+// slashes are ignored so "/boot/kernel" and "boot/kernel" are the same.
+type RouterFileServer struct {
+	mounts map[string]FileServer
+	mutex  *RWMutex
+}
+
+func NewRouterFileServer() *RouterFileServer {
+	return &RouterFileServer{
+		mounts: make(map[string]FileServer),
+		mutex:  &RWMutex{},
+	}
+}
+
+// Mount serves every file under prefix from backend, replacing any
+// backend already mounted there.  Mounting at "" or "/" catches every
+// file not covered by another mount.
+func (s *RouterFileServer) Mount(prefix string, backend FileServer) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	s.mounts[normalizeMount(prefix)] = backend
+}
+
+func (s *RouterFileServer) Unmount(prefix string) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	delete(s.mounts, normalizeMount(prefix))
+}
+
+func (s *RouterFileServer) Write(file *File) error {
+	backend, mount, name, err := s.route(file.Name)
+	if err != nil {
+		return err
+	}
+
+	return backend.Write(&File{Name: name[len(mount):], Data: file.Data, Digests: file.Digests})
+}
+
+func (s *RouterFileServer) Read(file string) (*File, error) {
+	backend, mount, name, err := s.route(file)
+	if err != nil {
+		return &File{}, err
+	}
+
+	f, err := backend.Read(name[len(mount):])
+	if err != nil {
+		return f, err
+	}
+
+	return &File{Name: file, Data: f.Data, Digests: f.Digests}, nil
+}
+
+func (s *RouterFileServer) FileExists(file string) bool {
+	backend, mount, name, err := s.route(file)
+	return err == nil && backend.FileExists(name[len(mount):])
+}
+
+func (s *RouterFileServer) Stat(file string) (*FileInfo, error) {
+	backend, mount, name, err := s.route(file)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := backend.Stat(name[len(mount):])
+	if err != nil {
+		return nil, err
+	}
+
+	routed := *info
+	routed.Name = file
+	return &routed, nil
+}
+
+// Names are listed with their mount prefix and without a leading slash.
+// Files of a backend hidden by a more specific mount aren't listed.
+func (s *RouterFileServer) List(prefix string) ([]*FileInfo, error) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	prefix = strings.TrimLeft(prefix, "/")
+	infos := []*FileInfo{}
+
+	for mount, backend := range s.mounts {
+		var backendPrefix string
+		switch {
+		case strings.HasPrefix(prefix, mount):
+			backendPrefix = prefix[len(mount):]
+		case strings.HasPrefix(mount, prefix):
+			backendPrefix = ""
+		default:
+			continue
+		}
+
+		backendInfos, err := backend.List(backendPrefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range backendInfos {
+			name := mount + info.Name
+			if strings.HasPrefix(name, prefix) && s.longestMount(name) == mount {
+				routed := *info
+				routed.Name = name
+				infos = append(infos, &routed)
+			}
+		}
+	}
+
+	sort.Sort(byName(infos))
+	return infos, nil
+}
+
+func (s *RouterFileServer) Delete(file string) error {
+	backend, mount, name, err := s.route(file)
+	if err != nil {
+		return err
+	}
+
+	return backend.Delete(name[len(mount):])
+}
+
+func (s *RouterFileServer) Rename(from string, to string) error {
+	backend, mount, fromName, err := s.route(from)
+	if err != nil {
+		return err
+	}
+
+	_, toMount, toName, err := s.route(to)
+	if err != nil {
+		return err
+	}
+
+	if toMount != mount {
+		return errors.New(fmt.Sprintf("Can't rename '%v' to '%v' across mounts", from, to))
+	}
+
+	return backend.Rename(fromName[len(mount):], toName[len(mount):])
+}
+
+func (s *RouterFileServer) Stage(file string) (Upload, error) {
+	backend, mount, name, err := s.route(file)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := backend.Stage(name[len(mount):])
+	if err != nil {
+		return nil, err
+	}
+
+	return &routerUpload{Upload: u, server: s, file: file, mount: mount}, nil
+}
+
+func (s *RouterFileServer) Reap() int {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	n := 0
+	for _, backend := range s.mounts {
+		n += backend.Reap()
+	}
+
+	return n
+}
+
+// An upload staged on the backend of mount
+type routerUpload struct {
+	Upload
+	server *RouterFileServer
+	file   string
+	mount  string
+}
+
+// Like a rename, an upload can't be committed to another mount
+func (u *routerUpload) Commit(name string, digests map[string]string) error {
+	_, mount, routed, err := u.server.route(name)
+	if err == nil && mount != u.mount {
+		err = errors.New(fmt.Sprintf("Can't commit '%v' as '%v' across mounts", u.file, name))
+	}
+
+	if err != nil {
+		u.Upload.Abort()
+		return err
+	}
+
+	return u.Upload.Commit(routed[len(mount):], digests)
+}
+
+// Find the backend serving a file along with its mount prefix and the
+// normalized file name
+func (s *RouterFileServer) route(file string) (FileServer, string, string, error) {
+	defer s.mutex.RUnlock()
+	s.mutex.RLock()
+
+	name := strings.TrimLeft(file, "/")
+	mount := s.longestMount(name)
+	backend, ok := s.mounts[mount]
+	if !ok {
+		return nil, "", "", NewError(ErrNotExist, fmt.Sprintf("No backend mounted for '%v'", file))
+	}
+
+	return backend, mount, name, nil
+}
+
+// The caller must hold the mutex
+func (s *RouterFileServer) longestMount(name string) string {
+	longest := ""
+	for mount := range s.mounts {
+		if strings.HasPrefix(name, mount) && len(mount) > len(longest) {
+			longest = mount
+		}
+	}
+
+	return longest
+}
+
+// "/boot", "boot/" and "boot" all become "boot/", the root becomes ""
+func normalizeMount(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+
+	return prefix + "/"
+}
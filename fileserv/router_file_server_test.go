@@ -0,0 +1,79 @@
+package fileserv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRouterRoutesByPrefix(t *testing.T) {
+	boot := NewMemFileServer()
+	uploads := NewMemFileServer()
+	serv := NewRouterFileServer()
+	serv.Mount("/boot", boot)
+	serv.Mount("/uploads/", uploads)
+
+	boot.Write(&File{Name: "kernel", Data: []byte{1}})
+
+	f, err := serv.Read("/boot/kernel")
+	if err != nil || f.Name != "/boot/kernel" || !bytes.Equal(f.Data, []byte{1}) {
+		t.Errorf("Expected /boot/kernel with data [1], received %v with err %v", f, err)
+	}
+
+	if err = serv.Write(&File{Name: "uploads/dump", Data: []byte{2}}); err != nil {
+		t.Errorf("Failed to write uploads/dump, returned %v", err)
+	}
+
+	if !uploads.FileExists("dump") {
+		t.Errorf("Expected dump to be written to the uploads backend")
+	}
+
+	if err = serv.Write(&File{Name: "other", Data: []byte{3}}); err == nil {
+		t.Errorf("Write outside any mount should have failed")
+	}
+
+	if err = serv.Rename("/uploads/dump", "/boot/dump"); err == nil {
+		t.Errorf("Rename across mounts should have failed")
+	}
+
+	u, err := serv.Stage("/uploads/staged")
+	if err != nil {
+		t.Fatalf("Failed to stage, returned %v", err)
+	}
+
+	if err = u.Commit("boot/staged", nil); err == nil || boot.FileExists("staged") {
+		t.Errorf("Commit across mounts should have failed")
+	}
+
+	if n := serv.Reap(); n != 0 {
+		t.Errorf("Expected the failed commit to abort the upload, reaped %v", n)
+	}
+}
+
+func TestRouterLongestPrefixWins(t *testing.T) {
+	root := NewMemFileServer()
+	boot := NewMemFileServer()
+	serv := NewRouterFileServer()
+	serv.Mount("/", root)
+	serv.Mount("/boot", boot)
+
+	serv.Write(&File{Name: "/boot/kernel", Data: []byte{1}})
+	serv.Write(&File{Name: "/readme", Data: []byte{2}})
+	root.Write(&File{Name: "boot/hidden", Data: []byte{3}})
+
+	if !boot.FileExists("kernel") || !root.FileExists("readme") {
+		t.Errorf("Expected files to be routed to the most specific mount")
+	}
+
+	infos, err := serv.List("")
+	if err != nil {
+		t.Fatalf("Failed to list, returned %v", err)
+	}
+
+	if len(infos) != 2 || infos[0].Name != "boot/kernel" || infos[1].Name != "readme" {
+		t.Errorf("Expected [boot/kernel readme], received %v", infos)
+	}
+
+	if infos, _ = serv.List("/boot/k"); len(infos) != 1 {
+		t.Errorf("Expected only boot/kernel, received %v", infos)
+	}
+}
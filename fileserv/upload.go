@@ -0,0 +1,37 @@
+package fileserv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An upload buffered in memory by the file server it is staged on, which
+// decides what committing and aborting mean
+type memUpload struct {
+	name     string
+	data     []byte
+	maxBytes int
+	commit   func(u *memUpload, name string, digests map[string]string) error
+	abort    func(u *memUpload)
+}
+
+func (u *memUpload) Write(data []byte) error {
+	if u.maxBytes > 0 && len(u.data)+len(data) > u.maxBytes {
+		return NewError(ErrNoSpace, fmt.Sprintf("File '%v' exceeds the %v byte limit", u.name, u.maxBytes))
+	}
+
+	u.data = append(u.data, data...)
+	return nil
+}
+
+func (u *memUpload) Commit(name string, digests map[string]string) error {
+	return u.commit(u, name, digests)
+}
+
+func (u *memUpload) Abort() {
+	u.abort(u)
+}
+
+func abortedError(file string) error {
+	return errors.New(fmt.Sprintf("Upload of '%v' was aborted", file))
+}
@@ -1,12 +1,231 @@
 package main
 
 import (
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/gabrielhartmann/tftp/admin"
+	"github.com/gabrielhartmann/tftp/config"
+	. "github.com/gabrielhartmann/tftp/fileserv"
 	. "github.com/gabrielhartmann/tftp/tftp"
 )
 
 func main() {
-	if err := StartNewReqSession(); err != nil {
+	configFile := flag.String("config", "", "YAML configuration file, replacing the listener, port, admin, rate limit, integrity and dedup flags, reloaded on SIGHUP")
+	addrs := flag.String("addr", ":0", "Comma separated UDP addresses to listen for requests on, e.g. 0.0.0.0:69,[::]:69, an ephemeral port by default")
+	portRange := flag.String("port-range", "", "Inclusive range of UDP ports for transfers, e.g. 50000-50100, ephemeral ports by default")
+	singlePort := flag.Bool("single-port", false, "Run every session over the listening port instead of a new port per session")
+	adminAddr := flag.String("admin", "", "Address of the optional admin HTTP API, e.g. localhost:8069")
+	adminToken := flag.String("admin-token", "", "Shared token required by the admin HTTP API")
+	tracePcap := flag.String("trace-pcap", "", "File to capture packets to in pcap format")
+	traceLog := flag.String("trace-log", "", "File to log decoded packets to, - for stderr")
+	traceClient := flag.String("trace-client", "", "Only trace packets of this client IP or CIDR subnet")
+	traceFile := flag.String("trace-file", "", "Only trace transfers of files matching this pattern, e.g. boot/*")
+	multicast := flag.String("multicast", "", "Serve RFC 2090 multicast reads using groups from this CIDR range, e.g. 239.255.69.0/24")
+	multicastPort := flag.Int("multicast-port", 1758, "UDP port of the multicast groups")
+	multicastIf := flag.String("multicast-if", "", "Interface to send multicast on, chosen by the system by default")
+	rateLimit := flag.Int("rate-limit", 0, "Bytes per second all transfers together may use, unlimited by default")
+	digests := flag.String("digests", "", "Comma separated digests of uploads to compute besides sha256: md5, crc32")
+	requireSidecar := flag.Bool("require-sidecar", false, "Reject uploads not preceded by a <name>.sha256 file holding their digest")
+	quarantine := flag.String("quarantine", "", "Prefix to keep uploads failing the sidecar check under, e.g. quarantine/, dropped by default")
+	dedup := flag.Bool("dedup", false, "Store files with the same contents once")
+	inetd := flag.Bool("inetd", false, "Serve the socket passed as stdin by inetd instead of listening")
+	auditLog := flag.String("audit-log", "", "File to append a JSON record of every transfer to")
+	auditMaxBytes := flag.Int64("audit-max-bytes", 10*1024*1024, "Size at which the audit log is rotated, never if 0")
+	auditBackups := flag.Int("audit-backups", 5, "Number of rotated audit logs to keep, at least 1 when rotating")
+	idleExit := flag.Duration("idle-exit", 0, "Exit after this long without requests or sessions, e.g. 5m, never by default")
+	flag.Parse()
+
+	var server *Server
+	listen := strings.Split(*addrs, ",")
+	if *configFile != "" {
+		c, err := config.Load(*configFile)
+		if err != nil {
+			logrus.Fatalf("%v", err)
+		}
+
+		if server, err = c.NewServer(); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+
+		listen = c.Listen
+		*adminAddr, *adminToken = c.Admin.Addr, c.Admin.Token
+		go reloadOnHangup(*configFile, server, c)
+	} else {
+		server = newServer(*portRange, *singlePort, *rateLimit, *dedup)
+
+		integrity := IntegrityConfig{RequireSidecar: *requireSidecar, Quarantine: *quarantine}
+		if *digests != "" {
+			integrity.Digests = strings.Split(*digests, ",")
+		}
+		if err := server.SetIntegrity(integrity); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+
+	if *tracePcap != "" || *traceLog != "" {
+		server.SetTracer(newTracer(*tracePcap, *traceLog, TraceFilter{Client: *traceClient, File: *traceFile}))
+	}
+
+	if *auditLog != "" {
+		log, err := NewAuditLog(*auditLog, *auditMaxBytes, *auditBackups)
+		if err != nil {
+			logrus.Fatalf("%v", err)
+		}
+		server.SetAuditor(log)
+	}
+
+	if *multicast != "" {
+		multicastConfig := MulticastConfig{Port: *multicastPort}
+		_, groups, err := net.ParseCIDR(*multicast)
+		if err != nil {
+			logrus.Fatalf("Invalid multicast groups '%v', expected e.g. 239.255.69.0/24", *multicast)
+		}
+		multicastConfig.Groups = groups
+
+		if *multicastIf != "" {
+			if multicastConfig.Interface, err = net.InterfaceByName(*multicastIf); err != nil {
+				logrus.Fatalf("%v", err)
+			}
+		}
+
+		if err := server.EnableMulticast(multicastConfig); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+
+	if *adminAddr != "" {
+		go func() {
+			if err := admin.ListenAndServe(*adminAddr, server, *adminToken); err != nil {
+				logrus.Fatalf("%v", err)
+			}
+		}()
+	}
+
+	shutdown := make(chan struct{})
+	go shutdownOnSignal(server, shutdown)
+	server.SetIdleTimeout(*idleExit)
+	if err := serve(server, listen, *inetd); err == ErrIdleTimeout {
+		logrus.Infof("Exiting after being idle for %v", *idleExit)
+	} else if err == ErrServerClosed {
+		<-shutdown
+	} else if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+}
+
+// Sockets passed by systemd or inetd take the place of the listening
+// addresses
+func serve(server *Server, listen []string, inetd bool) error {
+	conns, err := InheritedConns()
+	if err != nil {
+		return err
+	}
+
+	if inetd {
+		conn, err := InetdConn()
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	if len(conns) > 0 {
+		return server.ServeInherited(conns...)
+	}
+
+	return server.ListenAndServe(listen...)
+}
+
+func newServer(portRange string, singlePort bool, rateLimit int, dedup bool) *Server {
+	udpTransport := &UDPTransport{}
+	if portRange != "" {
+		var err error
+		if udpTransport.MinPort, udpTransport.MaxPort, err = ParsePortRange(portRange); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+
+	var transport Transport = udpTransport
+	if singlePort {
+		transport = NewMuxTransport(transport)
+	}
+
+	var fileServ FileServer = NewMemFileServer()
+	if dedup {
+		fileServ = NewDedupFileServer(time.Minute)
+	}
+
+	server := NewServerWithTransport(fileServ, transport)
+	if rateLimit > 0 {
+		if err := server.SetRateLimits([]RateLimit{{Rate: rateLimit}}); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+
+	return server
+}
+
+// Stop serving on SIGINT or SIGTERM, aborting unfinished uploads on the
+// way out, and close done once the sessions ended
+func shutdownOnSignal(server *Server, done chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	s := <-signals
+	logrus.Infof("Shutting down on %v", s)
+	if err := server.Shutdown(5 * time.Second); err != nil {
+		logrus.Errorf("%v", err)
+	}
+	close(done)
+}
+
+// Reloading only changes access rules, rate limits and logging, so
+// transfers keep running
+func reloadOnHangup(file string, server *Server, current *config.Config) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		c, err := config.Reload(file, server, current)
+		if err != nil {
+			logrus.Errorf("[Config]: Keeping the previous configuration: %v", err)
+		}
+		current = c
+	}
+}
+
+func newTracer(pcapFile string, logFile string, filter TraceFilter) *PacketTracer {
+	var pcap, log io.Writer
+	if pcapFile != "" {
+		f, err := os.Create(pcapFile)
+		if err != nil {
+			logrus.Fatalf("%v", err)
+		}
+		pcap = f
+	}
+
+	if logFile == "-" {
+		log = os.Stderr
+	} else if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logrus.Fatalf("%v", err)
+		}
+		log = f
+	}
+
+	tracer, err := NewPacketTracer(pcap, log, filter)
+	if err != nil {
 		logrus.Fatalf("%v", err)
 	}
+
+	return tracer
 }
@@ -0,0 +1,87 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sync"
+)
+
+// AccessRule allows or denies requests.  The first rule matching a
+// request decides, and requests matching no rule are allowed.
+type AccessRule struct {
+	// IP address or CIDR subnet of the clients, every client when empty
+	Client string
+
+	// A path.Match pattern for the files, every file when empty
+	File string
+
+	// DirectionRead or DirectionWrite, both when empty
+	Direction string
+
+	Allow bool
+}
+
+type accessRules struct {
+	mutex sync.RWMutex
+	rules []AccessRule
+	nets  []*net.IPNet
+}
+
+func (a *accessRules) set(rules []AccessRule) error {
+	nets := []*net.IPNet{}
+	for _, rule := range rules {
+		subnet, err := parseClientSubnet(rule.Client)
+		if err != nil {
+			return err
+		}
+
+		if _, err := path.Match(rule.File, ""); err != nil {
+			return errors.New(fmt.Sprintf("Invalid file pattern '%v': %v", rule.File, err))
+		}
+
+		if rule.Direction != "" && rule.Direction != DirectionRead && rule.Direction != DirectionWrite {
+			return errors.New(fmt.Sprintf("Invalid direction '%v', expected %v or %v", rule.Direction, DirectionRead, DirectionWrite))
+		}
+
+		nets = append(nets, subnet)
+	}
+
+	defer a.mutex.Unlock()
+	a.mutex.Lock()
+
+	a.rules = append([]AccessRule{}, rules...)
+	a.nets = nets
+	return nil
+}
+
+func (a *accessRules) list() []AccessRule {
+	defer a.mutex.RUnlock()
+	a.mutex.RLock()
+
+	return append([]AccessRule{}, a.rules...)
+}
+
+func (a *accessRules) allowed(client net.Addr, file string, direction string) bool {
+	defer a.mutex.RUnlock()
+	a.mutex.RLock()
+
+	for i, rule := range a.rules {
+		if !subnetContains(a.nets[i], client) {
+			continue
+		}
+
+		if rule.File != "" {
+			if ok, _ := path.Match(rule.File, file); !ok {
+				continue
+			}
+		}
+
+		if rule.Direction == "" || rule.Direction == direction {
+			return rule.Allow
+		}
+	}
+
+	return true
+}
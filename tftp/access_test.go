@@ -0,0 +1,94 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+func TestAccessRulesFirstMatchWins(t *testing.T) {
+	rules := &accessRules{}
+	err := rules.set([]AccessRule{
+		{Client: "10.0.0.1", Allow: true},
+		{Client: "10.0.0.0/8", File: "boot/*", Direction: DirectionRead, Allow: true},
+		{Client: "10.0.0.0/8", Allow: false},
+		{File: "secret", Allow: false},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set rules: %v", err)
+	}
+
+	admin := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	device := &net.UDPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1000}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1000}
+
+	tests := []struct {
+		client    net.Addr
+		file      string
+		direction string
+		allowed   bool
+	}{
+		{admin, "secret", DirectionWrite, true},
+		{device, "boot/kernel", DirectionRead, true},
+		{device, "boot/kernel", DirectionWrite, false},
+		{device, "dump", DirectionWrite, false},
+		{other, "dump", DirectionWrite, true},
+		{other, "secret", DirectionRead, false},
+	}
+
+	for _, test := range tests {
+		if allowed := rules.allowed(test.client, test.file, test.direction); allowed != test.allowed {
+			t.Errorf("Expected %v of '%v' by %v to be allowed: %v", test.direction, test.file, test.client, test.allowed)
+		}
+	}
+}
+
+func TestAccessRulesNegative(t *testing.T) {
+	rules := &accessRules{}
+	for _, rule := range []AccessRule{
+		{Client: "nobody"},
+		{File: "["},
+		{Direction: "both"},
+	} {
+		if err := rules.set([]AccessRule{rule}); err == nil {
+			t.Errorf("Expected rule %v to be rejected", rule)
+		}
+	}
+}
+
+func TestSessionAccessDenied(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(10)})
+	auditor := make(recordingAuditor, 10)
+	server.SetAuditor(auditor)
+
+	if err := server.SetAccessRules([]AccessRule{{Direction: DirectionWrite, Allow: false}}); err != nil {
+		t.Fatalf("Failed to set rules: %v", err)
+	}
+
+	if _, err := newTestClient(network, addr).get("foo"); err != nil {
+		t.Errorf("Expected reads to be allowed, received: %v", err)
+	}
+
+	err := newTestClient(network, addr).put("bar", testData(10))
+	if e, ok := err.(*testClientError); !ok || e.code != AccessViolation {
+		t.Errorf("Expected an access violation, received: %v", err)
+	}
+
+	if server.FileServer().FileExists("bar") {
+		t.Errorf("A denied write mustn't store the file")
+	}
+	// The allowed read may be audited either side of the denied write
+	record := auditor.next(t)
+	if record.Direction == DirectionRead {
+		record = auditor.next(t)
+	}
+	if record.File != "bar" || record.Direction != DirectionWrite || record.Outcome != OutcomeFailed ||
+		record.ErrorCode == nil || *record.ErrorCode != AccessViolation {
+		t.Errorf("Unexpected record of a denied write: %+v", record)
+	}
+}
@@ -0,0 +1,75 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// InheritedConns returns the sockets passed by systemd socket activation,
+// in the order of the socket unit, or none when the process wasn't socket
+// activated.  The environment variables describing them are unset, so
+// child processes don't take them for their own.
+func InheritedConns() ([]net.PacketConn, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return inheritedConns(pid, fds, listenFdsStart)
+}
+
+func inheritedConns(pid string, fds string, first int) ([]net.PacketConn, error) {
+	if fds == "" {
+		return nil, nil
+	}
+
+	// The sockets are meant for another process when the PID differs
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid LISTEN_FDS '%v'", fds))
+	}
+
+	conns := []net.PacketConn{}
+	for fd := first; fd < first+n; fd++ {
+		conn, err := fileConn(os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%v", fd)))
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		conns = append(conns, conn)
+	}
+
+	return conns, nil
+}
+
+// InetdConn returns the socket inetd passes as standard input, as
+// configured with "wait" for a UDP service
+func InetdConn() (net.PacketConn, error) {
+	return fileConn(os.Stdin)
+}
+
+// The connection holds a duplicate of the descriptor, so the file is
+// closed either way
+func fileConn(file *os.File) (net.PacketConn, error) {
+	defer file.Close()
+
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Inherited %v isn't a datagram socket: %v", file.Name(), err))
+	}
+
+	return conn, nil
+}
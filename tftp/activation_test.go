@@ -0,0 +1,148 @@
+package tftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+// Pass a socket as systemd would, by its descriptor
+func inheritSocket(t *testing.T) (net.PacketConn, *net.UDPAddr) {
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	file, err := conn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatalf("Failed to get the socket descriptor: %v", err)
+	}
+
+	conns, err := inheritedConns(strconv.Itoa(os.Getpid()), "1", int(file.Fd()))
+	if err != nil || len(conns) != 1 {
+		t.Fatalf("Failed to inherit the socket: %v, %v", conns, err)
+	}
+
+	return conns[0], &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// A request sent before the server starts, as with inetd, is answered
+func TestServeInheritedPendingRequest(t *testing.T) {
+	for _, transport := range []Transport{&UDPTransport{}, NewMuxTransport(&UDPTransport{})} {
+		conn, addr := inheritSocket(t)
+		server := NewServerWithTransport(NewMemFileServer(), transport)
+		data := testData(100)
+		server.FileServer().Write(&File{Name: "foo", Data: data})
+
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		client.WriteTo(requestBytes(RRQ, "foo"), addr)
+
+		go server.ServeInherited(conn)
+
+		buf := make([]byte, 1024)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, tid, err := client.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], blockBytes(DATA, 1, data)) {
+			t.Errorf("Expected the first block with %T, received %v, %v", transport, buf[:n], err)
+		} else {
+			client.WriteTo(blockBytes(ACK, 1, nil), tid)
+		}
+
+		if _, err := newUDPTestClient(addr).get("foo"); err != nil {
+			t.Errorf("Failed to read over the inherited socket with %T: %v", transport, err)
+		}
+
+		client.Close()
+		conn.Close()
+	}
+}
+
+func TestInheritedConnsNegative(t *testing.T) {
+	if conns, err := inheritedConns("", "", listenFdsStart); conns != nil || err != nil {
+		t.Errorf("Expected no sockets without LISTEN_FDS, received %v, %v", conns, err)
+	}
+
+	if conns, err := inheritedConns(strconv.Itoa(os.Getpid()+1), "1", listenFdsStart); conns != nil || err != nil {
+		t.Errorf("Expected no sockets for another process, received %v, %v", conns, err)
+	}
+
+	if _, err := inheritedConns("", "many", listenFdsStart); err == nil {
+		t.Errorf("Expected an invalid LISTEN_FDS to be rejected")
+	}
+
+	file, err := ioutil.TempFile("", "activation")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := inheritedConns("", "1", int(file.Fd())); err == nil {
+		t.Errorf("Expected a regular file to be rejected")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	server := NewServerWithTransport(NewMemFileServer(), network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(2000)})
+	server.SetIdleTimeout(200 * time.Millisecond)
+
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeInherited(conn)
+	}()
+
+	if _, err := newTestClient(network, conn.LocalAddr()).get("foo"); err != nil {
+		t.Errorf("Failed to read: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != ErrIdleTimeout {
+			t.Errorf("Expected the idle timeout, received %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server never exited while idle")
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Server exited after %v, before the idle timeout", elapsed)
+	}
+}
+
+// Timeouts too short to tick a tenth of are still honoured
+func TestIdleTimeoutTiny(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	server := NewServerWithTransport(NewMemFileServer(), network)
+	server.SetIdleTimeout(5 * time.Nanosecond)
+
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	if err := server.ServeInherited(conn); err != ErrIdleTimeout {
+		t.Errorf("Expected the idle timeout, received %v", err)
+	}
+}
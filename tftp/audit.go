@@ -0,0 +1,200 @@
+package tftp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	OutcomeCompleted = "completed"
+	OutcomeFailed    = "failed"
+)
+
+// AuditRecord describes a finished transfer, successful or not
+type AuditRecord struct {
+	Time      time.Time         `json:"time"`
+	Client    string            `json:"client"`
+	Port      int               `json:"port"`
+	File      string            `json:"file"`
+	Direction string            `json:"direction"`
+	Mode      string            `json:"mode"`
+	Options   map[string]string `json:"options,omitempty"`
+	Bytes     int               `json:"bytes"`
+
+	// In seconds
+	Duration float64 `json:"duration"`
+
+	Outcome string `json:"outcome"`
+
+	// Set when an error packet was sent or received
+	ErrorCode *uint16 `json:"error_code,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Auditor is told about every transfer once it ends
+type Auditor interface {
+	Audit(*AuditRecord)
+}
+
+// Start the record of a transfer beginning now
+func newAuditRecord(client net.Addr, file string, direction string, mode string) *AuditRecord {
+	record := &AuditRecord{
+		Time:      time.Now(),
+		Client:    client.String(),
+		File:      file,
+		Direction: direction,
+		Mode:      mode,
+	}
+
+	if udpAddr, ok := client.(*net.UDPAddr); ok {
+		record.Client = udpAddr.IP.String()
+		record.Port = udpAddr.Port
+	}
+
+	return record
+}
+
+// Complete the record of a transfer ending with err and pass it on
+func (s *Server) audit(record *AuditRecord, bytes int, err error) {
+	if s.auditor == nil {
+		return
+	}
+
+	record.Bytes = bytes
+	record.Duration = time.Since(record.Time).Seconds()
+	record.Outcome = OutcomeCompleted
+
+	if err != nil {
+		record.Outcome = OutcomeFailed
+		record.Error = err.Error()
+
+		var tftpErr *Error
+		if errors.As(err, &tftpErr) {
+			code := tftpErr.Code
+			record.ErrorCode = &code
+		}
+	}
+
+	s.auditor.Audit(record)
+}
+
+// AuditLog writes records as JSON, one per line, to a file rotated once
+// it would grow beyond a size.  The rotated files are named like the log
+// with a suffix of .1 for the most recent up to the number of backups
+// kept.
+type AuditLog struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// NewAuditLog appends to the file at path.  A maxBytes of 0 never rotates.
+// Rotating needs at least one backup, as records are never discarded.
+func NewAuditLog(path string, maxBytes int64, backups int) (*AuditLog, error) {
+	if maxBytes < 0 || backups < 0 || (maxBytes > 0 && backups == 0) {
+		return nil, errors.New(fmt.Sprintf("Invalid audit log rotation at %v bytes with %v backups", maxBytes, backups))
+	}
+
+	l := &AuditLog{
+		path:     path,
+		maxBytes: maxBytes,
+		backups:  backups,
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *AuditLog) Audit(record *AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		logrus.Errorf("[Audit]: Failed to encode %v: %v", record, err)
+		return
+	}
+	line = append(line, '\n')
+
+	defer l.mutex.Unlock()
+	l.mutex.Lock()
+
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			logrus.Errorf("[Audit]: Failed to rotate %v: %v", l.path, err)
+		}
+	}
+
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			logrus.Errorf("[Audit]: Lost record of '%v' by %v: %v", record.File, record.Client, err)
+			return
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		logrus.Errorf("[Audit]: Failed to write %v: %v", l.path, err)
+	}
+}
+
+func (l *AuditLog) Close() error {
+	defer l.mutex.Unlock()
+	l.mutex.Lock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// The caller must hold the mutex
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Shift the backups up by one, dropping the oldest, and start a new
+// file.  The caller must hold the mutex.
+func (l *AuditLog) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	for i := l.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%v.%v", l.path, i), fmt.Sprintf("%v.%v", l.path, i+1))
+	}
+
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+
+	return l.open()
+}
@@ -0,0 +1,164 @@
+package tftp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+type recordingAuditor chan *AuditRecord
+
+func (a recordingAuditor) Audit(record *AuditRecord) {
+	a <- record
+}
+
+func (a recordingAuditor) next(t *testing.T) *AuditRecord {
+	select {
+	case record := <-a:
+		return record
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No transfer was audited")
+		return nil
+	}
+}
+
+func TestSessionAudit(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	auditor := make(recordingAuditor, 10)
+	server := NewServerWithTransport(NewMemFileServer(), network)
+	server.SetAuditor(auditor)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(1000)})
+
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(conn)
+	addr := conn.LocalAddr()
+
+	if _, err := newTestClient(network, addr).get("foo"); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	record := auditor.next(t)
+	if record.File != "foo" || record.Direction != DirectionRead || record.Mode != "octet" || record.Bytes != 1000 ||
+		record.Outcome != OutcomeCompleted || record.ErrorCode != nil || record.Client == "" || record.Duration < 0 {
+		t.Errorf("Unexpected record of a completed read: %+v", record)
+	}
+
+	newTestClient(network, addr).get("missing")
+	record = auditor.next(t)
+	if record.File != "missing" || record.Outcome != OutcomeFailed || record.ErrorCode == nil || *record.ErrorCode != FileNotFound {
+		t.Errorf("Unexpected record of a failed read: %+v", record)
+	}
+
+	if err := newTestClient(network, addr).put("bar", testData(700)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	record = auditor.next(t)
+	if record.File != "bar" || record.Direction != DirectionWrite || record.Bytes != 700 || record.Outcome != OutcomeCompleted {
+		t.Errorf("Unexpected record of a completed write: %+v", record)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	line, _ := json.Marshal(&AuditRecord{File: "file0", Outcome: OutcomeCompleted})
+
+	// Room for two records per file
+	log, err := NewAuditLog(path, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	for _, file := range []string{"file0", "file1", "file2", "file3", "file4", "file5", "file6"} {
+		log.Audit(&AuditRecord{File: file, Outcome: OutcomeCompleted})
+	}
+	log.Close()
+
+	expected := map[string][]string{
+		path:        {"file6"},
+		path + ".1": {"file4", "file5"},
+		path + ".2": {"file2", "file3"},
+	}
+
+	for name, files := range expected {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Errorf("Failed to open %v: %v", name, err)
+			continue
+		}
+
+		var received []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Errorf("Invalid record in %v: %v", name, err)
+			}
+			received = append(received, record.File)
+		}
+		f.Close()
+
+		if len(received) != len(files) || received[0] != files[0] || received[len(received)-1] != files[len(files)-1] {
+			t.Errorf("Expected %v in %v, received %v", files, name, received)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only two backups to be kept")
+	}
+
+	if _, err := NewAuditLog(path, -1, 0); err == nil {
+		t.Errorf("Expected a negative size to be rejected")
+	}
+
+	if _, err := NewAuditLog(path, 100, 0); err == nil {
+		t.Errorf("Expected rotation without backups to be rejected")
+	}
+}
+
+func TestAuditLogWithoutRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	log, err := NewAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		log.Audit(&AuditRecord{File: "file", Outcome: OutcomeCompleted})
+	}
+	log.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %v: %v", path, err)
+	}
+
+	if lines := bytes.Count(data, []byte{'\n'}); lines != 100 {
+		t.Errorf("Expected all 100 records kept, received %v", lines)
+	}
+}
@@ -0,0 +1,24 @@
+package tftp
+
+import "sync"
+
+// Largest packet read or written.  Data packets are at most 516 bytes,
+// the rest leaves room for long request and error packets.
+const maxPacketSize = 1024
+
+// Packet buffers are pooled so that sessions don't allocate per block
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxPacketSize)
+		return &buf
+	},
+}
+
+func getPacketBuffer() *[]byte {
+	return packetPool.Get().(*[]byte)
+}
+
+func putPacketBuffer(buf *[]byte) {
+	*buf = (*buf)[:maxPacketSize]
+	packetPool.Put(buf)
+}
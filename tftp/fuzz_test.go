@@ -0,0 +1,279 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+)
+
+// Packets as sent by common clients, used to seed every fuzz target.
+// More live in testdata/fuzz.  Those named curl-* were captured with
+// -trace-pcap from curl 7.88.1 uploading and downloading a 1300 byte
+// file.  The others, including those shaped like PXE and U-Boot
+// requests, were written by hand rather than captured.
+var fuzzSeeds = [][]byte{
+	[]byte("\x00\x01foo.txt\x00octet\x00"),
+	[]byte("\x00\x01foo.txt\x00netascii\x00"),
+	[]byte("\x00\x02foo.txt\x00octet\x00"),
+	[]byte("\x00\x01pxelinux.0\x00octet\x00tsize\x000\x00blksize\x001456\x00"),
+	[]byte("\x00\x01undionly.kpxe\x00octet\x00blksize\x001432\x00tsize\x000\x00timeout\x001\x00"),
+	[]byte("\x00\x03\x00\x01abc"),
+	[]byte("\x00\x03\x00\x02"),
+	[]byte("\x00\x04\x00\x00"),
+	[]byte("\x00\x04\x00\x01"),
+	[]byte("\x00\x05\x00\x01File not found\x00"),
+	[]byte("\x00\x05\x00\x08\x00"),
+	[]byte("\x00\x06blksize\x001456\x00"),
+}
+
+func addSeeds(f *testing.F, strip int) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed[strip:])
+	}
+}
+
+// Packet sequences for the session fuzzers are encoded as a two byte
+// length followed by the packet
+func splitPackets(b []byte) [][]byte {
+	packets := [][]byte{}
+	for len(b) >= 2 {
+		n := int(b[0])<<8 | int(b[1])
+		b = b[2:]
+		if n > len(b) {
+			n = len(b)
+		}
+
+		packets = append(packets, b[:n])
+		b = b[n:]
+	}
+
+	return packets
+}
+
+func joinPackets(packets ...[]byte) []byte {
+	b := []byte{}
+	for _, p := range packets {
+		b = append(b, byte(len(p)>>8), byte(len(p)))
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+func addSequenceSeeds(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(joinPackets(seed))
+	}
+
+	f.Add(joinPackets(blockBytes(ACK, 1, nil), blockBytes(ACK, 1, nil), blockBytes(ACK, 2, nil)))
+	f.Add(joinPackets(blockBytes(DATA, 1, make([]byte, dataBlockSize)), blockBytes(DATA, 1, make([]byte, dataBlockSize)), blockBytes(DATA, 2, nil)))
+	f.Add(joinPackets(blockBytes(DATA, 2, nil), blockBytes(ACK, 0, nil), []byte{0, 5, 0, 0, 0}))
+}
+
+func FuzzParseRequest(f *testing.F) {
+	addSeeds(f, 2)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		file, mode, err := parseRequest(input)
+		if err != nil {
+			return
+		}
+
+		if validateMode(mode) != nil {
+			t.Errorf("Accepted mode %q", mode)
+		}
+
+		if !bytes.HasPrefix(input, append([]byte(file), 0)) {
+			t.Errorf("File %q isn't the start of %q", file, input)
+		}
+	})
+}
+
+func FuzzParseData(f *testing.F) {
+	addSeeds(f, 2)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		block, data, err := parseData(input)
+		if err != nil {
+			return
+		}
+
+		if !bytes.Equal(blockBytes(DATA, block, data)[2:], input) {
+			t.Errorf("Block %v with %v bytes doesn't encode back to %q", block, len(data), input)
+		}
+	})
+}
+
+func FuzzParseAck(f *testing.F) {
+	addSeeds(f, 2)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		block, err := parseAck(input)
+		if err == nil && !bytes.HasPrefix(input, []byte{byte(block >> 8), byte(block)}) {
+			t.Errorf("Block %v doesn't encode back to %q", block, input)
+		}
+	})
+}
+
+func FuzzParseError(f *testing.F) {
+	addSeeds(f, 2)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		var p Error
+		if err := p.UnmarshalBinary(append([]byte{0, ERROR}, input...)); err != nil {
+			return
+		}
+
+		if !bytes.Equal(appendErrorPacket(nil, p.Code, p.Msg)[2:], input) {
+			t.Errorf("Code %v and message %q don't encode back to %q", p.Code, p.Msg, input)
+		}
+	})
+}
+
+// Anything that parses must encode again and parse to the same packet
+func FuzzParsePacket(f *testing.F) {
+	addSeeds(f, 0)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		p, err := ParsePacket(input)
+		if err != nil {
+			return
+		}
+
+		b, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Parsed %#v from %q but can't marshal it: %v", p, input, err)
+		}
+
+		again, err := ParsePacket(b)
+		if err != nil || !equalPackets(p, again) {
+			t.Errorf("Parsed %#v from %q but %#v from its encoding %q", p, input, again, b)
+		}
+	})
+}
+
+// The sessions reject every packet ParsePacket rejects
+func FuzzHandlePackets(f *testing.F) {
+	addSeeds(f, 0)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		err := HandleTftpPackets(&requestRecorder{}, benchAddr, input)
+		if _, parseErr := ParsePacket(input); parseErr != nil && !isMalformed(err) {
+			t.Errorf("Handled %q which ParsePacket rejects with %v", input, parseErr)
+		}
+	})
+}
+
+// Sessions can't be opened, so the request session answers every
+// request itself instead of starting a session
+type busyTransport struct{}
+
+func (busyTransport) Listen(addr string) (net.PacketConn, error) {
+	return nil, errors.New("Listening isn't supported")
+}
+
+func (busyTransport) SessionConn(localAddr net.Addr, remoteAddr net.Addr) (net.PacketConn, error) {
+	return nil, errors.New("No transfer port free")
+}
+
+func FuzzReqSession(f *testing.F) {
+	addSeeds(f, 0)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		conn := &benchConn{}
+		s := NewReqSession(NewTftpReaderWriterFromConn(conn, nil, false), NewServerWithTransport(NewMemFileServer(), busyTransport{}))
+
+		err := HandleTftpPackets(s, benchAddr, input)
+		if opcode, _ := getOpcode(input); err == nil && opcode != RRQ && opcode != WRQ {
+			t.Errorf("Request session accepted %q", input)
+		}
+	})
+}
+
+// Whatever packets a read session receives, it keeps sending the block
+// it expects an ACK for and ACKs of the remaining blocks complete it
+func FuzzReadSession(f *testing.F) {
+	addSequenceSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		conn := &benchConn{}
+		server := NewServer(NewMemFileServer())
+		file := &File{Name: "foo", Data: testData(3*dataBlockSize + 100)}
+		s := &ReadSession{
+			rw:        NewTftpReaderWriterFromConn(conn, benchAddr, false),
+			server:    server,
+			file:      file,
+			sendBuf:   getPacketBuffer(),
+			currBlock: 1,
+			lastBlock: 4,
+		}
+		s.tracked = server.sessions.add(SessionInfo{Client: benchAddr.String()}, s.rw)
+		s.writeData()
+
+		check := func() {
+			if s.currBlock < 1 || int(s.currBlock) > s.lastBlock {
+				t.Fatalf("Current block %v out of range", s.currBlock)
+			}
+
+			if last := conn.last; last[1] == DATA && uint16(last[2])<<8|uint16(last[3]) != s.currBlock {
+				t.Fatalf("Sent block %v while expecting an ACK for %v", last[3], s.currBlock)
+			}
+		}
+
+		for _, packet := range splitPackets(input) {
+			HandleTftpPackets(s, benchAddr, packet)
+			check()
+		}
+
+		for i := 0; !s.fileComplete; i++ {
+			if i > s.lastBlock {
+				t.Fatalf("Session wedged at block %v", s.currBlock)
+			}
+
+			if err := s.Ack(s.currBlock); err != nil {
+				t.Fatalf("Ack of block %v failed: %v", s.currBlock, err)
+			}
+			check()
+		}
+	})
+}
+
+// Whatever packets a write session receives, it holds exactly the
+// blocks it ACKed and the next blocks complete the file
+func FuzzWriteSession(f *testing.F) {
+	addSequenceSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		conn := &benchConn{}
+		server := NewServer(NewMemFileServer())
+		upload, _ := server.FileServer().Stage("foo")
+		s := &WriteSession{
+			rw:       NewTftpReaderWriterFromConn(conn, benchAddr, false),
+			server:   server,
+			upload:   upload,
+			fileName: "foo",
+		}
+		s.tracked = server.sessions.add(SessionInfo{Client: benchAddr.String()}, s.rw)
+		s.writeAck()
+
+		check := func() {
+			if !s.fileComplete && s.bytes != int(s.block)*dataBlockSize {
+				t.Fatalf("Holding %v bytes after %v blocks", s.bytes, s.block)
+			}
+
+			if last := conn.last; last[1] == ACK && uint16(last[2])<<8|uint16(last[3]) != s.block {
+				t.Fatalf("Sent ACK %v after block %v", last[3], s.block)
+			}
+		}
+
+		for _, packet := range splitPackets(input) {
+			HandleTftpPackets(s, benchAddr, packet)
+			check()
+		}
+
+		if !s.fileComplete {
+			if err := s.Data(s.block+1, []byte("end")); err != nil {
+				t.Fatalf("Final block %v failed: %v", s.block+1, err)
+			}
+			check()
+		}
+
+		if file, err := server.FileServer().Read("foo"); err != nil || len(file.Data) != s.bytes {
+			t.Fatalf("Stored file doesn't hold the %v bytes received: %v", s.bytes, err)
+		}
+	})
+}
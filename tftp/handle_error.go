@@ -5,6 +5,7 @@ import (
 	"net"
 
 	"github.com/Sirupsen/logrus"
+	. "github.com/gabrielhartmann/tftp/fileserv"
 )
 
 const (
@@ -16,20 +17,50 @@ const (
 	UnknownTid
 	FileExists
 	NoSuchUser
+	OptionRefused // RFC 2347
 )
 
 func getErrorPacket(code uint16, msg string) *ErrorPacket {
-	codeBytes, _ := convertIntToBytes(code)
-	errorPacket := NewErrorPacket([2]byte{codeBytes[0], codeBytes[1]}, msg)
-	return errorPacket
+	return &ErrorPacket{
+		code:  code,
+		msg:   msg,
+		bytes: appendErrorPacket(nil, code, msg),
+	}
 }
 
+// HandleError sends an error packet and returns it as an *Error
 func HandleError(writer *TftpReaderWriter, code uint16, msg string) error {
 	errorPacket := getErrorPacket(code, msg)
 
 	logrus.Infof("Sending error packet: code: %v, msg: %v", errorPacket.code, errorPacket.msg)
 	writer.Write(errorPacket.bytes)
-	return errors.New(msg)
+	return &Error{Code: code, Msg: msg}
+}
+
+// Send the error packet matching err, e.g. from a file server
+func handleFileError(writer *TftpReaderWriter, err error) error {
+	return HandleError(writer, ErrorCode(err), err.Error())
+}
+
+// ErrorCode returns the TFTP error code for err.  An *Error keeps its
+// code, the file server errors map to the matching codes and anything
+// else is an UndefinedError.
+func ErrorCode(err error) uint16 {
+	var tftpErr *Error
+	switch {
+	case errors.As(err, &tftpErr):
+		return tftpErr.Code
+	case errors.Is(err, ErrNotExist):
+		return FileNotFound
+	case errors.Is(err, ErrExist):
+		return FileExists
+	case errors.Is(err, ErrPermission):
+		return AccessViolation
+	case errors.Is(err, ErrNoSpace):
+		return DiskFull
+	}
+
+	return UndefinedError
 }
 
 func isTimeout(err error) bool {
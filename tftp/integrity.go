@@ -0,0 +1,106 @@
+package tftp
+
+import (
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/gabrielhartmann/tftp/fileserv"
+)
+
+// Uploads of a file are checked against the SHA-256 digest in the file
+// of the same name with this suffix
+const sidecarSuffix = ".sha256"
+
+// IntegrityConfig controls the digests computed for uploads and how they
+// are checked.  A SHA-256 digest is always computed.
+type IntegrityConfig struct {
+	// Digests computed besides SHA-256, e.g. MD5 or CRC32
+	Digests []string
+
+	// Uploads must be preceded by a sidecar file, named like the upload
+	// with a .sha256 suffix, holding the expected SHA-256 digest as
+	// written by sha256sum
+	RequireSidecar bool
+
+	// Prefix under which uploads failing the check are kept, e.g.
+	// "quarantine/".  They are dropped when empty.
+	Quarantine string
+}
+
+// The digests of an upload, computed as its blocks arrive
+type uploadDigests map[string]hash.Hash
+
+func newUploadDigests(config IntegrityConfig) (uploadDigests, error) {
+	d := make(uploadDigests)
+	for _, algorithm := range append([]string{SHA256}, config.Digests...) {
+		h, err := NewHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		d[algorithm] = h
+	}
+
+	return d, nil
+}
+
+func (d uploadDigests) write(data []byte) {
+	for _, h := range d {
+		h.Write(data)
+	}
+}
+
+func (d uploadDigests) sums() map[string]string {
+	if d == nil {
+		return nil
+	}
+
+	sums := make(map[string]string)
+	for algorithm, h := range d {
+		sums[algorithm] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	return sums
+}
+
+// Check an upload of file with digests against its sidecar when one is
+// required, returning the error to send the client
+func (s *Server) verifyUpload(file string, digests map[string]string) *Error {
+	if !s.integrity.RequireSidecar || strings.HasSuffix(file, sidecarSuffix) {
+		return nil
+	}
+
+	sidecar, err := s.FileServer().Read(file + sidecarSuffix)
+	if err != nil {
+		return &Error{AccessViolation, fmt.Sprintf("Upload of '%v' requires '%v%v' first", file, file, sidecarSuffix)}
+	}
+
+	expected := ""
+	if fields := strings.Fields(string(sidecar.Data)); len(fields) > 0 {
+		expected = fields[0]
+	}
+
+	if !strings.EqualFold(expected, digests[SHA256]) {
+		return &Error{UndefinedError, fmt.Sprintf("Checksum mismatch for '%v'", file)}
+	}
+
+	return nil
+}
+
+// Keep an upload of file which failed verification for inspection, if
+// enabled, or else abort it
+func (s *Server) quarantine(upload Upload, file string, digests map[string]string) {
+	if s.integrity.Quarantine == "" {
+		upload.Abort()
+		return
+	}
+
+	quarantined := s.integrity.Quarantine + file
+	if err := upload.Commit(quarantined, digests); err != nil {
+		logrus.Errorf("[Integrity]: Failed to quarantine '%v': %v", file, err)
+		return
+	}
+
+	logrus.Warnf("[Integrity]: Quarantined '%v' as '%v'", file, quarantined)
+}
@@ -0,0 +1,72 @@
+package tftp
+
+import (
+	"crypto/md5"
+	"fmt"
+	"testing"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+func TestUploadDigests(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.integrity = IntegrityConfig{Digests: []string{MD5}}
+
+	data := testData(1500)
+	if err := newTestClient(network, addr).put("foo", data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	info, err := server.FileServer().Stat("foo")
+	if err != nil {
+		t.Fatalf("Failed to stat: %v", err)
+	}
+
+	if info.Checksum != Checksum(data) || info.Digests[SHA256] != Checksum(data) || info.Digests[MD5] != fmt.Sprintf("%x", md5.Sum(data)) {
+		t.Errorf("Unexpected digests: %v", info.Digests)
+	}
+}
+
+func TestUploadSidecar(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.integrity = IntegrityConfig{RequireSidecar: true, Quarantine: "quarantine/"}
+
+	data := testData(1000)
+
+	err := newTestClient(network, addr).put("foo", data)
+	if e, ok := err.(*testClientError); !ok || e.code != AccessViolation {
+		t.Errorf("Expected an upload without a sidecar to be denied, received: %v", err)
+	}
+
+	// The sidecar itself needs none
+	sidecar := []byte(Checksum(data) + "  foo\n")
+	if err := newTestClient(network, addr).put("foo.sha256", sidecar); err != nil {
+		t.Fatalf("Failed to write the sidecar: %v", err)
+	}
+
+	if err := newTestClient(network, addr).put("foo", data); err != nil {
+		t.Errorf("Failed to write a matching upload: %v", err)
+	}
+
+	server.FileServer().Write(&File{Name: "bar.sha256", Data: sidecar})
+	err = newTestClient(network, addr).put("bar", testData(999))
+	if e, ok := err.(*testClientError); !ok || e.code != UndefinedError {
+		t.Errorf("Expected a mismatched upload to be rejected, received: %v", err)
+	}
+
+	if server.FileServer().FileExists("bar") || !server.FileServer().FileExists("quarantine/bar") {
+		t.Errorf("Expected the mismatched upload to be quarantined")
+	}
+}
+
+func TestSetIntegrityNegative(t *testing.T) {
+	server := NewServer(NewMemFileServer())
+	if err := server.SetIntegrity(IntegrityConfig{Digests: []string{"sha1"}}); err == nil {
+		t.Errorf("Expected an unknown digest to be rejected")
+	}
+}
@@ -0,0 +1,418 @@
+// Package memnet is an in memory packet network for exercising TFTP
+// sessions deterministically.  Connections implement net.PacketConn and
+// are addressed by *net.UDPAddr.  The network can drop, duplicate,
+// reorder, delay and corrupt packets using a seeded random source, and
+// runs on a fake clock: whenever every open connection is blocked reading,
+// the clock jumps straight to the next packet delivery or read deadline,
+// so timeouts cost no real time.
+package memnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Conditions describe how the network mistreats packets.  Probabilities
+// are in [0, 1] and are applied to every packet independently.
+type Conditions struct {
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	Corrupt   float64
+
+	// Every packet takes Delay plus up to Jitter to arrive
+	Delay  time.Duration
+	Jitter time.Duration
+
+	// A reordered packet is held back up to this much longer, 10ms
+	// when not set
+	ReorderWindow time.Duration
+}
+
+// Stats counts what the network did to the packets sent through it
+type Stats struct {
+	Sent       int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+}
+
+type Network struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	rng        *rand.Rand
+	conditions Conditions
+	stats      Stats
+	now        time.Time
+	conns      map[string]*Conn
+	nextPort   int
+	blocked    int
+	activity   uint64
+	sequence   uint64
+	closed     bool
+	stop       chan struct{}
+}
+
+type packet struct {
+	data      []byte
+	from      *net.UDPAddr
+	deliverAt time.Time
+	sequence  uint64
+}
+
+// NewNetwork starts a network whose random decisions all derive from seed
+func NewNetwork(seed int64, conditions Conditions) *Network {
+	n := &Network{
+		rng:        rand.New(rand.NewSource(seed)),
+		conditions: conditions,
+		now:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		conns:      make(map[string]*Conn),
+		nextPort:   49152,
+		stop:       make(chan struct{}),
+	}
+	n.cond = sync.NewCond(&n.mutex)
+
+	go n.advanceWhenIdle()
+	return n
+}
+
+// Now returns the current time of the fake clock
+func (n *Network) Now() time.Time {
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	return n.now
+}
+
+// Advance moves the fake clock forward, delivering packets and expiring
+// read deadlines along the way
+func (n *Network) Advance(d time.Duration) {
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	n.now = n.now.Add(d)
+	n.activity++
+	n.cond.Broadcast()
+}
+
+func (n *Network) SetConditions(conditions Conditions) {
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	n.conditions = conditions
+}
+
+func (n *Network) Stats() Stats {
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	return n.stats
+}
+
+// Listen opens a connection on addr given as "host:port", so a Network
+// can serve as the transport of a tftp.Server
+func (n *Network) Listen(addr string) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.ListenUDP(udpAddr)
+}
+
+// SessionConn opens a connection on a free port
+func (n *Network) SessionConn(localAddr net.Addr, remoteAddr net.Addr) (net.PacketConn, error) {
+	return n.ListenUDP(nil)
+}
+
+// ListenUDP opens a connection on addr.  A zero port picks a free one, and
+// a nil addr picks a free port on 127.0.0.1.
+func (n *Network) ListenUDP(addr *net.UDPAddr) (*Conn, error) {
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	if n.closed {
+		return nil, errors.New("Network is closed")
+	}
+
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if addr != nil && addr.IP != nil {
+		local = &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	} else if addr != nil {
+		local.Port = addr.Port
+	}
+
+	if local.Port == 0 {
+		for n.conns[(&net.UDPAddr{IP: local.IP, Port: n.nextPort}).String()] != nil {
+			n.nextPort++
+		}
+		local.Port = n.nextPort
+		n.nextPort++
+	}
+
+	if _, ok := n.conns[local.String()]; ok {
+		return nil, errors.New(fmt.Sprintf("Address %v already in use", local))
+	}
+
+	conn := &Conn{network: n, local: local}
+	n.conns[local.String()] = conn
+	n.activity++
+	return conn, nil
+}
+
+// Close closes every connection and stops the clock
+func (n *Network) Close() {
+	n.mutex.Lock()
+	conns := []*Conn{}
+	for _, conn := range n.conns {
+		conns = append(conns, conn)
+	}
+
+	if !n.closed {
+		n.closed = true
+		close(n.stop)
+	}
+	n.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// The caller must hold the mutex
+func (n *Network) send(data []byte, from *net.UDPAddr, to net.Addr) {
+	n.stats.Sent++
+	n.activity++
+
+	dest, ok := n.conns[to.String()]
+	if !ok || n.rng.Float64() < n.conditions.Loss {
+		n.stats.Dropped++
+		return
+	}
+
+	copies := 1
+	if n.rng.Float64() < n.conditions.Duplicate {
+		n.stats.Duplicated++
+		copies++
+	}
+
+	for i := 0; i < copies; i++ {
+		buf := make([]byte, len(data))
+		copy(buf, data)
+
+		if len(buf) > 0 && n.rng.Float64() < n.conditions.Corrupt {
+			n.stats.Corrupted++
+			buf[n.rng.Intn(len(buf))] ^= byte(1 << uint(n.rng.Intn(8)))
+		}
+
+		delay := n.conditions.Delay
+		if n.conditions.Jitter > 0 {
+			delay += time.Duration(n.rng.Int63n(int64(n.conditions.Jitter)))
+		}
+
+		if n.rng.Float64() < n.conditions.Reorder {
+			n.stats.Reordered++
+			window := n.conditions.ReorderWindow
+			if window <= 0 {
+				window = 10 * time.Millisecond
+			}
+			delay += time.Duration(n.rng.Int63n(int64(window))) + 1
+		}
+
+		n.sequence++
+		dest.enqueue(&packet{
+			data:      buf,
+			from:      from,
+			deliverAt: n.now.Add(delay),
+			sequence:  n.sequence,
+		})
+	}
+
+	n.cond.Broadcast()
+}
+
+// Jump the clock whenever every open connection has been blocked reading
+// for a while with nothing happening.  Waiting for quiescence in real time
+// gives goroutines that are about to send a packet the chance to do so.
+func (n *Network) advanceWhenIdle() {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	var idleSince uint64
+	idleTicks := 0
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.Lock()
+		if n.blocked == 0 || n.blocked < len(n.conns) || n.activity != idleSince {
+			idleSince = n.activity
+			idleTicks = 0
+			n.mutex.Unlock()
+			continue
+		}
+
+		idleTicks++
+		if idleTicks >= 2 {
+			if next, ok := n.nextEvent(); ok && next.After(n.now) {
+				n.now = next
+				n.activity++
+				n.cond.Broadcast()
+			}
+			idleTicks = 0
+			idleSince = n.activity
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// The earliest pending delivery or read deadline.  The caller must hold
+// the mutex.
+func (n *Network) nextEvent() (time.Time, bool) {
+	var next time.Time
+	found := false
+
+	consider := func(t time.Time) {
+		if !found || t.Before(next) {
+			next, found = t, true
+		}
+	}
+
+	for _, conn := range n.conns {
+		if len(conn.queue) > 0 {
+			consider(conn.queue[0].deliverAt)
+		}
+
+		if conn.reading && !conn.deadline.IsZero() {
+			consider(conn.deadline)
+		}
+	}
+
+	return next, found
+}
+
+type Conn struct {
+	network  *Network
+	local    *net.UDPAddr
+	queue    []*packet
+	deadline time.Time
+	reading  bool
+	closed   bool
+}
+
+// Keep the queue ordered by delivery time, then by send order
+func (c *Conn) enqueue(p *packet) {
+	c.queue = append(c.queue, p)
+	sort.SliceStable(c.queue, func(i, j int) bool {
+		if c.queue[i].deliverAt.Equal(c.queue[j].deliverAt) {
+			return c.queue[i].sequence < c.queue[j].sequence
+		}
+		return c.queue[i].deliverAt.Before(c.queue[j].deliverAt)
+	})
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n := c.network
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	for {
+		if c.closed {
+			return 0, nil, errors.New("Use of closed memnet connection")
+		}
+
+		if len(c.queue) > 0 && !c.queue[0].deliverAt.After(n.now) {
+			p := c.queue[0]
+			c.queue = c.queue[1:]
+			n.activity++
+			return copy(b, p.data), p.from, nil
+		}
+
+		if !c.deadline.IsZero() && !n.now.Before(c.deadline) {
+			return 0, nil, &timeoutError{}
+		}
+
+		c.reading = true
+		n.blocked++
+		n.cond.Wait()
+		n.blocked--
+		c.reading = false
+	}
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n := c.network
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	if c.closed {
+		return 0, errors.New("Use of closed memnet connection")
+	}
+
+	n.send(b, c.local, addr)
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	n := c.network
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	if c.closed {
+		return errors.New("Connection already closed")
+	}
+
+	c.closed = true
+	delete(n.conns, c.local.String())
+	n.activity++
+	n.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Deadlines are given in real time, as callers compute them from
+// time.Now().  They are converted to the same distance into the future
+// on the fake clock.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	n := c.network
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+
+	if t.IsZero() {
+		c.deadline = time.Time{}
+	} else {
+		c.deadline = n.now.Add(time.Until(t))
+	}
+
+	n.activity++
+	n.cond.Broadcast()
+	return nil
+}
+
+// Writes never block
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "memnet read timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
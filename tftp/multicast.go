@@ -0,0 +1,616 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Port of the multicast groups when not configured, registered as tftp-mcast
+const multicastPort = 1758
+
+// MulticastConfig enables RFC 2090 multicast reads.  A client requesting
+// the multicast option for a file already being sent joins its group.
+type MulticastConfig struct {
+	// Groups are allocated from this range, one per file being sent,
+	// e.g. 239.255.69.0/24
+	Groups *net.IPNet
+
+	// UDP port of the groups, 1758 when not set
+	Port int
+
+	// Interface to send to the groups on, chosen by the system when nil
+	Interface *net.Interface
+
+	// Multicast TTL, 1 when not set, keeping the groups on the local network
+	TTL int
+}
+
+type multicastGroups struct {
+	config    MulticastConfig
+	server    *Server
+	mutex     sync.Mutex
+	transfers map[string]*multicastTransfer
+	inUse     map[string]bool
+}
+
+// A file being sent to a multicast group.  Only the master client, the
+// first in clients, ACKs.  When it has the whole file the next client
+// becomes master and ACKs the blocks it has, so the blocks it missed by
+// joining late are sent again.
+type multicastTransfer struct {
+	groups  *multicastGroups
+	rw      *TftpReaderWriter
+	file    *File
+	group   *net.UDPAddr
+	tracked *trackedSession
+	sendBuf *[]byte
+
+	// Clients in the order they joined and the audit records of those
+	// that haven't finished, guarded by the groups mutex
+	clients []net.Addr
+	records map[string]*AuditRecord
+
+	// Clients whose OACK the run loop is to send
+	oacks chan net.Addr
+
+	// Closed when the run loop ends, so that the reader stops
+	done chan struct{}
+
+	// Fires when the last packet expecting a reply is due for
+	// retransmission.  Only the run loop uses it.
+	timer *time.Timer
+
+	lastBlock    int
+	currBlock    uint16
+	promoted     bool
+	timeoutCount int
+}
+
+// A packet read for the run loop, in a pooled buffer
+type receivedPacket struct {
+	buf  *[]byte
+	n    int
+	addr net.Addr
+}
+
+func newMulticastGroups(config MulticastConfig, server *Server) (*multicastGroups, error) {
+	if config.Groups == nil || !config.Groups.IP.IsMulticast() {
+		return nil, errors.New(fmt.Sprintf("Invalid multicast groups '%v'", config.Groups))
+	}
+
+	if config.Port <= 0 {
+		config.Port = multicastPort
+	}
+
+	if config.TTL <= 0 {
+		config.TTL = 1
+	}
+
+	return &multicastGroups{
+		config:    config,
+		server:    server,
+		transfers: make(map[string]*multicastTransfer),
+		inUse:     make(map[string]bool),
+	}, nil
+}
+
+// Add client to the multicast transfer of fileName, starting one if there
+// is none.  Clients learn the group from the OACK sent to them.  The file
+// is read and the socket set up without holding the mutex, so a slow file
+// server doesn't hold up the transfers of other files.
+func (g *multicastGroups) join(client net.Addr, fileName string, mode string, localAddr net.Addr) error {
+	g.mutex.Lock()
+	if t, ok := g.transfers[fileName]; ok {
+		defer g.mutex.Unlock()
+		return t.join(client, mode)
+	}
+	g.mutex.Unlock()
+
+	file, err := g.server.FileServer().Read(fileName)
+	if err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	group, err := g.allocate(client)
+	if err == nil {
+		g.inUse[group.IP.String()] = true
+	}
+	g.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	rw, err := g.open(localAddr, client, group, fileName)
+	if err != nil {
+		g.mutex.Lock()
+		delete(g.inUse, group.IP.String())
+		g.mutex.Unlock()
+		return err
+	}
+
+	defer g.mutex.Unlock()
+	g.mutex.Lock()
+
+	// Another client may have started a transfer of the file meanwhile
+	if t, ok := g.transfers[fileName]; ok {
+		delete(g.inUse, group.IP.String())
+		rw.Close()
+		rw.release()
+		return t.join(client, mode)
+	}
+
+	t := &multicastTransfer{
+		groups:    g,
+		rw:        rw,
+		file:      file,
+		group:     group,
+		sendBuf:   getPacketBuffer(),
+		oacks:     make(chan net.Addr, 16),
+		done:      make(chan struct{}),
+		clients:   []net.Addr{client},
+		records:   make(map[string]*AuditRecord),
+		lastBlock: len(file.Data)/dataBlockSize + 1,
+	}
+	t.records[client.String()] = t.newAuditRecord(client, mode)
+
+	t.tracked = g.server.sessions.add(SessionInfo{
+		Client:    group.String(),
+		File:      file.Name,
+		Direction: DirectionRead,
+		Size:      len(file.Data),
+	}, rw)
+
+	g.transfers[fileName] = t
+
+	logrus.Infof("%v: Start for file '%v' with master %v", t.tracked.logPrefix("Multicast"), fileName, client)
+	go t.run()
+	return nil
+}
+
+// Open the connection sending fileName to group
+func (g *multicastGroups) open(localAddr net.Addr, client net.Addr, group *net.UDPAddr, fileName string) (*TftpReaderWriter, error) {
+	conn, err := g.server.transport.SessionConn(localAddr, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := g.setMulticastOptions(conn, group); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	rw := NewTftpReaderWriterFromConn(conn, nil, false)
+	rw.tracer = g.server.tracer
+	rw.file = fileName
+	rw.deadline = g.server.timeout
+	return rw, nil
+}
+
+// Add client to the transfer.  A repeated request means the client
+// missed its OACK.  The caller must hold the groups mutex.
+func (t *multicastTransfer) join(client net.Addr, mode string) error {
+	for _, c := range t.clients {
+		if sameAddr(c, client) {
+			t.queueOack(client)
+			return nil
+		}
+	}
+
+	logrus.Infof("%v: %v joined for '%v'", t.tracked.logPrefix("Multicast"), client, t.file.Name)
+	t.clients = append(t.clients, client)
+	t.records[client.String()] = t.newAuditRecord(client, mode)
+	t.queueOack(client)
+	return nil
+}
+
+// Have the run loop send client its OACK.  When the queue is full the
+// OACK is dropped, and the client repeats its request.
+func (t *multicastTransfer) queueOack(client net.Addr) {
+	select {
+	case t.oacks <- client:
+	default:
+		logrus.Infof("%v: Dropped OACK to %v, queue is full", t.tracked.logPrefix("Multicast"), client)
+	}
+}
+
+// Find a free group of the same address family as the client.  The
+// caller must hold the mutex.
+func (g *multicastGroups) allocate(client net.Addr) (*net.UDPAddr, error) {
+	udpAddr, ok := client.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("Multicast requires a UDP transport")
+	}
+
+	if (udpAddr.IP.To4() == nil) != (g.config.Groups.IP.To4() == nil) {
+		return nil, errors.New(fmt.Sprintf("Multicast groups '%v' are of another address family than %v", g.config.Groups, client))
+	}
+
+	for ip := g.config.Groups.IP.Mask(g.config.Groups.Mask); g.config.Groups.Contains(ip); ip = nextIP(ip) {
+		if !g.inUse[ip.String()] {
+			return &net.UDPAddr{IP: ip, Port: g.config.Port}, nil
+		}
+
+		if len(g.inUse) > 65536 {
+			break
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("All multicast groups of '%v' are in use", g.config.Groups))
+}
+
+func (g *multicastGroups) setMulticastOptions(conn net.PacketConn, group *net.UDPAddr) error {
+	udpConn := underlyingUDPConn(conn)
+	if udpConn == nil {
+		return errors.New("Multicast requires a UDP transport")
+	}
+
+	if group.IP.To4() != nil {
+		p := ipv4.NewPacketConn(udpConn)
+		if g.config.Interface != nil {
+			if err := p.SetMulticastInterface(g.config.Interface); err != nil {
+				return err
+			}
+		}
+
+		return p.SetMulticastTTL(g.config.TTL)
+	}
+
+	p := ipv6.NewPacketConn(udpConn)
+	if g.config.Interface != nil {
+		if err := p.SetMulticastInterface(g.config.Interface); err != nil {
+			return err
+		}
+	}
+
+	return p.SetMulticastHopLimit(g.config.TTL)
+}
+
+func underlyingUDPConn(conn net.PacketConn) *net.UDPConn {
+	switch c := conn.(type) {
+	case *net.UDPConn:
+		return c
+	case *rangePortConn:
+		return underlyingUDPConn(c.PacketConn)
+	}
+
+	return nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+
+	return next
+}
+
+// The run loop does all the sending of the transfer.  Packets from the
+// clients are read by another goroutine and handed to it along with the
+// OACKs requested by join.
+func (t *multicastTransfer) run() {
+	packets := make(chan receivedPacket)
+	go t.read(packets)
+
+	t.timer = time.NewTimer(t.rw.deadline)
+	defer t.timer.Stop()
+	defer t.close()
+
+	if !t.promote(false) {
+		return
+	}
+
+	for {
+		select {
+		case client := <-t.oacks:
+			if master, ok := t.role(client); ok {
+				t.sendOack(client, master)
+			}
+		case p, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			more := t.handle((*p.buf)[:p.n], p.addr)
+			putPacketBuffer(p.buf)
+			if !more {
+				return
+			}
+		case <-t.tracked.stop:
+			t.cancel()
+			return
+		case <-t.timer.C:
+			if t.timeoutCount++; t.timeoutCount < t.groups.server.retries {
+				t.groups.server.sessions.retransmit(t.tracked)
+				t.retransmit()
+				continue
+			}
+
+			if master, ok := t.master(); ok {
+				t.finish(master, errors.New(fmt.Sprintf("Timed out sending '%v'", t.file.Name)))
+			}
+			if !t.promote(true) {
+				return
+			}
+		}
+	}
+}
+
+// Read packets for the run loop until the connection is closed.  This is
+// the only goroutine reading from rw, so it releases it.
+func (t *multicastTransfer) read(packets chan<- receivedPacket) {
+	defer t.rw.release()
+	defer close(packets)
+
+	for {
+		bytes, addr, err := t.rw.Read()
+		if err != nil {
+			return
+		}
+
+		buf := getPacketBuffer()
+		p := receivedPacket{buf: buf, n: copy(*buf, bytes), addr: addr}
+		select {
+		case packets <- p:
+		case <-t.done:
+			putPacketBuffer(buf)
+			return
+		}
+	}
+}
+
+// Tell every client that the transfer was cancelled
+func (t *multicastTransfer) cancel() {
+	t.groups.mutex.Lock()
+	clients := append([]net.Addr{}, t.clients...)
+	t.groups.mutex.Unlock()
+
+	logrus.Infof("%v: cancelled", t.tracked.logPrefix("Multicast"))
+	errorPacket := getErrorPacket(UndefinedError, cancelledMessage)
+	for _, client := range clients {
+		t.rw.WriteTo(errorPacket.bytes, client)
+	}
+}
+
+// Restart the retransmission timeout after sending a packet that expects
+// a reply
+func (t *multicastTransfer) resetTimer() {
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+
+	t.timer.Reset(t.rw.deadline)
+}
+
+// Handle a packet from addr, returning false once every client is done
+func (t *multicastTransfer) handle(bytes []byte, addr net.Addr) bool {
+	master, isClient := t.role(addr)
+	if !isClient {
+		errorPacket := getErrorPacket(UnknownTid, "Unknown transfer ID")
+		t.rw.WriteTo(errorPacket.bytes, addr)
+		return true
+	}
+
+	p, err := ParsePacket(bytes)
+	if err != nil {
+		errorPacket := getErrorPacket(IllegalOperation, err.Error())
+		t.rw.WriteTo(errorPacket.bytes, addr)
+		t.finish(addr, &Error{IllegalOperation, err.Error()})
+		return t.leave(addr, master)
+	}
+
+	switch p := p.(type) {
+	case *Ack:
+		// A master may ACK beyond the block just sent when it joined late
+		// and has later blocks.  Earlier blocks are duplicates, which mustn't
+		// double the DATA sent.
+		if !master || (!t.promoted && p.Block < t.currBlock) || int(p.Block) > t.lastBlock {
+			return true
+		}
+
+		t.promoted = false
+		t.timeoutCount = 0
+		t.groups.server.sessions.progress(t.tracked, p.Block, ackedBytes(t.file, p.Block))
+		t.acked(addr, ackedBytes(t.file, p.Block))
+
+		if int(p.Block) == t.lastBlock {
+			logrus.Infof("%v: %v completed file '%v'", t.tracked.logPrefix("Multicast"), addr, t.file.Name)
+			t.finish(addr, nil)
+			return t.promote(true)
+		}
+
+		t.currBlock = p.Block + 1
+		t.sendData()
+	case *Error:
+		logrus.Infof("%v: %v left with error %v", t.tracked.logPrefix("Multicast"), addr, p)
+		t.finish(addr, p)
+		return t.leave(addr, master)
+	default:
+		errorPacket := getErrorPacket(IllegalOperation, fmt.Sprintf("Unexpected %v", p))
+		t.rw.WriteTo(errorPacket.bytes, addr)
+		t.finish(addr, &Error{IllegalOperation, fmt.Sprintf("Unexpected %v", p)})
+		return t.leave(addr, master)
+	}
+
+	return true
+}
+
+// Whether addr is a client of the transfer and its master
+func (t *multicastTransfer) role(addr net.Addr) (master bool, isClient bool) {
+	defer t.groups.mutex.Unlock()
+	t.groups.mutex.Lock()
+
+	for i, c := range t.clients {
+		if sameAddr(c, addr) {
+			return i == 0, true
+		}
+	}
+
+	return false, false
+}
+
+func (t *multicastTransfer) leave(addr net.Addr, master bool) bool {
+	if master {
+		return t.promote(true)
+	}
+
+	defer t.groups.mutex.Unlock()
+	t.groups.mutex.Lock()
+
+	for i, c := range t.clients {
+		if sameAddr(c, addr) {
+			t.clients = append(t.clients[:i], t.clients[i+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+// Make the next client master, dropping the current one.  Returns false
+// and ends the transfer when no client is left, in the same step so that
+// no client joins a transfer that is ending.
+func (t *multicastTransfer) promote(dropMaster bool) bool {
+	t.groups.mutex.Lock()
+	if dropMaster && len(t.clients) > 0 {
+		t.clients = t.clients[1:]
+	}
+
+	if len(t.clients) == 0 {
+		delete(t.groups.transfers, t.file.Name)
+		t.groups.mutex.Unlock()
+		return false
+	}
+
+	master := t.clients[0]
+	t.groups.mutex.Unlock()
+
+	t.promoted = true
+	t.timeoutCount = 0
+	t.sendOack(master, true)
+	return true
+}
+
+// Start the record of client joining the transfer.  The caller must hold
+// the mutex.
+func (t *multicastTransfer) newAuditRecord(client net.Addr, mode string) *AuditRecord {
+	record := newAuditRecord(client, t.file.Name, DirectionRead, mode)
+	record.Options = map[string]string{
+		"multicast": strings.Join([]string{t.group.IP.String(), fmt.Sprint(t.group.Port)}, ","),
+	}
+	return record
+}
+
+// Note the bytes a master client has
+func (t *multicastTransfer) acked(client net.Addr, bytes int) {
+	defer t.groups.mutex.Unlock()
+	t.groups.mutex.Lock()
+
+	if record, ok := t.records[client.String()]; ok {
+		record.Bytes = bytes
+	}
+}
+
+// Audit a client that completed, or left with err
+func (t *multicastTransfer) finish(client net.Addr, err error) {
+	t.groups.mutex.Lock()
+	record, ok := t.records[client.String()]
+	delete(t.records, client.String())
+	t.groups.mutex.Unlock()
+
+	if ok {
+		t.groups.server.audit(record, record.Bytes, err)
+	}
+}
+
+func (t *multicastTransfer) retransmit() {
+	if t.promoted {
+		master, _ := t.master()
+		t.sendOack(master, true)
+	} else {
+		t.sendData()
+	}
+}
+
+func (t *multicastTransfer) master() (net.Addr, bool) {
+	defer t.groups.mutex.Unlock()
+	t.groups.mutex.Lock()
+
+	if len(t.clients) == 0 {
+		return nil, false
+	}
+
+	return t.clients[0], true
+}
+
+// The OACK tells a client the group and whether it is the master client.
+// Only the master replies, so only its OACK restarts the timeout.
+func (t *multicastTransfer) sendOack(client net.Addr, master bool) error {
+	mc := "0"
+	if master {
+		mc = "1"
+	}
+
+	oack := &OptionAck{Options: map[string]string{
+		"multicast": strings.Join([]string{t.group.IP.String(), fmt.Sprint(t.group.Port), mc}, ","),
+	}}
+
+	b, err := oack.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if master {
+		t.resetTimer()
+	}
+	_, err = t.rw.WriteTo(b, client)
+	return err
+}
+
+func (t *multicastTransfer) sendData() {
+	start := (int(t.currBlock) - 1) * dataBlockSize
+	end := start + dataBlockSize
+	if end > len(t.file.Data) {
+		end = len(t.file.Data)
+	}
+
+	*t.sendBuf = appendDataPacket((*t.sendBuf)[:0], t.currBlock, t.file.Data[start:end])
+	t.resetTimer()
+	t.rw.WriteTo(*t.sendBuf, t.group)
+}
+
+func (t *multicastTransfer) close() {
+	t.groups.mutex.Lock()
+	if t.groups.transfers[t.file.Name] == t {
+		delete(t.groups.transfers, t.file.Name)
+	}
+	delete(t.groups.inUse, t.group.IP.String())
+	records := t.records
+	t.records = nil
+	t.groups.mutex.Unlock()
+
+	for _, record := range records {
+		t.groups.server.audit(record, record.Bytes, errors.New(fmt.Sprintf("Multicast of '%v' ended", t.file.Name)))
+	}
+
+	logrus.Infof("%v: Done with file '%v'", t.tracked.logPrefix("Multicast"), t.file.Name)
+	t.groups.server.sessions.remove(t.tracked)
+	close(t.done)
+	t.rw.Close()
+	putPacketBuffer(t.sendBuf)
+}
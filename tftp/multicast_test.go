@@ -0,0 +1,516 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+)
+
+// An RFC 2090 client.  It collects blocks from the group and ACKs the
+// blocks it has while it is the master client.
+type multicastTestClient struct {
+	ifi     *net.Interface
+	server  net.Addr
+	timeout time.Duration
+
+	// Called for every new block, before it is ACKed
+	onBlock func(block uint16)
+
+	// Called with every OACK, after joining the group
+	onOack func(master bool)
+
+	// Leave with an error after this many blocks, when set
+	leaveAfter int
+
+	conn   net.PacketConn
+	tid    net.Addr
+	blocks map[uint16][]byte
+	master bool
+}
+
+type multicastPacket struct {
+	packet Packet
+	addr   net.Addr
+}
+
+func (c *multicastTestClient) get(file string) ([]byte, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	c.conn = conn
+	c.blocks = map[uint16][]byte{}
+	packets := make(chan multicastPacket, 1024)
+	done := make(chan struct{})
+	defer close(done)
+
+	go readPackets(conn, packets, done)
+
+	request, _ := (&ReadRequest{Filename: file, Mode: "octet", Options: map[string]string{"multicast": ""}}).MarshalBinary()
+	conn.WriteTo(request, c.server)
+
+	var group *net.UDPConn
+	timeouts := 0
+	for {
+		var p multicastPacket
+		select {
+		case p = <-packets:
+		case <-time.After(c.timeout):
+			if timeouts++; timeouts > 10 {
+				return nil, errors.New("Client gave up after too many timeouts")
+			}
+
+			if c.master {
+				c.ack()
+			}
+			continue
+		}
+
+		switch packet := p.packet.(type) {
+		case *OptionAck:
+			fields := strings.Split(packet.Options["multicast"], ",")
+			if len(fields) != 3 {
+				return nil, errors.New(fmt.Sprintf("Invalid multicast option in %v", packet))
+			}
+
+			if group == nil {
+				port, _ := strconv.Atoi(fields[1])
+				group, err = net.ListenMulticastUDP("udp4", c.ifi, &net.UDPAddr{IP: net.ParseIP(fields[0]), Port: port})
+				if err != nil {
+					return nil, err
+				}
+				defer group.Close()
+
+				go readPackets(group, packets, done)
+			}
+
+			c.tid = p.addr
+			c.master = fields[2] == "1"
+			if c.onOack != nil {
+				c.onOack(c.master)
+			}
+		case *Data:
+			if _, ok := c.blocks[packet.Block]; ok {
+				continue
+			}
+
+			c.blocks[packet.Block] = packet.Data
+			if c.onBlock != nil {
+				c.onBlock(packet.Block)
+			}
+
+			if c.leaveAfter > 0 && len(c.blocks) >= c.leaveAfter {
+				b, _ := (&Error{Code: UndefinedError, Msg: "Leaving"}).MarshalBinary()
+				conn.WriteTo(b, c.tid)
+				return nil, nil
+			}
+		case *Error:
+			return nil, &testClientError{code: packet.Code, msg: packet.Msg}
+		default:
+			continue
+		}
+
+		timeouts = 0
+		if c.master {
+			if data, complete := c.ack(); complete {
+				return data, nil
+			}
+		}
+	}
+}
+
+// ACK the blocks received without a gap, returning the file once complete
+func (c *multicastTestClient) ack() ([]byte, bool) {
+	data := []byte{}
+	block := uint16(0)
+	complete := false
+	for {
+		next, ok := c.blocks[block+1]
+		if !ok {
+			break
+		}
+
+		block++
+		data = append(data, next...)
+		if len(next) < dataBlockSize {
+			complete = true
+			break
+		}
+	}
+
+	b, _ := (&Ack{Block: block}).MarshalBinary()
+	c.conn.WriteTo(b, c.tid)
+	return data, complete
+}
+
+func readPackets(conn net.PacketConn, packets chan<- multicastPacket, done <-chan struct{}) {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if p, err := ParsePacket(buf[:n]); err == nil {
+			select {
+			case packets <- multicastPacket{p, addr}:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+func loopbackInterface(t *testing.T) *net.Interface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Can't list interfaces: %v", err)
+	}
+
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagLoopback != 0 && ifis[i].Flags&net.FlagUp != 0 {
+			return &ifis[i]
+		}
+	}
+
+	t.Skip("No loopback interface")
+	return nil
+}
+
+func startMulticastServer(t *testing.T) (*Server, net.Addr, *net.Interface) {
+	ifi := loopbackInterface(t)
+	server := NewServer(NewMemFileServer())
+	_, groups, _ := net.ParseCIDR("239.255.69.0/24")
+	if err := server.EnableMulticast(MulticastConfig{Groups: groups, Port: freePort(t), Interface: ifi}); err != nil {
+		t.Fatalf("Failed to enable multicast: %v", err)
+	}
+
+	conn, err := server.Transport().Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	go server.Serve(conn)
+	return server, conn.LocalAddr(), ifi
+}
+
+// A client joining late gets the blocks it missed once it is master,
+// while a client not asking for multicast is served by unicast
+func TestMulticastLateJoiner(t *testing.T) {
+	server, addr, ifi := startMulticastServer(t)
+
+	data := testData(20*dataBlockSize + 100)
+	server.FileServer().Write(&File{Name: "kernel", Data: data})
+
+	type result struct {
+		name string
+		data []byte
+		err  error
+	}
+	results := make(chan result, 3)
+	lateJoined := make(chan struct{})
+
+	late := &multicastTestClient{ifi: ifi, server: addr, timeout: time.Second}
+	late.onOack = func(master bool) {
+		if !master {
+			close(lateJoined)
+		}
+	}
+
+	first := &multicastTestClient{ifi: ifi, server: addr, timeout: time.Second}
+	first.onBlock = func(block uint16) {
+		if block == 5 {
+			go func() {
+				data, err := late.get("kernel")
+				results <- result{"late", data, err}
+			}()
+			<-lateJoined
+		}
+	}
+
+	go func() {
+		data, err := first.get("kernel")
+		results <- result{"first", data, err}
+	}()
+
+	go func() {
+		data, err := newUDPTestClient(addr).get("kernel")
+		results <- result{"unicast", data, err}
+	}()
+
+	for i := 0; i < 3; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Errorf("%v client failed: %v", r.name, r.err)
+		} else if !bytes.Equal(r.data, data) {
+			t.Errorf("%v client received %v bytes, expected %v", r.name, len(r.data), len(data))
+		}
+	}
+
+	if len(late.blocks) != 21 {
+		t.Errorf("Expected the late client to have all 21 blocks, received %v", len(late.blocks))
+	}
+
+	waitForMulticast(t, server)
+}
+
+// When the master leaves the next client takes over
+func TestMulticastMasterLeaves(t *testing.T) {
+	server, addr, ifi := startMulticastServer(t)
+
+	data := testData(10 * dataBlockSize)
+	server.FileServer().Write(&File{Name: "kernel", Data: data})
+
+	secondJoined := make(chan struct{})
+	secondDone := make(chan error, 1)
+	second := &multicastTestClient{ifi: ifi, server: addr, timeout: time.Second}
+	second.onOack = func(master bool) {
+		if !master {
+			close(secondJoined)
+		}
+	}
+
+	// The second client joins before the first ACKs anything
+	first := &multicastTestClient{ifi: ifi, server: addr, timeout: time.Second, leaveAfter: 3}
+	first.onOack = func(master bool) {
+		go func() {
+			received, err := second.get("kernel")
+			if err == nil && !bytes.Equal(received, data) {
+				err = errors.New(fmt.Sprintf("Received %v bytes, expected %v", len(received), len(data)))
+			}
+			secondDone <- err
+		}()
+		<-secondJoined
+	}
+
+	if _, err := first.get("kernel"); err != nil {
+		t.Fatalf("First client failed: %v", err)
+	}
+
+	if err := <-secondDone; err != nil {
+		t.Errorf("Second client failed: %v", err)
+	}
+
+	waitForMulticast(t, server)
+}
+
+// Repeated requests of a late joiner are answered without postponing the
+// retransmissions to a master that stopped ACKing
+func TestMulticastRepeatedRequestsDontDelayMaster(t *testing.T) {
+	server := NewServer(NewMemFileServer())
+	server.SetTimeouts(200*time.Millisecond, 100)
+	_, groups, _ := net.ParseCIDR("239.255.69.0/24")
+	if err := server.EnableMulticast(MulticastConfig{Groups: groups, Port: freePort(t), Interface: loopbackInterface(t)}); err != nil {
+		t.Fatalf("Failed to enable multicast: %v", err)
+	}
+	server.FileServer().Write(&File{Name: "kernel", Data: testData(10 * dataBlockSize)})
+
+	conn, err := server.Transport().Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(conn)
+	defer server.Shutdown(time.Second)
+
+	request, _ := (&ReadRequest{Filename: "kernel", Mode: "octet", Options: map[string]string{"multicast": ""}}).MarshalBinary()
+	readOack := func(c net.PacketConn, within time.Duration) string {
+		buf := make([]byte, 1024)
+		c.SetReadDeadline(time.Now().Add(within))
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("No OACK within %v: %v", within, err)
+		}
+
+		p, err := ParsePacket(buf[:n])
+		oack, ok := p.(*OptionAck)
+		if !ok {
+			t.Fatalf("Expected an OACK, received %v, %v", p, err)
+		}
+
+		return oack.Options["multicast"]
+	}
+
+	master, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer master.Close()
+	master.WriteTo(request, conn.LocalAddr())
+	if option := readOack(master, 5*time.Second); !strings.HasSuffix(option, ",1") {
+		t.Fatalf("Expected the first client to be master, received %q", option)
+	}
+
+	joiner, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+	defer joiner.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			joiner.WriteTo(request, conn.LocalAddr())
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	if option := readOack(joiner, time.Second); !strings.HasSuffix(option, ",0") {
+		t.Errorf("Expected the joining client not to be master, received %q", option)
+	}
+
+	// The master never ACKs, so its OACK is sent again after a timeout
+	if option := readOack(master, time.Second); !strings.HasSuffix(option, ",1") {
+		t.Errorf("Expected the OACK to be retransmitted to the master, received %q", option)
+	}
+}
+
+// Cancelling a multicast transfer tells every client
+func TestMulticastCancel(t *testing.T) {
+	server, addr, _ := startMulticastServer(t)
+	defer server.Shutdown(time.Second)
+	server.FileServer().Write(&File{Name: "kernel", Data: testData(10 * dataBlockSize)})
+
+	request, _ := (&ReadRequest{Filename: "kernel", Mode: "octet", Options: map[string]string{"multicast": ""}}).MarshalBinary()
+	clients := []net.PacketConn{}
+	for i := 0; i < 2; i++ {
+		c, _ := net.ListenPacket("udp4", "127.0.0.1:0")
+		defer c.Close()
+		clients = append(clients, c)
+
+		// Wait for the OACK so that the client has joined
+		c.WriteTo(request, addr)
+		if p := readPacket(t, c); p == nil {
+			t.Fatalf("Client %v received no OACK", i)
+		}
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("Expected one session, received %v", sessions)
+	}
+
+	if err := server.CancelSessionByID(sessions[0].ID); err != nil {
+		t.Fatalf("Failed to cancel: %v", err)
+	}
+
+	for i, c := range clients {
+		for {
+			p := readPacket(t, c)
+			if p == nil {
+				t.Fatalf("Client %v wasn't told of the cancellation", i)
+			}
+
+			if e, ok := p.(*Error); ok {
+				if e.Code != UndefinedError {
+					t.Errorf("Expected client %v to be told of the cancellation, received %v", i, e)
+				}
+				break
+			}
+		}
+	}
+
+	waitForSessions(t, server)
+}
+
+// The next packet received by c, nil when none arrives within a second
+func readPacket(t *testing.T, c net.PacketConn) Packet {
+	buf := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+
+	p, err := ParsePacket(buf[:n])
+	if err != nil {
+		t.Fatalf("Received a malformed packet %q: %v", buf[:n], err)
+	}
+
+	return p
+}
+
+// A file server whose reads block until released
+type blockingFileServer struct {
+	FileServer
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingFileServer) Read(file string) (*File, error) {
+	close(s.reading)
+	<-s.release
+	return nil, errors.New("Released")
+}
+
+// Joining reads the file without holding up the other transfers
+func TestMulticastJoinReadsUnlocked(t *testing.T) {
+	fileServ := &blockingFileServer{NewMemFileServer(), make(chan struct{}), make(chan struct{})}
+	server := NewServer(fileServ)
+	_, groups, _ := net.ParseCIDR("239.255.69.0/24")
+	if err := server.EnableMulticast(MulticastConfig{Groups: groups}); err != nil {
+		t.Fatalf("Failed to enable multicast: %v", err)
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1000}
+	joined := make(chan error, 1)
+	go func() {
+		joined <- server.multicast.join(client, "slow", "octet", nil)
+	}()
+	<-fileServ.reading
+
+	locked := make(chan struct{})
+	go func() {
+		server.multicast.mutex.Lock()
+		server.multicast.mutex.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The groups were locked while reading the file")
+	}
+
+	close(fileServ.release)
+	if err := <-joined; err == nil {
+		t.Errorf("Expected the failed read to fail joining")
+	}
+}
+
+func TestMulticastRejectedInSinglePortMode(t *testing.T) {
+	_, groups, _ := net.ParseCIDR("239.255.69.0/24")
+	server := NewServerWithTransport(NewMemFileServer(), NewMuxTransport(&UDPTransport{}))
+	if err := server.EnableMulticast(MulticastConfig{Groups: groups}); err == nil {
+		t.Errorf("Expected multicast to be rejected in single port mode")
+	}
+
+	_, unicast, _ := net.ParseCIDR("10.0.0.0/8")
+	if err := NewServer(NewMemFileServer()).EnableMulticast(MulticastConfig{Groups: unicast}); err == nil {
+		t.Errorf("Expected unicast groups to be rejected")
+	}
+}
+
+func waitForMulticast(t *testing.T, server *Server) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		server.multicast.mutex.Lock()
+		n := len(server.multicast.inUse)
+		server.multicast.mutex.Unlock()
+
+		if n == 0 && len(server.Sessions()) == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Multicast transfers never ended: %v", server.Sessions())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
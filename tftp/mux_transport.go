@@ -0,0 +1,304 @@
+package tftp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Returned by SessionConn for a client which already has a session on the
+// shared socket, usually because it repeated its request
+var errSessionActive = errors.New("Client already has an active session")
+
+// MuxTransport runs every session over the listening socket instead of
+// a new port per session, which keeps TFTP to a single port through
+// firewalls and NAT.  Packets arriving on the listening socket from a
+// client with an active session are routed to that session, everything
+// else, including repeated requests, goes to the request session.
+type MuxTransport struct {
+	base      Transport
+	mutex     sync.Mutex
+	listeners []*muxListener
+}
+
+func NewMuxTransport(base Transport) *MuxTransport {
+	return &MuxTransport{base: base}
+}
+
+func (t *MuxTransport) Listen(addr string) (net.PacketConn, error) {
+	conn, err := t.base.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.share(conn), nil
+}
+
+// Adopt shares a socket opened elsewhere like a listening socket
+func (t *MuxTransport) Adopt(conn net.PacketConn) (net.PacketConn, error) {
+	if adopter, ok := t.base.(connAdopter); ok {
+		var err error
+		if conn, err = adopter.Adopt(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.share(conn), nil
+}
+
+func (t *MuxTransport) share(conn net.PacketConn) *muxListener {
+	listener := &muxListener{
+		PacketConn: conn,
+		sessions:   make(map[string]*muxConn),
+	}
+
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+	t.listeners = append(t.listeners, listener)
+	return listener
+}
+
+func (t *MuxTransport) SessionConn(localAddr net.Addr, remoteAddr net.Addr) (net.PacketConn, error) {
+	listener := t.listenerFor(localAddr)
+	if listener == nil {
+		return nil, errors.New("MuxTransport has no listening socket to share")
+	}
+
+	return listener.register(localAddr, remoteAddr)
+}
+
+// PortUsage reports the port usage of the base transport, 0 of 0 when it
+// has no port range
+func (t *MuxTransport) PortUsage() (inUse int, total int) {
+	if user, ok := t.base.(interface{ PortUsage() (int, int) }); ok {
+		return user.PortUsage()
+	}
+
+	return 0, 0
+}
+
+// Find the listener a request to localAddr arrived on
+func (t *MuxTransport) listenerFor(localAddr net.Addr) *muxListener {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	if len(t.listeners) == 0 {
+		return nil
+	}
+
+	local, ok := localAddr.(*net.UDPAddr)
+	for _, listener := range t.listeners {
+		addr, isUDP := listener.LocalAddr().(*net.UDPAddr)
+		if !ok || !isUDP {
+			if localAddr != nil && listener.LocalAddr().String() == localAddr.String() {
+				return listener
+			}
+			continue
+		}
+
+		if addr.Port == local.Port && (addr.IP.IsUnspecified() || addr.IP.Equal(local.IP)) {
+			return listener
+		}
+	}
+
+	return t.listeners[0]
+}
+
+type muxListener struct {
+	net.PacketConn
+	mutex    sync.Mutex
+	sessions map[string]*muxConn
+}
+
+func (l *muxListener) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, _, err := l.ReadFromLocal(b)
+	return n, addr, err
+}
+
+func (l *muxListener) ReadFromLocal(b []byte) (int, net.Addr, net.Addr, error) {
+	for {
+		n, addr, localAddr, err := l.readFromLocal(b)
+		if err != nil {
+			return n, addr, localAddr, err
+		}
+
+		if isRequest(b[:n]) {
+			return n, addr, localAddr, nil
+		}
+
+		l.mutex.Lock()
+		session, ok := l.sessions[addr.String()]
+		l.mutex.Unlock()
+
+		if !ok {
+			return n, addr, localAddr, nil
+		}
+
+		session.deliver(b[:n])
+	}
+}
+
+func (l *muxListener) readFromLocal(b []byte) (int, net.Addr, net.Addr, error) {
+	if reader, ok := l.PacketConn.(localAddrReader); ok {
+		return reader.ReadFromLocal(b)
+	}
+
+	n, addr, err := l.PacketConn.ReadFrom(b)
+	return n, addr, l.LocalAddr(), err
+}
+
+// Send from the address the session's request arrived on
+func (l *muxListener) writeToFrom(b []byte, localAddr net.Addr, remoteAddr net.Addr) (int, error) {
+	if writer, ok := l.PacketConn.(localAddrWriter); ok && localAddr != nil {
+		return writer.WriteToFrom(b, localAddr, remoteAddr)
+	}
+
+	return l.PacketConn.WriteTo(b, remoteAddr)
+}
+
+func (l *muxListener) Close() error {
+	l.mutex.Lock()
+	sessions := []*muxConn{}
+	for _, session := range l.sessions {
+		sessions = append(sessions, session)
+	}
+	l.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+
+	return l.PacketConn.Close()
+}
+
+func (l *muxListener) register(localAddr net.Addr, remoteAddr net.Addr) (*muxConn, error) {
+	defer l.mutex.Unlock()
+	l.mutex.Lock()
+
+	key := remoteAddr.String()
+	if _, ok := l.sessions[key]; ok {
+		return nil, errSessionActive
+	}
+
+	conn := &muxConn{
+		listener:   l,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		packets:    make(chan []byte, 16),
+		closed:     make(chan struct{}),
+	}
+	l.sessions[key] = conn
+	return conn, nil
+}
+
+func (l *muxListener) unregister(conn *muxConn) {
+	defer l.mutex.Unlock()
+	l.mutex.Lock()
+
+	if l.sessions[conn.remoteAddr.String()] == conn {
+		delete(l.sessions, conn.remoteAddr.String())
+	}
+}
+
+// The connection of one session on a shared listening socket
+type muxConn struct {
+	listener   *muxListener
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	packets    chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+	mutex      sync.Mutex
+	deadline   time.Time
+}
+
+// Like a socket buffer, packets are dropped when the session falls behind
+func (c *muxConn) deliver(b []byte) {
+	packet := make([]byte, len(b))
+	copy(packet, b)
+
+	select {
+	case c.packets <- packet:
+	default:
+		logrus.Infof("Dropped packet from %v, session queue is full", c.remoteAddr)
+	}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-c.packets:
+		return copy(b, packet), c.remoteAddr, nil
+	case <-c.closed:
+		return 0, nil, errors.New("Use of closed session connection")
+	case <-timeout:
+		return 0, nil, &muxTimeoutError{}
+	}
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("Use of closed session connection")
+	default:
+		return c.listener.writeToFrom(b, c.localAddr, addr)
+	}
+}
+
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.listener.unregister(c)
+	})
+
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+
+	return c.listener.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+
+	c.deadline = t
+	return nil
+}
+
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type muxTimeoutError struct{}
+
+func (e *muxTimeoutError) Error() string   { return "Session read timeout" }
+func (e *muxTimeoutError) Timeout() bool   { return true }
+func (e *muxTimeoutError) Temporary() bool { return true }
+
+// Requests always start a new session rather than going to an existing one
+func isRequest(b []byte) bool {
+	opcode, err := getOpcode(b)
+	return err == nil && (opcode == RRQ || opcode == WRQ)
+}
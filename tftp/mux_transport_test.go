@@ -0,0 +1,167 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+func newUDPTestClient(server net.Addr) *testClient {
+	return &testClient{
+		listen: func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", "127.0.0.1:0")
+		},
+		server:  server,
+		timeout: time.Second,
+		retries: 3,
+	}
+}
+
+func TestMuxSessionsShareListeningPort(t *testing.T) {
+	transport := NewMuxTransport(&UDPTransport{})
+	server := NewServerWithTransport(NewMemFileServer(), transport)
+	server.FileServer().Write(&File{Name: "kernel", Data: testData(5000)})
+
+	conn, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go server.Serve(conn)
+
+	done := make(chan error)
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("dump%v", i)
+		go func() {
+			client := newUDPTestClient(conn.LocalAddr())
+			client.onTid = func(tid net.Addr) {
+				if tid.String() != conn.LocalAddr().String() {
+					t.Errorf("Expected replies from %v, received them from %v", conn.LocalAddr(), tid)
+				}
+			}
+
+			data, err := client.get("kernel")
+			if err == nil && !bytes.Equal(data, testData(5000)) {
+				err = fmt.Errorf("Read returned %v bytes, expected 5000", len(data))
+			}
+
+			if err == nil {
+				err = client.put(name, testData(3000))
+			}
+
+			done <- err
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Transfer failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("dump%v", i)
+		if file, err := server.FileServer().Read(name); err != nil || !bytes.Equal(file.Data, testData(3000)) {
+			t.Errorf("Write of %v failed: %v", name, err)
+		}
+	}
+}
+
+// Every packet, requests included, arrives twice.  The repeated request
+// of a client with a running session must not disturb that session.
+func TestMuxDuplicateRequests(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{Duplicate: 1})
+	defer network.Close()
+
+	transport := NewMuxTransport(network)
+	server := NewServerWithTransport(NewMemFileServer(), transport)
+	auditor := make(recordingAuditor, 10)
+	server.SetAuditor(auditor)
+
+	conn, err := transport.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(conn)
+
+	client := newTestClient(network, conn.LocalAddr())
+	if err := client.put("dump", testData(1536)); err != nil {
+		t.Errorf("Write with a repeated request failed: %v", err)
+	}
+
+	if data, err := client.get("dump"); err != nil || !bytes.Equal(data, testData(1536)) {
+		t.Errorf("Read with a repeated request failed: %v", err)
+	}
+
+	waitForSessions(t, server)
+	for i := 0; i < 2; i++ {
+		if record := auditor.next(t); record.Outcome != OutcomeCompleted {
+			t.Errorf("Expected only completed transfers to be audited, received %+v", record)
+		}
+	}
+
+	select {
+	case record := <-auditor:
+		t.Errorf("Expected only the transfers to be audited, received %+v", record)
+	default:
+	}
+}
+
+func TestMuxRoutesRequestsToListener(t *testing.T) {
+	transport := NewMuxTransport(&UDPTransport{})
+	conn, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	client, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer client.Close()
+
+	session, err := transport.SessionConn(conn.LocalAddr(), client.LocalAddr())
+	if err != nil {
+		t.Fatalf("Failed to open session connection: %v", err)
+	}
+	defer session.Close()
+
+	if _, err = transport.SessionConn(conn.LocalAddr(), client.LocalAddr()); err == nil {
+		t.Errorf("Second session for the same client should have failed")
+	}
+
+	// Packets are only routed while the listener is being read, as the
+	// request session always does
+	requests := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			requests <- append([]byte{}, buf[:n]...)
+		}
+	}()
+
+	client.WriteTo(requestBytes(RRQ, "foo"), conn.LocalAddr())
+	client.WriteTo(blockBytes(ACK, 1, nil), conn.LocalAddr())
+
+	select {
+	case request := <-requests:
+		if !isRequest(request) {
+			t.Errorf("Expected the listener to receive the request, received %v", request)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the listener to receive the request")
+	}
+
+	buf := make([]byte, 1024)
+	session.SetDeadline(time.Now().Add(time.Second))
+	if n, _, err := session.ReadFrom(buf); err != nil || !bytes.Equal(buf[:n], blockBytes(ACK, 1, nil)) {
+		t.Errorf("Expected the session to receive the ACK, received %v: %v", buf[:n], err)
+	}
+}
@@ -1,5 +1,31 @@
 package tftp
 
+import "encoding/binary"
+
+// The append functions encode a packet onto the end of buf, so sessions
+// can encode every packet into one reusable send buffer
+
+func appendDataPacket(buf []byte, block uint16, data []byte) []byte {
+	buf = appendTwoByteInt(appendTwoByteInt(buf, DATA), block)
+	return append(buf, data...)
+}
+
+func appendAckPacket(buf []byte, block uint16) []byte {
+	return appendTwoByteInt(appendTwoByteInt(buf, ACK), block)
+}
+
+func appendErrorPacket(buf []byte, code uint16, msg string) []byte {
+	buf = appendTwoByteInt(appendTwoByteInt(buf, ERROR), code)
+	buf = append(buf, msg...)
+	return append(buf, 0)
+}
+
+func appendTwoByteInt(buf []byte, value uint16) []byte {
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], value)
+	return buf
+}
+
 type DataPacket struct {
 	block uint16
 	data  []byte
@@ -7,14 +33,12 @@ type DataPacket struct {
 }
 
 func NewDataPacket(block [2]byte, data []byte) *DataPacket {
-	block64, _ := convertBytesToInt([]byte{block[0], block[1]})
-	block16 := uint16(block64)
-	bytes := append([]byte{0x0, 0x3, block[0], block[1]}, data...)
+	block16 := binary.BigEndian.Uint16(block[:])
 
 	return &DataPacket{
 		block: block16,
 		data:  data,
-		bytes: bytes,
+		bytes: appendDataPacket(make([]byte, 0, 4+len(data)), block16, data),
 	}
 }
 
@@ -24,13 +48,11 @@ type AckPacket struct {
 }
 
 func NewAckPacket(block [2]byte) *AckPacket {
-	block64, _ := convertBytesToInt([]byte{block[0], block[1]})
-	block16 := uint16(block64)
-	bytes := []byte{0x0, 0x4, block[0], block[1]}
+	block16 := binary.BigEndian.Uint16(block[:])
 
 	return &AckPacket{
 		block: block16,
-		bytes: bytes,
+		bytes: appendAckPacket(make([]byte, 0, 4), block16),
 	}
 }
 
@@ -41,15 +63,11 @@ type ErrorPacket struct {
 }
 
 func NewErrorPacket(code [2]byte, msg string) *ErrorPacket {
-	code64, _ := convertBytesToInt([]byte{code[0], code[1]})
-	code16 := uint16(code64)
-	bytes := []byte{0x0, 0x5, code[0], code[1]}
-	bytes = append(bytes, []byte(msg)...)
-	bytes = append(bytes, 0)
+	code16 := binary.BigEndian.Uint16(code[:])
 
 	return &ErrorPacket{
 		code:  code16,
 		msg:   msg,
-		bytes: bytes,
+		bytes: appendErrorPacket(make([]byte, 0, 5+len(msg)), code16, msg),
 	}
 }
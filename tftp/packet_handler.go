@@ -6,52 +6,81 @@ import (
 )
 
 type PacketHandler interface {
-	ReadReq(addr *net.UDPAddr, file string, mode string) error
-	WriteReq(addr *net.UDPAddr, file string, mode string) error
+	// Options holds the RFC 2347 options of the request, if any, by
+	// lower case name
+	ReadReq(addr net.Addr, file string, mode string, options map[string]string) error
+	WriteReq(addr net.Addr, file string, mode string, options map[string]string) error
 	Data(block uint16, data []byte) error
 	Ack(block uint16) error
 	Err(code uint16, msg string) error
 }
 
+// A packet that can't be parsed, as opposed to an error returned by
+// a handler
+type malformedPacketError struct {
+	err error
+}
+
+func (e *malformedPacketError) Error() string {
+	return e.err.Error()
+}
+
+func isMalformed(err error) bool {
+	_, ok := err.(*malformedPacketError)
+	return ok
+}
+
 // This function determines the type of a packet and routes it to the
-// appropriate handling method
-func HandleTftpPackets(handler PacketHandler, addr *net.UDPAddr, input []byte) error {
+// appropriate handling method.  Packets are decoded by the exported packet
+// types, as ParsePacket decodes them, and those that can't be give a
+// malformedPacketError.  The sessions further only accept octet mode, the
+// RFC 1350 error codes and none of the packets only servers send.
+func HandleTftpPackets(handler PacketHandler, addr net.Addr, input []byte) error {
 	code, err := getOpcode(input)
 	if err != nil {
-		return err
+		return &malformedPacketError{err}
 	}
 
 	switch code {
 	case RRQ:
-		if file, mode, err := parseRequest(input[2:]); err == nil {
-			return handler.ReadReq(addr, file, mode)
-		} else {
-			return err
+		var p ReadRequest
+		if err := p.UnmarshalBinary(input); err != nil {
+			return &malformedPacketError{err}
+		} else if err := validateMode(p.Mode); err != nil {
+			return &malformedPacketError{err}
 		}
+		return handler.ReadReq(addr, p.Filename, p.Mode, p.Options)
 	case WRQ:
-		if file, mode, err := parseRequest(input[2:]); err == nil {
-			return handler.WriteReq(addr, file, mode)
-		} else {
-			return err
+		var p WriteRequest
+		if err := p.UnmarshalBinary(input); err != nil {
+			return &malformedPacketError{err}
+		} else if err := validateMode(p.Mode); err != nil {
+			return &malformedPacketError{err}
 		}
+		return handler.WriteReq(addr, p.Filename, p.Mode, p.Options)
 	case DATA:
-		if block, data, err := parseData(input[2:]); err == nil {
-			return handler.Data(block, data)
-		} else {
-			return err
+		// The payload is copied into a pooled buffer rather than a new one
+		buf := getPacketBuffer()
+		defer putPacketBuffer(buf)
+		p := Data{Data: (*buf)[:0]}
+		if err := p.UnmarshalBinary(input); err != nil {
+			return &malformedPacketError{err}
 		}
+		return handler.Data(p.Block, p.Data)
 	case ACK:
-		if block, err := parseAck(input[2:]); err == nil {
-			return handler.Ack(block)
-		} else {
-			return err
+		var p Ack
+		if err := p.UnmarshalBinary(input); err != nil {
+			return &malformedPacketError{err}
 		}
+		return handler.Ack(p.Block)
 	case ERROR:
-		if code, msg, err := parseError(input[2:]); err == nil {
-			return handler.Err(code, msg)
-		} else {
-			return err
+		var p Error
+		if err := p.UnmarshalBinary(input); err != nil {
+			return &malformedPacketError{err}
+		} else if err := validateErrorCode(p.Code); err != nil {
+			return &malformedPacketError{err}
 		}
+		return handler.Err(p.Code, p.Msg)
 	default:
 		return errors.New("We should never reach the end of HandleTftpPackets")
 	}
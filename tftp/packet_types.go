@@ -0,0 +1,402 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Option acknowledgement opcode from RFC 2347.  It is only ever sent by
+// servers, so the packet handlers treat it as an invalid opcode.
+const OACK = 6
+
+// Packet is any TFTP packet.  MarshalBinary encodes the whole packet
+// including its opcode and UnmarshalBinary decodes one, failing when the
+// opcode belongs to another packet type.
+type Packet interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	Opcode() uint16
+}
+
+// ReadRequest asks to read Filename.  Options holds the RFC 2347 options
+// following the mode, by lower case name as option names are case
+// insensitive, and is nil when there are none.  Option values may be
+// empty, like that of the RFC 2090 multicast option.
+type ReadRequest struct {
+	Filename string
+	Mode     string
+	Options  map[string]string
+}
+
+// WriteRequest asks to write Filename
+type WriteRequest struct {
+	Filename string
+	Mode     string
+	Options  map[string]string
+}
+
+// Data carries up to 512 bytes of a transfer.  UnmarshalBinary copies the
+// payload, reusing the capacity of Data.
+type Data struct {
+	Block uint16
+	Data  []byte
+}
+
+type Ack struct {
+	Block uint16
+}
+
+type Error struct {
+	Code uint16
+	Msg  string
+}
+
+// OptionAck acknowledges the options of a request the server accepted
+type OptionAck struct {
+	Options map[string]string
+}
+
+// ParsePacket decodes a packet of any opcode
+func ParsePacket(b []byte) (Packet, error) {
+	opcode, err := getTwoByteInt(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Packet
+	switch opcode {
+	case RRQ:
+		p = &ReadRequest{}
+	case WRQ:
+		p = &WriteRequest{}
+	case DATA:
+		p = &Data{}
+	case ACK:
+		p = &Ack{}
+	case ERROR:
+		p = &Error{}
+	case OACK:
+		p = &OptionAck{}
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid opCode '%v' out of range", opcode))
+	}
+
+	if err := p.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *ReadRequest) Opcode() uint16  { return RRQ }
+func (p *WriteRequest) Opcode() uint16 { return WRQ }
+func (p *Data) Opcode() uint16         { return DATA }
+func (p *Ack) Opcode() uint16          { return ACK }
+func (p *Error) Opcode() uint16        { return ERROR }
+func (p *OptionAck) Opcode() uint16    { return OACK }
+
+func (p *ReadRequest) String() string {
+	return fmt.Sprintf("RRQ '%v' %v%v", p.Filename, p.Mode, optionsString(p.Options))
+}
+
+func (p *WriteRequest) String() string {
+	return fmt.Sprintf("WRQ '%v' %v%v", p.Filename, p.Mode, optionsString(p.Options))
+}
+
+func (p *Data) String() string {
+	return fmt.Sprintf("DATA %v of %v bytes", p.Block, len(p.Data))
+}
+
+func (p *Ack) String() string {
+	return fmt.Sprintf("ACK %v", p.Block)
+}
+
+func (p *Error) String() string {
+	return fmt.Sprintf("ERROR %v '%v'", p.Code, p.Msg)
+}
+
+// An *Error is also the error returned for error packets sent or received
+// by the sessions, found with errors.As
+func (p *Error) Error() string {
+	return p.String()
+}
+
+func (p *OptionAck) String() string {
+	return "OACK" + optionsString(p.Options)
+}
+
+func optionsString(options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := ""
+	for _, name := range names {
+		s += fmt.Sprintf(" %v=%v", name, options[name])
+	}
+
+	return s
+}
+
+func (p *ReadRequest) MarshalBinary() ([]byte, error) {
+	return marshalRequest(RRQ, p.Filename, p.Mode, p.Options)
+}
+
+func (p *ReadRequest) UnmarshalBinary(b []byte) (err error) {
+	p.Filename, p.Mode, p.Options, err = unmarshalRequest(RRQ, b)
+	return err
+}
+
+func (p *WriteRequest) MarshalBinary() ([]byte, error) {
+	return marshalRequest(WRQ, p.Filename, p.Mode, p.Options)
+}
+
+func (p *WriteRequest) UnmarshalBinary(b []byte) (err error) {
+	p.Filename, p.Mode, p.Options, err = unmarshalRequest(WRQ, b)
+	return err
+}
+
+func (p *Data) MarshalBinary() ([]byte, error) {
+	if len(p.Data) > dataBlockSize {
+		return nil, errors.New(fmt.Sprintf("Data of %v bytes exceeds the %v byte block size", len(p.Data), dataBlockSize))
+	}
+
+	return appendDataPacket(make([]byte, 0, 4+len(p.Data)), p.Block, p.Data), nil
+}
+
+func (p *Data) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(DATA, b); err != nil {
+		return err
+	}
+
+	block, data, err := parseData(b[2:])
+	if err != nil {
+		return err
+	}
+
+	if len(data) > dataBlockSize {
+		return errors.New(fmt.Sprintf("Data of %v bytes exceeds the %v byte block size", len(data), dataBlockSize))
+	}
+
+	p.Block = block
+	p.Data = append(p.Data[:0], data...)
+	return nil
+}
+
+func (p *Ack) MarshalBinary() ([]byte, error) {
+	return appendAckPacket(make([]byte, 0, 4), p.Block), nil
+}
+
+func (p *Ack) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(ACK, b); err != nil {
+		return err
+	}
+
+	if len(b) != 4 {
+		return errors.New(fmt.Sprintf("Ack packet must be 4 bytes, not %v", len(b)))
+	}
+
+	p.Block, _ = parseAck(b[2:])
+	return nil
+}
+
+func (p *Error) MarshalBinary() ([]byte, error) {
+	if err := checkString("error message", p.Msg, true); err != nil {
+		return nil, err
+	}
+
+	return appendErrorPacket(make([]byte, 0, 5+len(p.Msg)), p.Code, p.Msg), nil
+}
+
+// Unlike the handlers, which only accept the RFC 1350 error codes,
+// UnmarshalBinary accepts any code so that extensions can be inspected
+func (p *Error) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(ERROR, b); err != nil {
+		return err
+	}
+
+	if len(b) < 4 {
+		return errors.New("Input is too short to extract error code")
+	}
+
+	fields, err := splitStrings(b[4:])
+	if err != nil {
+		return err
+	}
+
+	if len(fields) != 1 {
+		return errors.New("Error packet must hold exactly one message")
+	}
+
+	p.Code, _ = getTwoByteInt(b[2:])
+	p.Msg = fields[0]
+	return nil
+}
+
+func (p *OptionAck) MarshalBinary() ([]byte, error) {
+	b := appendTwoByteInt(nil, OACK)
+	return appendOptions(b, p.Options)
+}
+
+func (p *OptionAck) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(OACK, b); err != nil {
+		return err
+	}
+
+	fields, err := splitStrings(b[2:])
+	if err != nil {
+		return err
+	}
+
+	p.Options, err = parseOptions(fields)
+	return err
+}
+
+func marshalRequest(opcode uint16, file string, mode string, options map[string]string) ([]byte, error) {
+	if err := checkString("file name", file, false); err != nil {
+		return nil, err
+	}
+
+	if err := checkString("mode", mode, false); err != nil {
+		return nil, err
+	}
+
+	b := appendTwoByteInt(nil, opcode)
+	b = append(append(b, file...), 0)
+	b = append(append(b, mode...), 0)
+	return appendOptions(b, options)
+}
+
+func unmarshalRequest(opcode uint16, b []byte) (string, string, map[string]string, error) {
+	if err := checkOpcode(opcode, b); err != nil {
+		return "", "", nil, err
+	}
+
+	fields, err := splitStrings(b[2:])
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	if len(fields) < 2 {
+		return "", "", nil, errors.New("Request must hold a file name and a mode")
+	}
+
+	if fields[0] == "" || fields[1] == "" {
+		return "", "", nil, errors.New("Request file name and mode must not be empty")
+	}
+
+	options, err := parseOptions(fields[2:])
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return fields[0], fields[1], options, nil
+}
+
+// Options are written in name order so that encoding is deterministic.
+// Names differing only by case would be the same option when parsed, so
+// they are rejected.
+func appendOptions(b []byte, options map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[string]string, len(names))
+	for _, name := range names {
+		if err := checkString("option name", name, false); err != nil {
+			return nil, err
+		}
+
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			return nil, errors.New(fmt.Sprintf("Options '%v' and '%v' differ only by case", other, name))
+		}
+		seen[strings.ToLower(name)] = name
+
+		if err := checkString("option value", options[name], true); err != nil {
+			return nil, err
+		}
+
+		b = append(append(b, name...), 0)
+		b = append(append(b, options[name]...), 0)
+	}
+
+	return b, nil
+}
+
+func parseOptions(fields []string) (map[string]string, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	if len(fields)%2 != 0 {
+		return nil, errors.New(fmt.Sprintf("Option '%v' has no value", fields[len(fields)-1]))
+	}
+
+	options := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		if fields[i] == "" {
+			return nil, errors.New("Option names must not be empty")
+		}
+
+		name := strings.ToLower(fields[i])
+		if _, ok := options[name]; ok {
+			return nil, errors.New(fmt.Sprintf("Option '%v' appears more than once", fields[i]))
+		}
+
+		options[name] = fields[i+1]
+	}
+
+	return options, nil
+}
+
+// Split a sequence of 0 terminated strings
+func splitStrings(b []byte) ([]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	if b[len(b)-1] != 0 {
+		return nil, errors.New("Strings must be terminated by a 0")
+	}
+
+	fields := bytes.Split(b[:len(b)-1], []byte{0})
+	strs := make([]string, len(fields))
+	for i, field := range fields {
+		strs[i] = string(field)
+	}
+
+	return strs, nil
+}
+
+func checkOpcode(opcode uint16, b []byte) error {
+	code, err := getTwoByteInt(b)
+	if err != nil {
+		return err
+	}
+
+	if code != opcode {
+		return errors.New(fmt.Sprintf("Expected opCode '%v', found '%v'", opcode, code))
+	}
+
+	return nil
+}
+
+func checkString(what string, s string, emptyOk bool) error {
+	if !emptyOk && s == "" {
+		return errors.New(fmt.Sprintf("The %v must not be empty", what))
+	}
+
+	if strings.IndexByte(s, 0) >= 0 {
+		return errors.New(fmt.Sprintf("The %v must not contain a 0 byte", what))
+	}
+
+	return nil
+}
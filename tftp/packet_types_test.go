@@ -0,0 +1,196 @@
+package tftp
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// Strings without 0 bytes, which can't appear inside packet strings
+func randomString(r *rand.Rand, emptyOk bool) string {
+	n := r.Intn(20)
+	if !emptyOk {
+		n++
+	}
+
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(1 + r.Intn(255))
+	}
+
+	return string(b)
+}
+
+func randomOptions(r *rand.Rand) map[string]string {
+	n := r.Intn(4)
+	if n == 0 {
+		return nil
+	}
+
+	// Parsing lower cases option names
+	options := map[string]string{}
+	for i := 0; i < n; i++ {
+		options[strings.ToLower(randomString(r, false))] = randomString(r, true)
+	}
+
+	return options
+}
+
+func randomPacket(r *rand.Rand) Packet {
+	switch r.Intn(6) {
+	case 0:
+		return &ReadRequest{Filename: randomString(r, false), Mode: randomString(r, false), Options: randomOptions(r)}
+	case 1:
+		return &WriteRequest{Filename: randomString(r, false), Mode: randomString(r, false), Options: randomOptions(r)}
+	case 2:
+		data := make([]byte, r.Intn(dataBlockSize+1))
+		r.Read(data)
+		return &Data{Block: uint16(r.Intn(1 << 16)), Data: data}
+	case 3:
+		return &Ack{Block: uint16(r.Intn(1 << 16))}
+	case 4:
+		return &Error{Code: uint16(r.Intn(1 << 16)), Msg: randomString(r, true)}
+	default:
+		return &OptionAck{Options: randomOptions(r)}
+	}
+}
+
+// Generates any packet for testing/quick
+type anyPacket struct {
+	Packet
+}
+
+func (anyPacket) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(anyPacket{randomPacket(r)})
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	roundTrip := func(p anyPacket) bool {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			t.Logf("Marshal %#v: %v", p.Packet, err)
+			return false
+		}
+
+		parsed, err := ParsePacket(b)
+		if err != nil {
+			t.Logf("Parse %v: %v", b, err)
+			return false
+		}
+
+		again, err := parsed.MarshalBinary()
+		if err != nil || !bytes.Equal(b, again) {
+			t.Logf("Marshal of %#v gave %v, expected %v", parsed, again, b)
+			return false
+		}
+
+		return equalPackets(p.Packet, parsed)
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func equalPackets(a Packet, b Packet) bool {
+	if da, ok := a.(*Data); ok {
+		db, ok := b.(*Data)
+		return ok && da.Block == db.Block && bytes.Equal(da.Data, db.Data)
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// The typed packets encode exactly like the packets the sessions send
+func TestPacketEncodingMatchesSessions(t *testing.T) {
+	cases := []struct {
+		packet   Packet
+		expected []byte
+	}{
+		{&ReadRequest{Filename: "foo", Mode: "octet"}, []byte("\x00\x01foo\x00octet\x00")},
+		{&WriteRequest{Filename: "foo", Mode: "octet", Options: map[string]string{"tsize": "0", "blksize": "1428"}},
+			[]byte("\x00\x02foo\x00octet\x00blksize\x001428\x00tsize\x000\x00")},
+		{&Data{Block: 1, Data: []byte("abc")}, NewDataPacket([2]byte{0, 1}, []byte("abc")).bytes},
+		{&Ack{Block: 7}, NewAckPacket([2]byte{0, 7}).bytes},
+		{&Error{Code: 2, Msg: "err"}, NewErrorPacket([2]byte{0, 2}, "err").bytes},
+		{&OptionAck{Options: map[string]string{"blksize": "1428"}}, []byte("\x00\x06blksize\x001428\x00")},
+	}
+
+	for _, c := range cases {
+		b, err := c.packet.MarshalBinary()
+		if err != nil {
+			t.Errorf("Marshal %#v failed: %v", c.packet, err)
+		} else if !bytes.Equal(b, c.expected) {
+			t.Errorf("Expected %#v to encode as %q, received %q", c.packet, c.expected, b)
+		}
+	}
+}
+
+func TestParsePacketNegative(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0},
+		{0, 0},
+		{0, 7},
+		[]byte("\x00\x01foo\x00"),
+		[]byte("\x00\x01foo\x00octet"),
+		[]byte("\x00\x01\x00octet\x00"),
+		[]byte("\x00\x01foo\x00octet\x00blksize\x00"),
+		[]byte("\x00\x01foo\x00octet\x00tsize\x000\x00tsize\x000\x00"),
+		[]byte("\x00\x01foo\x00octet\x00blksize\x00512\x00BLKSIZE\x001024\x00"),
+		{0, 3, 0},
+		append([]byte{0, 3, 0, 1}, make([]byte, dataBlockSize+1)...),
+		{0, 4, 0},
+		{0, 4, 0, 1, 0},
+		{0, 5, 0, 1},
+		[]byte("\x00\x05\x00\x01err"),
+		[]byte("\x00\x05\x00\x01e\x00rr\x00"),
+		[]byte("\x00\x06blksize"),
+	}
+
+	for _, input := range inputs {
+		if p, err := ParsePacket(input); err == nil {
+			t.Errorf("Expected parsing %q to fail, received %#v", input, p)
+		}
+	}
+}
+
+// RFC 2347 option names are case insensitive
+func TestParseOptionNamesIgnoreCase(t *testing.T) {
+	p, err := ParsePacket([]byte("\x00\x01foo\x00octet\x00BlkSize\x001024\x00TSIZE\x000\x00"))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if options := p.(*ReadRequest).Options; len(options) != 2 || options["blksize"] != "1024" || options["tsize"] != "0" {
+		t.Errorf("Expected lower case option names, received %v", options)
+	}
+}
+
+func TestUnmarshalWrongOpcode(t *testing.T) {
+	b, _ := (&Ack{Block: 1}).MarshalBinary()
+	if err := (&Data{}).UnmarshalBinary(b); err == nil {
+		t.Errorf("Expected an ACK not to unmarshal as DATA")
+	}
+}
+
+func TestMarshalNegative(t *testing.T) {
+	packets := []Packet{
+		&ReadRequest{Filename: "", Mode: "octet"},
+		&WriteRequest{Filename: "foo", Mode: "oc\x00tet"},
+		&ReadRequest{Filename: "foo", Mode: "octet", Options: map[string]string{"": "1"}},
+		&ReadRequest{Filename: "foo", Mode: "octet", Options: map[string]string{"blksize": "512", "BLKSIZE": "1024"}},
+		&OptionAck{Options: map[string]string{"tsize": "0", "TSize": "0"}},
+		&Data{Data: make([]byte, dataBlockSize+1)},
+		&Error{Msg: "e\x00rr"},
+	}
+
+	for _, p := range packets {
+		if b, err := p.MarshalBinary(); err == nil {
+			t.Errorf("Expected marshalling %#v to fail, received %q", p, b)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package tftp
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -17,7 +16,7 @@ func validateMode(mode string) error {
 }
 
 func validateErrorCode(code uint16) error {
-	if code > 7 {
+	if code > OptionRefused {
 		return errors.New(fmt.Sprintf("Invalid error code: %v", code))
 	}
 
@@ -42,36 +41,5 @@ func getTwoByteInt(input []byte) (uint16, error) {
 		return 0, errors.New("Require at least 2 bytes to parse uint16")
 	}
 
-	output, err := convertBytesToInt(input[:2])
-	if err != nil {
-		return 0, err
-	}
-
-	return uint16(output), nil
-}
-
-func convertBytesToInt(input []byte) (uint64, error) {
-	// Pad a slice as golang doesn't provide a straight conversion to 16-bit integers
-	pad := []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
-	paddedInput := append(pad, input...)
-
-	var result uint64
-	err := binary.Read(bytes.NewBuffer(paddedInput[:]), binary.BigEndian, &result)
-
-	if err != nil {
-		return 0, errors.New(fmt.Sprintf("Failed to convert bytes '%v' to integer '%v'", paddedInput, result))
-	}
-
-	return result, nil
-}
-
-func convertIntToBytes(input uint16) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, input)
-
-	if err != nil {
-		return []byte{}, errors.New(fmt.Sprintf("Failed to convert uint16 '%v' to bytes", input))
-	}
-
-	return buf.Bytes(), nil
+	return binary.BigEndian.Uint16(input), nil
 }
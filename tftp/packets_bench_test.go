@@ -0,0 +1,141 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+)
+
+// An upload dropping what it is sent, so that benchmarks don't grow it
+// without bound
+type discardUpload struct{}
+
+func (discardUpload) Write(data []byte) error                             { return nil }
+func (discardUpload) Commit(name string, digests map[string]string) error { return nil }
+func (discardUpload) Abort()                                              {}
+
+// A connection answering every packet written to it, without a network
+type benchConn struct {
+	last  [4]byte
+	reply func(last [4]byte, b []byte) int
+}
+
+func (c *benchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.reply(c.last, b), benchAddr, nil
+}
+
+func (c *benchConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	copy(c.last[:], b)
+	return len(b), nil
+}
+
+func (c *benchConn) Close() error                       { return nil }
+func (c *benchConn) LocalAddr() net.Addr                { return benchAddr }
+func (c *benchConn) SetDeadline(t time.Time) error      { return nil }
+func (c *benchConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *benchConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var benchAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6969}
+
+// One block of a read session: read the ACK of the last block sent,
+// handle it and send the next DATA block
+func BenchmarkReadSessionBlock(b *testing.B) {
+	conn := &benchConn{
+		reply: func(last [4]byte, buf []byte) int {
+			// ACK whatever block was sent last
+			return copy(buf, []byte{0, ACK, last[2], last[3]})
+		},
+	}
+
+	server := NewServer(NewMemFileServer())
+	file := &File{Name: "kernel", Data: make([]byte, dataBlockSize*60000)}
+	s := &ReadSession{
+		rw:        NewTftpReaderWriterFromConn(conn, benchAddr, false),
+		server:    server,
+		file:      file,
+		sendBuf:   getPacketBuffer(),
+		currBlock: 1,
+		lastBlock: 60001,
+	}
+	s.tracked = server.sessions.add(SessionInfo{Client: benchAddr.String()}, s.rw)
+	s.writeData()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if s.currBlock == 60000 {
+			s.currBlock = 1
+			s.writeData()
+		}
+
+		packet, addr, err := s.rw.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err = HandleTftpPackets(s, addr, packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// One block of a write session: read the next DATA block, store it and
+// ACK it
+func BenchmarkWriteSessionBlock(b *testing.B) {
+	data := make([]byte, dataBlockSize+4)
+	conn := &benchConn{
+		reply: func(last [4]byte, buf []byte) int {
+			// Send the block after the one ACKed last
+			block := uint16(last[2])<<8 | uint16(last[3]) + 1
+			data[0], data[1], data[2], data[3] = 0, DATA, byte(block>>8), byte(block)
+			return copy(buf, data)
+		},
+	}
+
+	server := NewServer(NewMemFileServer())
+	s := &WriteSession{
+		rw:     NewTftpReaderWriterFromConn(conn, benchAddr, false),
+		server: server,
+		upload: discardUpload{},
+	}
+	s.tracked = server.sessions.add(SessionInfo{Client: benchAddr.String()}, s.rw)
+	s.writeAck()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		packet, addr, err := s.rw.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if err = HandleTftpPackets(s, addr, packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Keep the results of benchmarked functions alive, so that the compiler
+// can't drop the calls
+var (
+	blockSink uint16
+	dataSink  []byte
+)
+
+func BenchmarkParseData(b *testing.B) {
+	packet := make([]byte, dataBlockSize+2)
+	packet[1] = 7
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		block, data, err := parseData(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		blockSink, dataSink = block, data
+	}
+}
@@ -2,6 +2,7 @@ package tftp
 
 import (
 	"bytes"
+	"net"
 	"testing"
 )
 
@@ -77,18 +78,19 @@ func TestParseError(t *testing.T) {
 	var expectedErrorCode uint16 = 2
 	expectedMessage := "msg"
 
-	code, msg, err := parseError([]byte{0, 2, 'm', 's', 'g', 0})
+	var p Error
+	err := p.UnmarshalBinary([]byte{0, 5, 0, 2, 'm', 's', 'g', 0})
 
 	if err != nil {
 		t.Errorf("Expected parseError to succeed, returned error: %v", err)
 	}
 
-	if code != expectedErrorCode {
-		t.Errorf("Expected error code: %v, returned %v", expectedErrorCode, code)
+	if p.Code != expectedErrorCode {
+		t.Errorf("Expected error code: %v, returned %v", expectedErrorCode, p.Code)
 	}
 
-	if msg != "msg" {
-		t.Errorf("Expected error message: %v, returned %v", expectedMessage, msg)
+	if p.Msg != "msg" {
+		t.Errorf("Expected error message: %v, returned %v", expectedMessage, p.Msg)
 	}
 
 }
@@ -141,3 +143,46 @@ func TestCreateErrorPacket(t *testing.T) {
 		t.Errorf("Expected bytes: %v, received: %v", expectedBytes, errPacket.bytes)
 	}
 }
+
+// Records the requests handed to it
+type requestRecorder struct {
+	requests int
+	options  map[string]string
+}
+
+func (r *requestRecorder) ReadReq(addr net.Addr, file string, mode string, options map[string]string) error {
+	r.requests++
+	r.options = options
+	return nil
+}
+
+func (r *requestRecorder) WriteReq(addr net.Addr, file string, mode string, options map[string]string) error {
+	return r.ReadReq(addr, file, mode, options)
+}
+
+func (r *requestRecorder) Data(block uint16, data []byte) error { return nil }
+func (r *requestRecorder) Ack(block uint16) error               { return nil }
+func (r *requestRecorder) Err(code uint16, msg string) error    { return nil }
+
+func TestHandleRequestOptions(t *testing.T) {
+	for _, opcode := range []uint16{RRQ, WRQ} {
+		r := &requestRecorder{}
+		request := append(requestBytes(opcode, "foo"), "BlkSize\x00512\x00multicast\x00\x00"...)
+		if err := HandleTftpPackets(r, benchAddr, request); err != nil || r.requests != 1 {
+			t.Fatalf("Expected request %q to be handled, received %v", request, err)
+		}
+
+		if len(r.options) != 2 || r.options["blksize"] != "512" || r.options["multicast"] != "" {
+			t.Errorf("Expected the options of %q by lower case name, received %v", request, r.options)
+		}
+
+		// Requests with malformed options are rejected like any other
+		// malformed packet rather than served without them
+		for _, options := range []string{"blksize\x00", "\x00512\x00", "blksize\x00512\x00BLKSIZE\x001024\x00"} {
+			request := append(requestBytes(opcode, "foo"), options...)
+			if err := HandleTftpPackets(r, benchAddr, request); !isMalformed(err) || r.requests != 1 {
+				t.Errorf("Expected request %q to be malformed, received %v", request, err)
+			}
+		}
+	}
+}
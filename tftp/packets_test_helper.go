@@ -21,6 +21,16 @@ func opcodePositiveTestHelper(t *testing.T, bytes []byte, expectedCode uint16) {
 	}
 }
 
+// Requests are given without their opcode
+func parseRequest(input []byte) (string, string, error) {
+	var p ReadRequest
+	if err := p.UnmarshalBinary(append([]byte{0, RRQ}, input...)); err != nil {
+		return "", "", err
+	}
+
+	return p.Filename, p.Mode, validateMode(p.Mode)
+}
+
 func parseRequestHelperPositive(t *testing.T, input []byte, expectedFile string, expectedMode string) {
 	file, mode, err := parseRequest(input)
 	if err != nil {
@@ -0,0 +1,132 @@
+package tftp
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Implemented by connections which know the local address each packet
+// was sent to, which differs from LocalAddr on wildcard sockets
+type localAddrReader interface {
+	ReadFromLocal(b []byte) (n int, remoteAddr net.Addr, localAddr net.Addr, err error)
+}
+
+// Implemented by connections which can choose the local address a packet
+// is sent from
+type localAddrWriter interface {
+	WriteToFrom(b []byte, localAddr net.Addr, remoteAddr net.Addr) (int, error)
+}
+
+// pktinfoConn uses IP_PKTINFO / IPV6_PKTINFO on a socket bound to a
+// wildcard address so that on multi-homed hosts a reply can come from the
+// same address the request was sent to
+type pktinfoConn struct {
+	net.PacketConn
+	v4   *ipv4.PacketConn
+	v6   *ipv6.PacketConn
+	port int
+}
+
+// Wrap a UDP socket bound to a wildcard address.  Sockets bound to a
+// specific address, and platforms without packet info, are returned as is.
+func withPktinfo(conn net.PacketConn) net.PacketConn {
+	udpAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || !udpAddr.IP.IsUnspecified() {
+		return conn
+	}
+
+	c := &pktinfoConn{PacketConn: conn, port: udpAddr.Port}
+	var err error
+	if udpAddr.IP.To4() != nil {
+		c.v4 = ipv4.NewPacketConn(conn)
+		err = c.v4.SetControlMessage(ipv4.FlagDst, true)
+	} else {
+		c.v6 = ipv6.NewPacketConn(conn)
+		err = c.v6.SetControlMessage(ipv6.FlagDst, true)
+	}
+
+	if err != nil {
+		logrus.Infof("Packet info unavailable on %v, replies use the default source address: %v", udpAddr, err)
+		return conn
+	}
+
+	return c
+}
+
+func (c *pktinfoConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, remoteAddr, _, err := c.ReadFromLocal(b)
+	return n, remoteAddr, err
+}
+
+func (c *pktinfoConn) ReadFromLocal(b []byte) (int, net.Addr, net.Addr, error) {
+	var dst net.IP
+	var n int
+	var remoteAddr net.Addr
+	var err error
+
+	if c.v4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, remoteAddr, err = c.v4.ReadFrom(b)
+		if cm != nil {
+			dst = cm.Dst
+		}
+	} else {
+		var cm *ipv6.ControlMessage
+		n, cm, remoteAddr, err = c.v6.ReadFrom(b)
+		if cm != nil {
+			dst = cm.Dst
+		}
+	}
+
+	if err != nil || dst == nil {
+		return n, remoteAddr, c.LocalAddr(), err
+	}
+
+	// IPv4 clients of a dual-stack socket arrive on mapped addresses
+	if dst4 := dst.To4(); dst4 != nil {
+		dst = dst4
+	}
+
+	return n, remoteAddr, &net.UDPAddr{IP: dst, Port: c.port}, nil
+}
+
+func (c *pktinfoConn) WriteToFrom(b []byte, localAddr net.Addr, remoteAddr net.Addr) (int, error) {
+	udpAddr, ok := localAddr.(*net.UDPAddr)
+	if !ok || udpAddr.IP.IsUnspecified() {
+		return c.WriteTo(b, remoteAddr)
+	}
+
+	if c.v4 != nil {
+		return c.v4.WriteTo(b, &ipv4.ControlMessage{Src: udpAddr.IP}, remoteAddr)
+	}
+
+	return c.v6.WriteTo(b, &ipv6.ControlMessage{Src: udpAddr.IP.To16()}, remoteAddr)
+}
+
+// The network to bind a "host:port" address with.  An IP literal gets a
+// socket of its own family, so "0.0.0.0:69" and "[::]:69" can be bound
+// side by side, while an empty host gets a dual-stack socket.
+func udpNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "udp"
+	}
+
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
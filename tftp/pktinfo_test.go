@@ -0,0 +1,95 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+)
+
+func TestUdpNetwork(t *testing.T) {
+	cases := map[string]string{
+		":69":              "udp",
+		"0.0.0.0:69":       "udp4",
+		"192.168.1.10:69":  "udp4",
+		"[::]:69":          "udp6",
+		"[fe80::1%eth0]:0": "udp6",
+		"localhost:69":     "udp",
+	}
+
+	for addr, expected := range cases {
+		if network := udpNetwork(addr); network != expected {
+			t.Errorf("Expected network %v for %v, received %v", expected, addr, network)
+		}
+	}
+}
+
+// Every address in 127.0.0.0/8 is local on Linux, which makes the
+// loopback interface multi-homed
+func TestRepliesComeFromRequestedAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Requires every 127.0.0.0/8 address to be local")
+	}
+
+	server := NewServer(NewMemFileServer())
+	server.FileServer().Write(&File{Name: "foo", Data: testData(2000)})
+
+	conn, err := server.Transport().Listen("0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go server.Serve(conn)
+
+	if _, ok := conn.(localAddrReader); !ok {
+		t.Skip("Packet info is unavailable")
+	}
+
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		serverAddr := &net.UDPAddr{IP: net.ParseIP(ip), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+		client := newUDPTestClient(serverAddr)
+		client.onTid = func(tid net.Addr) {
+			if !tid.(*net.UDPAddr).IP.Equal(serverAddr.IP) {
+				t.Errorf("Expected replies from %v, received them from %v", serverAddr.IP, tid)
+			}
+		}
+
+		data, err := client.get("foo")
+		if err != nil || !bytes.Equal(data, testData(2000)) {
+			t.Errorf("Read via %v failed: %v", ip, err)
+		}
+	}
+}
+
+func TestSeparateIPv4AndIPv6Listeners(t *testing.T) {
+	probe, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is unavailable")
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	server := NewServer(NewMemFileServer())
+	server.FileServer().Write(&File{Name: "foo", Data: testData(700)})
+
+	v4Addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	v6Addr := &net.UDPAddr{IP: net.IPv6loopback, Port: port}
+	go server.ListenAndServe(v4Addr.String(), v6Addr.String())
+	time.Sleep(50 * time.Millisecond)
+
+	for _, addr := range []*net.UDPAddr{v4Addr, v6Addr} {
+		client := newUDPTestClient(addr)
+		network := udpNetwork(addr.String())
+		client.listen = func() (net.PacketConn, error) {
+			return net.ListenPacket(network, net.JoinHostPort(addr.IP.String(), "0"))
+		}
+
+		data, err := client.get("foo")
+		if err != nil || !bytes.Equal(data, testData(700)) {
+			t.Errorf("Read via %v failed: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scopes of a rate limit
+const (
+	ScopeGlobal  = "global"
+	ScopeClient  = "client"
+	ScopeSession = "session"
+)
+
+// RateLimit caps the bytes per second of the transfers it matches.  By
+// default the transfers matching a limit share one token bucket, so a
+// limit on a subnet or a file pattern caps all of them together.  A
+// client or session scope gives each client or session its own bucket
+// instead.
+type RateLimit struct {
+	// IP address or CIDR subnet of the clients limited, every client
+	// when empty
+	Client string
+
+	// A path.Match pattern for the files limited, every file when empty
+	File string
+
+	// ScopeGlobal, ScopeClient or ScopeSession, global when empty
+	Scope string
+
+	// Bytes per second
+	Rate int
+
+	// Bytes that may be sent at once after an idle period, one block
+	// when not set
+	Burst int
+}
+
+type rateLimiter struct {
+	mutex sync.RWMutex
+	rules []*rateRule
+	now   func() time.Time
+	sleep func(time.Duration, <-chan struct{})
+}
+
+// A limit with its buckets, keyed by client IP or session ID as its
+// scope requires
+type rateRule struct {
+	limit   RateLimit
+	subnet  *net.IPNet
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		now:   time.Now,
+		sleep: sleep,
+	}
+}
+
+// Sleep for d unless cancel is closed first
+func sleep(d time.Duration, cancel <-chan struct{}) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-cancel:
+	}
+}
+
+// Replace the limits.  A limit for the same clients, files and scope as
+// an existing one keeps the tokens of its buckets, so changing a rate
+// doesn't grant a fresh burst.
+func (l *rateLimiter) set(limits []RateLimit) error {
+	rules := []*rateRule{}
+	for _, limit := range limits {
+		rule, err := newRateRule(limit)
+		if err != nil {
+			return err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	defer l.mutex.Unlock()
+	l.mutex.Lock()
+
+	now := l.now()
+	for _, rule := range rules {
+		for _, old := range l.rules {
+			if old.limit.Client == rule.limit.Client && old.limit.File == rule.limit.File && old.limit.Scope == rule.limit.Scope {
+				old.mutex.Lock()
+				for key, bucket := range old.buckets {
+					old.refill(bucket, now)
+					rule.buckets[key] = &tokenBucket{
+						tokens: math.Min(bucket.tokens, float64(rule.limit.Burst)),
+						last:   now,
+					}
+				}
+				old.mutex.Unlock()
+			}
+		}
+	}
+
+	l.rules = rules
+	return nil
+}
+
+func (l *rateLimiter) limits() []RateLimit {
+	defer l.mutex.RUnlock()
+	l.mutex.RLock()
+
+	limits := []RateLimit{}
+	for _, rule := range l.rules {
+		limits = append(limits, rule.limit)
+	}
+
+	return limits
+}
+
+// Wait until n bytes may be sent to or received from client for file in
+// session, or until cancel is closed.  The limits are looked up on every
+// call, so changes apply to transfers already running.  No wait is longer
+// than max, so that the peer doesn't give up on the transfer meanwhile.
+// The tokens missing then are owed by the next wait.
+func (l *rateLimiter) wait(client net.Addr, session uint64, file string, n int, cancel <-chan struct{}, max time.Duration) {
+	l.mutex.RLock()
+	if len(l.rules) == 0 {
+		l.mutex.RUnlock()
+		return
+	}
+
+	now := l.now()
+	var delay time.Duration
+	for _, rule := range l.rules {
+		if rule.matches(client, file) {
+			if d := rule.take(rule.key(client, session), n, now); d > delay {
+				delay = d
+			}
+		}
+	}
+	l.mutex.RUnlock()
+
+	if delay > max {
+		delay = max
+	}
+
+	if delay > 0 {
+		l.sleep(delay, cancel)
+	}
+}
+
+func newRateRule(limit RateLimit) (*rateRule, error) {
+	if limit.Rate <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid rate %v, expected a positive number of bytes per second", limit.Rate))
+	}
+
+	if limit.Burst <= 0 {
+		limit.Burst = dataBlockSize
+	}
+
+	if limit.Scope == "" {
+		limit.Scope = ScopeGlobal
+	}
+
+	if limit.Scope != ScopeGlobal && limit.Scope != ScopeClient && limit.Scope != ScopeSession {
+		return nil, errors.New(fmt.Sprintf("Invalid scope '%v', expected %v, %v or %v", limit.Scope, ScopeGlobal, ScopeClient, ScopeSession))
+	}
+
+	subnet, err := parseClientSubnet(limit.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := path.Match(limit.File, ""); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid file pattern '%v': %v", limit.File, err))
+	}
+
+	return &rateRule{
+		limit:   limit,
+		subnet:  subnet,
+		buckets: make(map[string]*tokenBucket),
+	}, nil
+}
+
+func (r *rateRule) matches(client net.Addr, file string) bool {
+	if !subnetContains(r.subnet, client) {
+		return false
+	}
+
+	if r.limit.File != "" {
+		if ok, _ := path.Match(r.limit.File, file); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The bucket of client in session under the scope of the rule
+func (r *rateRule) key(client net.Addr, session uint64) string {
+	switch r.limit.Scope {
+	case ScopeClient:
+		if udpAddr, ok := client.(*net.UDPAddr); ok {
+			return udpAddr.IP.String()
+		}
+		return client.String()
+	case ScopeSession:
+		return strconv.FormatUint(session, 10)
+	default:
+		return ""
+	}
+}
+
+// Take n tokens from the bucket under key, returning how long to wait
+// for them.  Tokens taken ahead of time leave the bucket in debt, which
+// makes the next taker wait longer.
+func (r *rateRule) take(key string, n int, now time.Time) time.Duration {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		r.prune(now)
+		bucket = &tokenBucket{tokens: float64(r.limit.Burst), last: now}
+		r.buckets[key] = bucket
+	}
+
+	r.refill(bucket, now)
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-bucket.tokens / float64(r.limit.Rate) * float64(time.Second))
+}
+
+// Drop the buckets which have filled up again, as they are no different
+// from new ones.  This keeps the buckets of clients and sessions long
+// gone from piling up.  The caller must hold the mutex.
+func (r *rateRule) prune(now time.Time) {
+	for key, bucket := range r.buckets {
+		r.refill(bucket, now)
+		if bucket.tokens >= float64(r.limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// The caller must hold the mutex
+func (r *rateRule) refill(bucket *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens += elapsed.Seconds() * float64(r.limit.Rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens > float64(r.limit.Burst) {
+		bucket.tokens = float64(r.limit.Burst)
+	}
+}
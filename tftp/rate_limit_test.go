@@ -0,0 +1,279 @@
+package tftp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+// A clock only advanced by sleeping on it
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func useFakeClock(l *rateLimiter) *fakeClock {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	l.now = c.Now
+	l.sleep = c.Sleep
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration, cancel <-chan struct{}) {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func (c *fakeClock) Slept() time.Duration {
+	defer c.mutex.Unlock()
+	c.mutex.Lock()
+	return c.slept
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	limiter := newRateLimiter()
+	clock := useFakeClock(limiter)
+	err := limiter.set([]RateLimit{
+		{Client: "10.0.0.0/8", Rate: 1000, Burst: 1000},
+		{File: "*.img", Rate: 100},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set limits: %v", err)
+	}
+
+	inside := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	outside := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1000}
+
+	limiter.wait(outside, 1, "kernel", 100000, nil, time.Hour)
+	if clock.Slept() != 0 {
+		t.Errorf("Expected no limit to apply, slept %v", clock.Slept())
+	}
+
+	// The burst is free, after that the rate applies
+	limiter.wait(inside, 1, "kernel", 1000, nil, time.Hour)
+	limiter.wait(inside, 1, "kernel", 500, nil, time.Hour)
+	if clock.Slept() != 500*time.Millisecond {
+		t.Errorf("Expected to sleep 500ms, slept %v", clock.Slept())
+	}
+
+	// The slowest matching limit wins
+	limiter.wait(inside, 1, "disk.img", 512, nil, time.Hour)
+	limiter.wait(inside, 1, "disk.img", 100, nil, time.Hour)
+	if clock.Slept() != 1500*time.Millisecond {
+		t.Errorf("Expected to sleep 1.5s, slept %v", clock.Slept())
+	}
+}
+
+func TestRateLimiterChangeKeepsTokens(t *testing.T) {
+	limiter := newRateLimiter()
+	clock := useFakeClock(limiter)
+	limiter.set([]RateLimit{{Rate: 1000}})
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	limiter.wait(client, 1, "kernel", 1512, nil, time.Hour)
+	if clock.Slept() != time.Second {
+		t.Fatalf("Expected to sleep 1s, slept %v", clock.Slept())
+	}
+
+	// Raising the rate doesn't refill the bucket
+	limiter.set([]RateLimit{{Rate: 2000}})
+	limiter.wait(client, 1, "kernel", 1000, nil, time.Hour)
+	if clock.Slept() != 1500*time.Millisecond {
+		t.Errorf("Expected to sleep 1.5s, slept %v", clock.Slept())
+	}
+
+	limiter.set(nil)
+	limiter.wait(client, 1, "kernel", 100000, nil, time.Hour)
+	if clock.Slept() != 1500*time.Millisecond {
+		t.Errorf("Expected no more limits, slept %v", clock.Slept())
+	}
+}
+
+// Three transfers of 2000 bytes at once, two of them by the same client
+func TestRateLimiterScopes(t *testing.T) {
+	a := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("10.1.2.4"), Port: 1000}
+
+	for scope, expected := range map[string][]time.Duration{
+		ScopeGlobal:  {time.Second, 3 * time.Second, 5 * time.Second},
+		ScopeClient:  {time.Second, 3 * time.Second, time.Second},
+		ScopeSession: {time.Second, time.Second, time.Second},
+	} {
+		limiter := newRateLimiter()
+		now := time.Unix(0, 0)
+		limiter.now = func() time.Time { return now }
+
+		var slept []time.Duration
+		limiter.sleep = func(d time.Duration, cancel <-chan struct{}) { slept = append(slept, d) }
+
+		limiter.set([]RateLimit{{Scope: scope, Rate: 1000, Burst: 1000}})
+		limiter.wait(a, 1, "kernel", 2000, nil, time.Hour)
+		limiter.wait(a, 2, "kernel", 2000, nil, time.Hour)
+		limiter.wait(b, 3, "kernel", 2000, nil, time.Hour)
+
+		if len(slept) != 3 || slept[0] != expected[0] || slept[1] != expected[1] || slept[2] != expected[2] {
+			t.Errorf("Expected %v limits to sleep %v, slept %v", scope, expected, slept)
+		}
+	}
+}
+
+func TestRateLimiterPrunesFullBuckets(t *testing.T) {
+	limiter := newRateLimiter()
+	clock := useFakeClock(limiter)
+	limiter.set([]RateLimit{{Scope: ScopeSession, Rate: 1000, Burst: 1000}})
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	for session := uint64(1); session <= 100; session++ {
+		limiter.wait(client, session, "kernel", 1000, nil, time.Hour)
+		clock.Sleep(time.Second, nil)
+	}
+
+	if buckets := len(limiter.rules[0].buckets); buckets != 1 {
+		t.Errorf("Expected the buckets of finished sessions to be dropped, %v left", buckets)
+	}
+}
+
+// Waits are capped so that peers don't time out, the tokens missing are
+// owed by the next wait
+func TestRateLimiterWaitCapped(t *testing.T) {
+	limiter := newRateLimiter()
+	clock := useFakeClock(limiter)
+	limiter.set([]RateLimit{{Rate: 100}})
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	limiter.wait(client, 1, "kernel", 1000, nil, time.Second)
+	if clock.Slept() != time.Second {
+		t.Fatalf("Expected to sleep 1s, slept %v", clock.Slept())
+	}
+
+	limiter.wait(client, 1, "kernel", 0, nil, time.Hour)
+	if clock.Slept() != 4*time.Second+880*time.Millisecond {
+		t.Errorf("Expected to sleep 4.88s, slept %v", clock.Slept())
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	limiter := newRateLimiter()
+	limiter.set([]RateLimit{{Rate: 1}})
+
+	cancel := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(cancel) })
+
+	start := time.Now()
+	limiter.wait(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}, 1, "kernel", 1000, cancel, time.Hour)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the wait to end when cancelled, waited %v", elapsed)
+	}
+}
+
+func TestRateLimiterNegative(t *testing.T) {
+	limiter := newRateLimiter()
+	for _, limits := range [][]RateLimit{
+		{{Rate: 0}},
+		{{Rate: -5}},
+		{{Client: "10.0.0.0/33", Rate: 1}},
+		{{Client: "host", Rate: 1}},
+		{{File: "[", Rate: 1}},
+		{{Scope: "host", Rate: 1}},
+		{{Rate: 1}, {File: "[", Rate: 1}},
+	} {
+		if err := limiter.set(limits); err == nil {
+			t.Errorf("Expected limits %v to be rejected", limits)
+		}
+	}
+
+	if len(limiter.limits()) != 0 {
+		t.Errorf("Rejected limits mustn't be set: %v", limiter.limits())
+	}
+}
+
+// Reads pace DATA and writes pace ACKs to the rate of the limits
+func TestSessionRateLimit(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	clock := useFakeClock(server.limiter)
+
+	if err := server.SetRateLimits([]RateLimit{{File: "slow*", Rate: 1000}}); err != nil {
+		t.Fatalf("Failed to set limits: %v", err)
+	}
+
+	data := testData(5 * dataBlockSize)
+	server.FileServer().Write(&File{Name: "slow", Data: data})
+	server.FileServer().Write(&File{Name: "fast", Data: data})
+
+	if _, err := newTestClient(network, addr).get("fast"); err != nil || clock.Slept() != 0 {
+		t.Errorf("Expected an unlimited read, slept %v, err %v", clock.Slept(), err)
+	}
+
+	received, err := newTestClient(network, addr).get("slow")
+	if err != nil || !bytes.Equal(received, data) {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	// The first block is covered by the burst
+	expected := 4 * dataBlockSize * time.Second / 1000
+	if clock.Slept() != expected {
+		t.Errorf("Expected the read to take %v, slept %v", expected, clock.Slept())
+	}
+
+	if err := newTestClient(network, addr).put("slow.up", data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	// The read used up the burst of the shared limit
+	if written := clock.Slept() - expected; written != expected+dataBlockSize*time.Second/1000 {
+		t.Errorf("Expected the write to take %v, slept %v", expected+dataBlockSize*time.Second/1000, written)
+	}
+
+	waitForSessions(t, server)
+}
+
+// Sessions limited each to a rate run side by side at that rate
+func TestSessionRateLimitScope(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+
+	// Each read takes a second on its own, two if they shared the rate
+	rate := 20 * dataBlockSize
+	if err := server.SetRateLimits([]RateLimit{{Scope: ScopeSession, Rate: rate}}); err != nil {
+		t.Fatalf("Failed to set limits: %v", err)
+	}
+	server.FileServer().Write(&File{Name: "kernel", Data: testData(21 * dataBlockSize)})
+
+	start := time.Now()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := newTestClient(network, addr).get("kernel")
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 1600*time.Millisecond {
+		t.Errorf("Expected both reads to take about a second, took %v", elapsed)
+	}
+
+	waitForSessions(t, server)
+}
@@ -11,54 +11,78 @@ import (
 
 type ReadSession struct {
 	rw           *TftpReaderWriter
+	server       *Server
+	tracked      *trackedSession
 	file         *File
+	sendBuf      *[]byte
 	currBlock    uint16
 	lastBlock    int
+	ackedBytes   int
 	fileComplete bool
 	timeoutCount int
 }
 
-func StartNewReadSession(remoteAddr *net.UDPAddr, fileName string, fileServ FileServer) error {
-	// Create TftpReaderWriter
-	rw, err := NewTftpReaderWriter(remoteAddr, true)
-	if err != nil {
-		return err
-	}
-
-	if !fileServ.FileExists(fileName) {
-		return HandleError(rw, FileNotFound, fmt.Sprintf("File '%v' doesn't exist", fileName))
-	}
+// StartNewReadSession runs a read session over rw, which the session
+// closes when done
+func StartNewReadSession(rw *TftpReaderWriter, fileName string, mode string, server *Server) (err error) {
+	fileServ := server.FileServer()
+	remoteAddr := rw.remoteAddr
+	defer rw.release()
+	defer rw.Close()
+
+	var readSession *ReadSession
+	record := newAuditRecord(remoteAddr, fileName, DirectionRead, mode)
+	defer func() {
+		bytes := 0
+		if readSession != nil {
+			bytes = readSession.ackedBytes
+		}
+		server.audit(record, bytes, err)
+	}()
 
 	file, err := fileServ.Read(fileName)
 	if err != nil {
-		return err
+		return handleFileError(rw, err)
 	}
 
 	// Set the last block we expect to receive an ACK for.
-	// In the case of empty files we still need to transmit one block
-	// hence the lastBlock == 0, case
-	lastBlock := (len(file.Data) / dataBlockSize)
-	if lastBlock*dataBlockSize < len(file.Data) || lastBlock == 0 {
-		lastBlock++
-	}
+	// The transfer ends with the first block shorter than dataBlockSize,
+	// so empty files and files of an exact multiple of dataBlockSize
+	// end with an empty block
+	lastBlock := (len(file.Data) / dataBlockSize) + 1
 
-	readSession := &ReadSession{
+	readSession = &ReadSession{
 		rw:           rw,
+		server:       server,
 		file:         file,
+		sendBuf:      getPacketBuffer(),
 		currBlock:    1,
 		lastBlock:    lastBlock,
 		fileComplete: false,
 		timeoutCount: 0,
 	}
 
-	logrus.Infof("[Read Session %v]: Start for file '%v'", remoteAddr.Port, file.Name)
+	readSession.tracked = server.sessions.add(SessionInfo{
+		Client:    remoteAddr.String(),
+		File:      file.Name,
+		Direction: DirectionRead,
+		Size:      len(file.Data),
+	}, rw)
+	defer server.sessions.remove(readSession.tracked)
+	defer putPacketBuffer(readSession.sendBuf)
+
+	logrus.Infof("%v: Start for file '%v'", readSession.tracked.logPrefix("Read Session"), file.Name)
 
 	// Main work loop with bounded timeouts
-	for readSession.timeoutCount < timeoutCountMax {
+	for readSession.timeoutCount < server.retries {
 		if err = readSession.Start(); err != nil {
 			if isTimeout(err) {
-				logrus.Infof("[Read Session %v]: timeout %d", remoteAddr.Port, readSession.timeoutCount)
+				logrus.Infof("%v: timeout %d", readSession.tracked.logPrefix("Read Session"), readSession.timeoutCount)
 				readSession.timeoutCount++
+				server.sessions.retransmit(readSession.tracked)
+			} else if server.sessions.isCancelled(readSession.tracked) {
+				logrus.Infof("%v: cancelled", readSession.tracked.logPrefix("Read Session"))
+				return errors.New(fmt.Sprintf("Read session for '%v' cancelled", file.Name))
 			} else {
 				return err
 			}
@@ -78,14 +102,16 @@ func (s *ReadSession) Start() error {
 	// See the ACK() method below
 	for {
 		if s.fileComplete {
-			logrus.Infof("[Read Session]: completed file '%v' with %v bytes", s.file.Name, len(s.file.Data))
+			logrus.Infof("%v: completed file '%v' with %v bytes", s.tracked.logPrefix("Read Session"), s.file.Name, len(s.file.Data))
 			return nil
 		}
 
 		if bytes, _, err := s.rw.Read(); err != nil {
 			return err
 		} else {
-			if err := HandleTftpPackets(s, s.rw.remoteAddr, bytes); err != nil {
+			if err := HandleTftpPackets(s, s.rw.remoteAddr, bytes); isMalformed(err) {
+				return HandleError(s.rw, IllegalOperation, err.Error())
+			} else if err != nil {
 				return err
 			}
 		}
@@ -110,32 +136,32 @@ func (s *ReadSession) getData() []byte {
 	return s.file.Data[start:end]
 }
 
-// Build the next Data packet for transmission
-func (s *ReadSession) getDataPacket() (*DataPacket, error) {
-	if bytes, err := convertIntToBytes(s.currBlock); err != nil {
-		return nil, err
-	} else {
-		data := s.getData()
-		blockArr := [2]byte{bytes[0], bytes[1]}
-		return NewDataPacket(blockArr, data), nil
+// Number of file bytes the client has acknowledged up to and including block
+func ackedBytes(file *File, block uint16) int {
+	acked := int(block) * dataBlockSize
+	if acked > len(file.Data) {
+		return len(file.Data)
 	}
+
+	return acked
 }
 
-// Send the next data packet to the requestor
+// Send the next data packet to the requestor, encoded into the
+// session's send buffer
 func (s *ReadSession) writeData() error {
-	if data, err := s.getDataPacket(); err != nil {
-		return err
-	} else {
-		_, err = s.rw.Write(data.bytes)
-		return err
-	}
+	data := s.getData()
+	s.server.limiter.wait(s.rw.remoteAddr, s.tracked.info.ID, s.file.Name, len(data), s.tracked.stop, s.rw.deadline/2)
+
+	*s.sendBuf = appendDataPacket((*s.sendBuf)[:0], s.currBlock, data)
+	_, err := s.rw.Write(*s.sendBuf)
+	return err
 }
 
-func (s *ReadSession) ReadReq(addr *net.UDPAddr, file string, mode string) error {
+func (s *ReadSession) ReadReq(addr net.Addr, file string, mode string, options map[string]string) error {
 	return errors.New("ReadReq operations are not supported on read handlers")
 }
 
-func (s *ReadSession) WriteReq(addr *net.UDPAddr, file string, mode string) error {
+func (s *ReadSession) WriteReq(addr net.Addr, file string, mode string, options map[string]string) error {
 	return errors.New("WriteReq operations are not supported on read handlers")
 }
 
@@ -144,6 +170,16 @@ func (s *ReadSession) Data(block uint16, data []byte) error {
 }
 
 func (s *ReadSession) Ack(block uint16) error {
+	// Duplicate or delayed ACKs of earlier blocks are ignored rather than
+	// answered, which would double every following packet
+	if block != s.currBlock {
+		return nil
+	}
+
+	s.ackedBytes = ackedBytes(s.file, block)
+	s.server.sessions.progress(s.tracked, block, s.ackedBytes)
+	s.timeoutCount = 0
+
 	if int(block) == s.lastBlock {
 		s.fileComplete = true
 		return nil
@@ -154,6 +190,6 @@ func (s *ReadSession) Ack(block uint16) error {
 }
 
 func (s *ReadSession) Err(code uint16, msg string) error {
-	logrus.Infof("Received Error with code %v and message %v", code, msg)
-	return errors.New(fmt.Sprintf("Received Error with code %v and message %v", code, msg))
+	logrus.Infof("%v: Received Error with code %v and message %v", s.tracked.logPrefix("Read Session"), code, msg)
+	return &Error{Code: code, Msg: msg}
 }
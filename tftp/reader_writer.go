@@ -1,82 +1,162 @@
 package tftp
 
 import (
+	"errors"
 	"net"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 )
 
+// TftpReaderWriter reads and writes TFTP packets over any packet
+// connection.  A reader writer with a remote address belongs to a single
+// transfer: it only writes to that address and answers packets from any
+// other address with an unknown transfer ID error.
 type TftpReaderWriter struct {
-	buf        []byte
-	conn       *net.UDPConn
-	localAddr  *net.UDPAddr
-	remoteAddr *net.UDPAddr
+	buf        *[]byte
+	conn       net.PacketConn
+	localAddr  net.Addr
+	remoteAddr net.Addr
 	timeout    bool
+
+	// How long to wait for a reply when timeout is set
+	deadline time.Duration
+
+	// Sees every packet when set, along with the file being transferred
+	tracer Tracer
+	file   string
 }
 
-func NewTftpReaderWriter(remoteAddr *net.UDPAddr, timeout bool) (*TftpReaderWriter, error) {
-	// Resolve UDP address
-	localAddr, err := net.ResolveUDPAddr("udp", ":0")
+// NewTftpReaderWriter opens a UDP connection on an ephemeral port
+func NewTftpReaderWriter(remoteAddr net.Addr, timeout bool) (*TftpReaderWriter, error) {
+	conn, err := (&UDPTransport{}).SessionConn(nil, remoteAddr)
 	if err != nil {
-		logrus.Infof("Failed to resolve UDP address: %v", err)
 		return nil, err
 	}
 
-	var conn *net.UDPConn = nil
-
-	if remoteAddr == nil {
-		// Listen on UDP connection
-		conn, err = net.ListenUDP("udp", localAddr)
-		if err != nil {
-			logrus.Infof("Failed to UDP listen: %v", err)
-			return nil, err
-		} else {
-			logrus.Infof("UDP local address: %v", conn.LocalAddr())
-		}
-	} else {
-		// Connect to remote address
-		conn, err = net.DialUDP("udp", localAddr, remoteAddr)
-		if err != nil {
-			return nil, err
-		}
-	}
+	return NewTftpReaderWriterFromConn(conn, remoteAddr, timeout), nil
+}
 
-	writer := &TftpReaderWriter{
+func NewTftpReaderWriterFromConn(conn net.PacketConn, remoteAddr net.Addr, timeout bool) *TftpReaderWriter {
+	return &TftpReaderWriter{
 		conn:       conn,
-		buf:        make([]byte, 1024),
-		localAddr:  localAddr,
+		buf:        getPacketBuffer(),
+		localAddr:  conn.LocalAddr(),
 		remoteAddr: remoteAddr,
 		timeout:    timeout,
+		deadline:   timeoutSec * time.Second,
 	}
-
-	return writer, nil
 }
 
 func (rw *TftpReaderWriter) Write(bytes []byte) (int, error) {
+	if rw.remoteAddr == nil {
+		return 0, errors.New("Can't write without a remote address")
+	}
+
 	rw.setDeadline()
-	return rw.conn.Write(bytes)
+	rw.trace(bytes, rw.localAddr, rw.remoteAddr, true)
+	return rw.conn.WriteTo(bytes, rw.remoteAddr)
 }
 
-func (rw *TftpReaderWriter) Read() ([]byte, *net.UDPAddr, error) {
-	rw.setDeadline()
+// WriteTo writes to an address other than the remote address, e.g. for
+// the listening socket to answer a client from the address the client
+// last sent to
+func (rw *TftpReaderWriter) WriteTo(bytes []byte, addr net.Addr) (int, error) {
+	rw.trace(bytes, rw.localAddr, addr, true)
+	if writer, ok := rw.conn.(localAddrWriter); ok {
+		return writer.WriteToFrom(bytes, rw.localAddr, addr)
+	}
 
-	// Read bytes into buffer
-	length, addr, err := rw.conn.ReadFromUDP(rw.buf)
-	if err != nil {
-		logrus.Infof("Read error: ", err)
-		return []byte{}, nil, err
+	return rw.conn.WriteTo(bytes, addr)
+}
+
+// LocalAddr returns the local address the last packet read was sent to
+func (rw *TftpReaderWriter) LocalAddr() net.Addr {
+	return rw.localAddr
+}
+
+// Read the next packet.  Timeouts count from the last Write, so packets
+// the session ignores, like duplicate ACKs, don't postpone retransmission.
+// The returned bytes share the read buffer and are only valid until the
+// next Read; callers that keep them must copy.
+func (rw *TftpReaderWriter) Read() ([]byte, net.Addr, error) {
+	for {
+		// Read bytes into buffer
+		length, addr, err := rw.readFrom()
+		if err != nil {
+			logrus.Infof("Read error: %v", err)
+			return []byte{}, nil, err
+		}
+
+		packet := (*rw.buf)[:length]
+		rw.trace(packet, addr, rw.localAddr, false)
+
+		// Packets from another transfer ID get an error without
+		// disturbing the current transfer
+		if rw.remoteAddr != nil && !sameAddr(addr, rw.remoteAddr) {
+			logrus.Infof("Packet from unknown transfer ID %v", addr)
+			errorPacket := getErrorPacket(UnknownTid, "Unknown transfer ID")
+			rw.trace(errorPacket.bytes, rw.localAddr, addr, true)
+			rw.conn.WriteTo(errorPacket.bytes, addr)
+			continue
+		}
+
+		return packet, addr, nil
+	}
+}
+
+func (rw *TftpReaderWriter) readFrom() (int, net.Addr, error) {
+	if reader, ok := rw.conn.(localAddrReader); ok {
+		length, addr, localAddr, err := reader.ReadFromLocal(*rw.buf)
+		if err == nil {
+			rw.localAddr = localAddr
+		}
+
+		return length, addr, err
 	}
 
-	// Copy bytes into new buffer
-	copyBuf := make([]byte, length)
-	copy(copyBuf, rw.buf[0:length])
+	return rw.conn.ReadFrom(*rw.buf)
+}
+
+func (rw *TftpReaderWriter) Close() error {
+	return rw.conn.Close()
+}
+
+// Return the read buffer to the pool.  Close may be called from another
+// goroutine to cancel a session, so only the goroutine reading from rw
+// may release it, once it is done reading.
+func (rw *TftpReaderWriter) release() {
+	if rw.buf != nil {
+		putPacketBuffer(rw.buf)
+		rw.buf = nil
+	}
+}
 
-	return copyBuf, addr, nil
+func (rw *TftpReaderWriter) trace(bytes []byte, from net.Addr, to net.Addr, sent bool) {
+	if rw.tracer != nil {
+		rw.tracer.Trace(&TracedPacket{
+			Time:  time.Now(),
+			From:  from,
+			To:    to,
+			Sent:  sent,
+			File:  rw.file,
+			Bytes: bytes,
+		})
+	}
 }
 
 func (rw *TftpReaderWriter) setDeadline() {
 	if rw.timeout {
-		rw.conn.SetDeadline(time.Now().Add(timeoutSec * time.Second))
+		rw.conn.SetDeadline(time.Now().Add(rw.deadline))
 	}
 }
+
+func sameAddr(a net.Addr, b net.Addr) bool {
+	udpA, okA := a.(*net.UDPAddr)
+	udpB, okB := b.(*net.UDPAddr)
+	if okA && okB {
+		return udpA.Port == udpB.Port && udpA.IP.Equal(udpB.IP)
+	}
+
+	return a.Network() == b.Network() && a.String() == b.String()
+}
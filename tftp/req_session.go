@@ -2,6 +2,7 @@ package tftp
 
 import (
 	"errors"
+	"fmt"
 	"net"
 
 	"github.com/Sirupsen/logrus"
@@ -9,26 +10,19 @@ import (
 )
 
 type ReqSession struct {
-	rw       *TftpReaderWriter
-	fileServ FileServer
+	rw     *TftpReaderWriter
+	server *Server
 }
 
+// Serve requests from an in memory file server
 func StartNewReqSession() error {
-	rw, err := NewTftpReaderWriter(nil, false)
-	if err != nil {
-		logrus.Errorf("Failed to start request session with err: %v", err)
-		return err
-	}
-
-	reqSession := NewReqSession(rw)
-	logrus.Infof("[Request Session]: Starting")
-	return reqSession.Start()
+	return NewServer(NewMemFileServer()).ListenAndServe(":0")
 }
 
-func NewReqSession(rw *TftpReaderWriter) *ReqSession {
+func NewReqSession(rw *TftpReaderWriter, server *Server) *ReqSession {
 	return &ReqSession{
-		rw:       rw,
-		fileServ: NewMemFileServer(),
+		rw:     rw,
+		server: server,
 	}
 }
 
@@ -39,23 +33,92 @@ func (s *ReqSession) Start() error {
 		if bytes, addr, err := s.rw.Read(); err != nil {
 			return err
 		} else {
+			s.server.sessions.touch()
+
+			// A bad packet from one client mustn't stop the server.  Stray
+			// DATA, ACK and ERROR packets are dropped silently as they
+			// are often late retransmissions.
 			if err := HandleTftpPackets(s, addr, bytes); err != nil {
-				return err
+				logrus.Infof("[Request Session]: Dropped packet from %v: %v", addr, err)
+				if isMalformed(err) {
+					errorPacket := getErrorPacket(IllegalOperation, err.Error())
+					s.rw.WriteTo(errorPacket.bytes, addr)
+				}
 			}
 		}
 	}
 }
 
-func (s *ReqSession) ReadReq(addr *net.UDPAddr, file string, mode string) error {
+func (s *ReqSession) ReadReq(addr net.Addr, file string, mode string, options map[string]string) error {
 	logrus.Infof("[Request Session]: Received ReadReq for file: %v, in mode %v", file, mode)
-	go StartNewReadSession(addr, file, s.fileServ)
-	return nil
+	if !s.checkAccess(addr, file, DirectionRead, mode) {
+		return nil
+	}
+
+	// Clients that can't be served by multicast fall back to unicast
+	if _, ok := options["multicast"]; ok && s.server.multicast != nil {
+		if err := s.server.multicast.join(addr, file, mode, s.rw.LocalAddr()); err == nil {
+			return nil
+		} else {
+			logrus.Infof("[Request Session]: Serving %v by unicast: %v", addr, err)
+		}
+	}
+
+	if rw, err := s.openSession(addr, file, DirectionRead, mode); err != nil {
+		return err
+	} else {
+		go StartNewReadSession(rw, file, mode, s.server)
+		return nil
+	}
 }
 
-func (s *ReqSession) WriteReq(addr *net.UDPAddr, file string, mode string) error {
+func (s *ReqSession) WriteReq(addr net.Addr, file string, mode string, options map[string]string) error {
 	logrus.Infof("[Request Session]: Received WriteReq for file: %v, in mode %v", file, mode)
-	go StartNewWriteSession(addr, file, s.fileServ)
-	return nil
+	if !s.checkAccess(addr, file, DirectionWrite, mode) {
+		return nil
+	}
+	if rw, err := s.openSession(addr, file, DirectionWrite, mode); err != nil {
+		return err
+	} else {
+		go StartNewWriteSession(rw, file, mode, s.server)
+		return nil
+	}
+}
+
+// Denied requests are answered from the listening socket without
+// starting a session
+func (s *ReqSession) checkAccess(addr net.Addr, file string, direction string, mode string) bool {
+	if s.server.access.allowed(addr, file, direction) {
+		return true
+	}
+
+	logrus.Infof("[Request Session]: Denied %v of '%v' to %v", direction, file, addr)
+	s.refuse(addr, file, direction, mode, &Error{AccessViolation, fmt.Sprintf("Access to '%v' denied", file)})
+	return false
+}
+
+// Open the connection of a new session.  When that fails, e.g. because
+// no transfer port is free, the client is told from the listening socket.
+// A repeated request from a client whose session shares the listening
+// socket is dropped, as an error from there would end that session.
+func (s *ReqSession) openSession(addr net.Addr, file string, direction string, mode string) (*TftpReaderWriter, error) {
+	rw, err := s.server.newSessionReaderWriter(s.rw.LocalAddr(), addr, file)
+	if errors.Is(err, errSessionActive) {
+		return nil, err
+	} else if err != nil {
+		s.refuse(addr, file, direction, mode, &Error{UndefinedError, fmt.Sprintf("Server busy: %v", err)})
+		return nil, err
+	}
+
+	return rw, nil
+}
+
+// Send the client err for a request which never got a session, auditing
+// it as a failed transfer
+func (s *ReqSession) refuse(addr net.Addr, file string, direction string, mode string, err *Error) {
+	errorPacket := getErrorPacket(err.Code, err.Msg)
+	s.rw.WriteTo(errorPacket.bytes, addr)
+	s.server.audit(newAuditRecord(addr, file, direction, mode), 0, err)
 }
 
 func (s *ReqSession) Data(block uint16, data []byte) error {
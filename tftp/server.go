@@ -0,0 +1,343 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/gabrielhartmann/tftp/fileserv"
+)
+
+// Server ties together the file server that backs transfers, the
+// transport connections are opened on, and the set of sessions
+// currently transferring files
+type Server struct {
+	fileServ  FileServer
+	transport Transport
+	sessions  *sessionTable
+	tracer    Tracer
+	auditor   Auditor
+	integrity IntegrityConfig
+	multicast *multicastGroups
+	reap      sync.Once
+	mutex     sync.Mutex
+	listeners map[net.PacketConn]struct{}
+	closed    bool
+	limiter   *rateLimiter
+	access    *accessRules
+	timeout   time.Duration
+	retries   int
+	idleExit  time.Duration
+}
+
+// NewServer creates a server on the default UDP transport
+func NewServer(fileServ FileServer) *Server {
+	return NewServerWithTransport(fileServ, &UDPTransport{})
+}
+
+func NewServerWithTransport(fileServ FileServer, transport Transport) *Server {
+	return &Server{
+		fileServ:  fileServ,
+		transport: transport,
+		sessions:  newSessionTable(),
+		listeners: make(map[net.PacketConn]struct{}),
+		limiter:   newRateLimiter(),
+		access:    &accessRules{},
+		timeout:   timeoutSec * time.Second,
+		retries:   timeoutCountMax,
+	}
+}
+
+func (s *Server) FileServer() FileServer {
+	return s.fileServ
+}
+
+func (s *Server) Transport() Transport {
+	return s.transport
+}
+
+// Sessions returns a snapshot of every active read and write session
+func (s *Server) Sessions() []SessionInfo {
+	return s.sessions.list()
+}
+
+var ErrServerClosed = errors.New("Server shut down")
+
+// Shutdown closes the listening connections, so that serving returns
+// ErrServerClosed, then cancels every session, aborting unfinished
+// uploads, and waits for them to end or for timeout to pass.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.mutex.Lock()
+	s.closed = true
+	for conn := range s.listeners {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	return s.sessions.drain(timeout)
+}
+
+// Session returns the session with id if it is still active
+func (s *Server) Session(id uint64) (SessionInfo, bool) {
+	return s.sessions.get(id)
+}
+
+// CancelSession stops the session transferring to or from client,
+// given as "host:port".  The client is sent an error packet.
+func (s *Server) CancelSession(client string) error {
+	return s.sessions.cancelClient(client)
+}
+
+// CancelSessionByID stops the session with id like CancelSession
+func (s *Server) CancelSessionByID(id uint64) error {
+	return s.sessions.cancelID(id)
+}
+
+// SetTracer has every packet sent or received passed to tracer.  It must
+// be called before serving.
+func (s *Server) SetTracer(tracer Tracer) {
+	s.tracer = tracer
+}
+
+// SetRateLimits replaces the limits on the rate of transfers.  It may be
+// called at any time, and sessions already running follow the new limits
+// from their next block on.
+func (s *Server) SetRateLimits(limits []RateLimit) error {
+	return s.limiter.set(limits)
+}
+
+func (s *Server) RateLimits() []RateLimit {
+	return s.limiter.limits()
+}
+
+// SetAccessRules replaces the rules deciding which requests are served.
+// Like the rate limits they may be changed at any time, but only apply
+// to requests arriving afterwards.
+func (s *Server) SetAccessRules(rules []AccessRule) error {
+	return s.access.set(rules)
+}
+
+func (s *Server) AccessRules() []AccessRule {
+	return s.access.list()
+}
+
+// SetTimeouts sets how long sessions wait for a reply before
+// retransmitting, and how many times they retransmit before giving up.
+// It must be called before serving.
+func (s *Server) SetTimeouts(timeout time.Duration, retries int) error {
+	if timeout <= 0 || retries <= 0 {
+		return errors.New(fmt.Sprintf("Invalid timeout %v with %v retries, both must be positive", timeout, retries))
+	}
+
+	s.timeout = timeout
+	s.retries = retries
+	return nil
+}
+
+// SetAuditor has every transfer recorded by auditor once it ends.  It
+// must be called before serving.
+func (s *Server) SetAuditor(auditor Auditor) {
+	s.auditor = auditor
+}
+
+// SetIntegrity sets the digests computed for uploads and how they are
+// checked.  It must be called before serving.
+func (s *Server) SetIntegrity(config IntegrityConfig) error {
+	if _, err := newUploadDigests(config); err != nil {
+		return err
+	}
+
+	s.integrity = config
+	return nil
+}
+
+// EnableMulticast serves RFC 2090 multicast reads to clients asking for
+// them.  It must be called before serving.  Sessions share one port in
+// single port mode, so multicast, which needs a port per group, can't be
+// combined with a MuxTransport.
+func (s *Server) EnableMulticast(config MulticastConfig) error {
+	if _, ok := s.transport.(*MuxTransport); ok {
+		return errors.New("Multicast can't be combined with single port mode")
+	}
+
+	groups, err := newMulticastGroups(config, s)
+	if err != nil {
+		return err
+	}
+
+	s.multicast = groups
+	return nil
+}
+
+// ListenAndServe listens for requests on every address, e.g. ":69" for a
+// dual-stack socket, "0.0.0.0:69" and "[::]:69" for separate IPv4 and IPv6
+// sockets, or ":0" for an ephemeral port.  It spawns read and write
+// sessions for requests until serving any of the addresses fails.
+func (s *Server) ListenAndServe(addrs ...string) error {
+	conns := []net.PacketConn{}
+	for _, addr := range addrs {
+		conn, err := s.transport.Listen(addr)
+		if err != nil {
+			logrus.Errorf("Failed to start request session with err: %v", err)
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		}
+
+		logrus.Infof("%v local address: %v", strings.ToUpper(conn.LocalAddr().Network()), conn.LocalAddr())
+		conns = append(conns, conn)
+	}
+
+	return s.serveAll(conns)
+}
+
+// ServeInherited handles requests on sockets opened elsewhere, e.g. by
+// systemd socket activation or inetd, until serving any of them fails.
+// Requests already waiting on them are handled first.
+func (s *Server) ServeInherited(conns ...net.PacketConn) error {
+	adopted := []net.PacketConn{}
+	for _, conn := range conns {
+		if adopter, ok := s.transport.(connAdopter); ok {
+			c, err := adopter.Adopt(conn)
+			if err != nil {
+				return err
+			}
+			conn = c
+		}
+
+		logrus.Infof("%v inherited address: %v", strings.ToUpper(conn.LocalAddr().Network()), conn.LocalAddr())
+		adopted = append(adopted, conn)
+	}
+
+	return s.serveAll(adopted)
+}
+
+func (s *Server) serveAll(conns []net.PacketConn) error {
+	if len(conns) == 0 {
+		return errors.New("No address to listen on")
+	}
+
+	errs := make(chan error, len(conns)+1)
+	for _, conn := range conns {
+		go func(conn net.PacketConn) {
+			errs <- s.Serve(conn)
+		}(conn)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if s.idleExit > 0 {
+		s.sessions.touch()
+		go s.watchIdle(errs, done)
+	}
+
+	err := <-errs
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+var ErrIdleTimeout = errors.New("No requests or sessions within the idle timeout")
+
+// SetIdleTimeout has serving stop with ErrIdleTimeout once there were
+// neither sessions nor requests for timeout, so that a server started on
+// demand by systemd or inetd exits when it is no longer needed.  It must
+// be called before serving.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.idleExit = timeout
+}
+
+func (s *Server) watchIdle(errs chan<- error, done <-chan struct{}) {
+	// Very short timeouts are checked no more than every millisecond
+	tick := s.idleExit / 10
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.sessions.idle() >= s.idleExit {
+				errs <- ErrIdleTimeout
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Serve handles requests arriving on conn until reading from it fails or
+// the server is shut down.  Serving first reaps uploads staged by a
+// previous run.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if !s.addListener(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(conn)
+
+	s.reap.Do(func() {
+		if n := s.fileServ.Reap(); n > 0 {
+			logrus.Infof("Reaped %v abandoned uploads", n)
+		}
+	})
+
+	rw := NewTftpReaderWriterFromConn(conn, nil, false)
+	rw.tracer = s.tracer
+	reqSession := NewReqSession(rw, s)
+	logrus.Infof("[Request Session]: Starting")
+	err := reqSession.Start()
+
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Track conn so that Shutdown closes it, unless already shut down
+func (s *Server) addListener(conn net.PacketConn) bool {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	if s.closed {
+		return false
+	}
+
+	s.listeners[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(conn net.PacketConn) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+
+	delete(s.listeners, conn)
+}
+
+// Create the reader writer of a new read or write session of file
+// answering remoteAddr from localAddr
+func (s *Server) newSessionReaderWriter(localAddr net.Addr, remoteAddr net.Addr, file string) (*TftpReaderWriter, error) {
+	conn, err := s.transport.SessionConn(localAddr, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := NewTftpReaderWriterFromConn(conn, remoteAddr, true)
+	rw.tracer = s.tracer
+	rw.file = file
+	rw.deadline = s.timeout
+	return rw, nil
+}
@@ -0,0 +1,307 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DirectionRead  = "read"
+	DirectionWrite = "write"
+)
+
+// Session states
+const (
+	SessionTransferring   = "transferring"
+	SessionRetransmitting = "retransmitting"
+	SessionDallying       = "dallying"
+	SessionCancelled      = "cancelled"
+)
+
+// SessionInfo describes the progress of a read or write session.
+// Size is 0 for write sessions as the final size isn't known until
+// the last block arrives.
+type SessionInfo struct {
+	// Unique among the sessions of a server
+	ID uint64
+
+	Client    string
+	File      string
+	Direction string
+	Start     time.Time
+	State     string
+
+	// The last block ACKed
+	Block       uint16
+	Bytes       int
+	Size        int
+	Retransmits int
+}
+
+const cancelledMessage = "Session cancelled by the server"
+
+type trackedSession struct {
+	info      SessionInfo
+	rw        *TftpReaderWriter
+	cancelled bool
+
+	// Closed when the session is cancelled
+	stop chan struct{}
+}
+
+// Prefix of the log lines of the session, naming its ID and client, e.g.
+// "[Read Session 3 10.0.0.5:2000]"
+func (t *trackedSession) logPrefix(kind string) string {
+	if t == nil {
+		return fmt.Sprintf("[%v]", kind)
+	}
+
+	return fmt.Sprintf("[%v %v %v]", kind, t.info.ID, t.info.Client)
+}
+
+type sessionTable struct {
+	mutex    sync.Mutex
+	sessions map[uint64]*trackedSession
+	lastID   uint64
+
+	// Set once draining, after which sessions are cancelled as they start
+	draining bool
+
+	// Time of the last request or session start or end
+	lastActive time.Time
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions:   make(map[uint64]*trackedSession),
+		lastActive: time.Now(),
+	}
+}
+
+func (t *sessionTable) add(info SessionInfo, rw *TftpReaderWriter) *trackedSession {
+	t.mutex.Lock()
+
+	t.lastID++
+	info.ID = t.lastID
+	info.Start = time.Now()
+	info.State = SessionTransferring
+
+	session := &trackedSession{info: info, rw: rw, stop: make(chan struct{})}
+	t.sessions[info.ID] = session
+	t.lastActive = info.Start
+
+	cancelled := t.draining && t.cancel(session)
+	t.mutex.Unlock()
+
+	if cancelled {
+		session.abort()
+	}
+	return session
+}
+
+func (t *sessionTable) remove(session *trackedSession) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	delete(t.sessions, session.info.ID)
+	t.lastActive = time.Now()
+}
+
+// Note a request, which counts as activity even without a session
+func (t *sessionTable) touch() {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	t.lastActive = time.Now()
+}
+
+// How long there have been no sessions and no requests
+func (t *sessionTable) idle() time.Duration {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	if len(t.sessions) > 0 {
+		return 0
+	}
+
+	return time.Since(t.lastActive)
+}
+
+// Note the last block ACKed and the bytes transferred so far
+func (t *sessionTable) progress(session *trackedSession, block uint16, bytes int) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	session.info.Block = block
+	session.info.Bytes = bytes
+	if session.info.State == SessionRetransmitting {
+		session.info.State = SessionTransferring
+	}
+}
+
+func (t *sessionTable) retransmit(session *trackedSession) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	session.info.Retransmits++
+	if session.info.State == SessionTransferring {
+		session.info.State = SessionRetransmitting
+	}
+}
+
+func (t *sessionTable) setState(session *trackedSession, state string) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	if !session.cancelled {
+		session.info.State = state
+	}
+}
+
+func (t *sessionTable) isCancelled(session *trackedSession) bool {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	return session.cancelled
+}
+
+func (t *sessionTable) list() []SessionInfo {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	infos := make([]SessionInfo, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		infos = append(infos, session.info)
+	}
+
+	sort.Sort(byClient(infos))
+	return infos
+}
+
+func (t *sessionTable) get(id uint64) (SessionInfo, bool) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	if session, ok := t.sessions[id]; ok {
+		return session.info, true
+	}
+
+	return SessionInfo{}, false
+}
+
+// Whether another session of the same client transfers the same file
+func (t *sessionTable) duplicate(session *trackedSession) bool {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	for _, other := range t.sessions {
+		if other != session && other.info.Client == session.info.Client &&
+			other.info.File == session.info.File && other.info.Direction == session.info.Direction {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *sessionTable) cancelClient(client string) error {
+	t.mutex.Lock()
+	for _, session := range t.sessions {
+		if session.info.Client == client {
+			cancelled := t.cancel(session)
+			t.mutex.Unlock()
+
+			if cancelled {
+				return session.abort()
+			}
+			return nil
+		}
+	}
+	t.mutex.Unlock()
+
+	return errors.New(fmt.Sprintf("No session for client '%v'", client))
+}
+
+func (t *sessionTable) cancelID(id uint64) error {
+	t.mutex.Lock()
+	session, ok := t.sessions[id]
+	cancelled := ok && t.cancel(session)
+	t.mutex.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("No session with ID %v", id))
+	} else if cancelled {
+		return session.abort()
+	}
+
+	return nil
+}
+
+// Cancel every session and wait until they are removed
+func (t *sessionTable) drain(timeout time.Duration) error {
+	t.mutex.Lock()
+	t.draining = true
+	cancelled := []*trackedSession{}
+	for _, session := range t.sessions {
+		if t.cancel(session) {
+			cancelled = append(cancelled, session)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, session := range cancelled {
+		session.abort()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		t.mutex.Lock()
+		n := len(t.sessions)
+		t.mutex.Unlock()
+
+		if n == 0 {
+			return nil
+		} else if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("%v sessions still running after %v", n, timeout))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Mark session cancelled, returning false when it already was.  The
+// caller must hold the mutex, and then abort the session once it has
+// released the mutex.
+func (t *sessionTable) cancel(session *trackedSession) bool {
+	if session.cancelled {
+		return false
+	}
+
+	session.cancelled = true
+	session.info.State = SessionCancelled
+	close(session.stop)
+	return true
+}
+
+// Tell the client a cancelled session is cancelled, then close the
+// connection of the session to unblock its pending read, which then
+// fails and ends the session.  Multicast transfers, which have no single
+// client, tell their clients themselves once stop is closed.
+func (t *trackedSession) abort() error {
+	if t.rw.remoteAddr == nil {
+		return nil
+	}
+
+	errorPacket := getErrorPacket(UndefinedError, cancelledMessage)
+	t.rw.Write(errorPacket.bytes)
+	return t.rw.Close()
+}
+
+type byClient []SessionInfo
+
+func (b byClient) Len() int           { return len(b) }
+func (b byClient) Less(i, j int) bool { return b[i].Client < b[j].Client }
+func (b byClient) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
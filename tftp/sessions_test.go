@@ -0,0 +1,703 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+var testSizes = []int{0, 1, 511, 512, 513, 1536, 5000}
+
+// A minimal lockstep TFTP client retransmitting on timeouts
+type testClient struct {
+	listen  func() (net.PacketConn, error)
+	server  net.Addr
+	timeout time.Duration
+	retries int
+
+	// Called with the session address once the first reply arrives
+	onTid func(tid net.Addr)
+}
+
+// An error packet received by the client
+type testClientError struct {
+	code uint16
+	msg  string
+}
+
+func (e *testClientError) Error() string {
+	return fmt.Sprintf("Received Error with code %v and message %v", e.code, e.msg)
+}
+
+func newTestClient(network *memnet.Network, server net.Addr) *testClient {
+	return &testClient{
+		listen: func() (net.PacketConn, error) {
+			return network.ListenUDP(nil)
+		},
+		server:  server,
+		timeout: time.Second,
+		retries: 10,
+	}
+}
+
+func requestBytes(opcode uint16, file string) []byte {
+	return append(append(append([]byte{0, byte(opcode)}, file...), 0), append([]byte("octet"), 0)...)
+}
+
+func blockBytes(opcode uint16, block uint16, data []byte) []byte {
+	return append([]byte{0, byte(opcode), byte(block >> 8), byte(block)}, data...)
+}
+
+func (c *testClient) get(file string) ([]byte, error) {
+	var received []byte
+	var expected uint16 = 1
+
+	err := c.exchange(requestBytes(RRQ, file), func(opcode uint16, block uint16, payload []byte) ([]byte, bool) {
+		if opcode != DATA {
+			return nil, false
+		}
+
+		if block == expected {
+			received = append(received, payload...)
+			expected++
+			return blockBytes(ACK, block, nil), len(payload) < dataBlockSize
+		} else if block == expected-1 {
+			return blockBytes(ACK, block, nil), false
+		}
+
+		return nil, false
+	})
+
+	return received, err
+}
+
+func (c *testClient) put(file string, data []byte) error {
+	var acked uint16 = 0
+	lastBlock := uint16(len(data)/dataBlockSize + 1)
+
+	return c.exchange(requestBytes(WRQ, file), func(opcode uint16, block uint16, payload []byte) ([]byte, bool) {
+		if opcode != ACK || block != acked {
+			return nil, false
+		}
+
+		if block == lastBlock {
+			return nil, true
+		}
+
+		acked++
+		start := int(block) * dataBlockSize
+		end := start + dataBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		return blockBytes(DATA, acked, data[start:end]), false
+	})
+}
+
+// Send a request and feed every reply from the session to handle, which
+// returns the next packet to send, if any, and whether the transfer is done.
+// The last packet sent is retransmitted on timeouts.
+func (c *testClient) exchange(request []byte, handle func(opcode uint16, block uint16, payload []byte) ([]byte, bool)) error {
+	conn, err := c.listen()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lastSent, dest := request, c.server
+	var tid net.Addr
+	retries := 0
+	buf := make([]byte, 1024)
+
+	conn.WriteTo(lastSent, dest)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, addr, err := conn.ReadFrom(buf)
+		if isTimeout(err) {
+			if retries++; retries > c.retries {
+				return errors.New("Client gave up after too many timeouts")
+			}
+
+			conn.WriteTo(lastSent, dest)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if tid == nil {
+			tid, dest = addr, addr
+			if c.onTid != nil {
+				c.onTid(tid)
+			}
+		} else if addr.String() != tid.String() {
+			conn.WriteTo(append(blockBytes(ERROR, UnknownTid, []byte("Unknown transfer ID")), 0), addr)
+			continue
+		}
+
+		if n < 4 {
+			return errors.New(fmt.Sprintf("Packet too short: %v", buf[:n]))
+		}
+
+		opcode := binary.BigEndian.Uint16(buf[0:2])
+		block := binary.BigEndian.Uint16(buf[2:4])
+		if opcode == ERROR {
+			return &testClientError{code: block, msg: string(bytes.TrimRight(buf[4:n], "\x00"))}
+		}
+
+		next, done := handle(opcode, block, buf[4:n])
+		if next != nil {
+			lastSent = next
+			retries = 0
+			conn.WriteTo(lastSent, dest)
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+func startTestServer(t *testing.T, network *memnet.Network) (*Server, net.Addr) {
+	server := NewServerWithTransport(NewMemFileServer(), network)
+
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	go server.Serve(conn)
+	return server, conn.LocalAddr()
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	return data
+}
+
+// Sessions linger for timeouts measured on the fake clock, which only
+// advances while everything is idle
+func waitForSessions(t *testing.T, server *Server) {
+	deadline := time.Now().Add(10 * time.Second)
+	for len(server.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Sessions never ended: %v", server.Sessions())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionRead(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+
+	for _, size := range testSizes {
+		name := fmt.Sprintf("file%v", size)
+		server.FileServer().Write(&File{Name: name, Data: testData(size)})
+
+		data, err := newTestClient(network, addr).get(name)
+		if err != nil {
+			t.Errorf("Failed to read %v: %v", name, err)
+		}
+
+		if !bytes.Equal(data, testData(size)) {
+			t.Errorf("Read of %v returned %v bytes, expected %v", name, len(data), size)
+		}
+	}
+
+	waitForSessions(t, server)
+}
+
+func TestSessionWrite(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+
+	for _, size := range testSizes {
+		name := fmt.Sprintf("file%v", size)
+
+		if err := newTestClient(network, addr).put(name, testData(size)); err != nil {
+			t.Errorf("Failed to write %v: %v", name, err)
+		}
+
+		file, err := server.FileServer().Read(name)
+		if err != nil || !bytes.Equal(file.Data, testData(size)) {
+			t.Errorf("Write of %v stored %v bytes, expected %v: %v", name, len(file.Data), size, err)
+		}
+	}
+
+	waitForSessions(t, server)
+}
+
+func TestSessionLossyNetwork(t *testing.T) {
+	conditions := memnet.Conditions{
+		Loss:      0.1,
+		Duplicate: 0.1,
+		Reorder:   0.1,
+		Delay:     5 * time.Millisecond,
+		Jitter:    5 * time.Millisecond,
+	}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		network := memnet.NewNetwork(seed, conditions)
+		server, addr := startTestServer(t, network)
+
+		for _, size := range []int{0, 512, 5000} {
+			name := fmt.Sprintf("file%v", size)
+
+			if err := newTestClient(network, addr).put(name, testData(size)); err != nil {
+				t.Errorf("Seed %v: failed to write %v: %v", seed, name, err)
+			}
+
+			data, err := newTestClient(network, addr).get(name)
+			if err != nil || !bytes.Equal(data, testData(size)) {
+				t.Errorf("Seed %v: read of %v returned %v bytes, expected %v: %v", seed, name, len(data), size, err)
+			}
+		}
+
+		waitForSessions(t, server)
+
+		if stats := network.Stats(); stats.Dropped == 0 || stats.Duplicated == 0 || stats.Reordered == 0 {
+			t.Errorf("Seed %v: expected the network to misbehave, stats: %+v", seed, stats)
+		}
+		network.Close()
+	}
+}
+
+func TestSessionCorruptionNeverWedges(t *testing.T) {
+	network := memnet.NewNetwork(7, memnet.Conditions{Corrupt: 0.05, Loss: 0.05})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "kernel", Data: testData(20000)})
+
+	for i := 0; i < 10; i++ {
+		// Either outcome is fine, as long as both ends give up or finish
+		newTestClient(network, addr).get("kernel")
+		newTestClient(network, addr).put(fmt.Sprintf("dump%v", i), testData(3000))
+	}
+
+	waitForSessions(t, server)
+
+	if network.Stats().Corrupted == 0 {
+		t.Errorf("Expected the network to corrupt packets")
+	}
+}
+
+func TestSessionReadMissingFile(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	_, addr := startTestServer(t, network)
+
+	_, err := newTestClient(network, addr).get("missing")
+	if e, ok := err.(*testClientError); !ok || e.code != FileNotFound {
+		t.Errorf("Expected a file not found error, received: %v", err)
+	}
+}
+
+func TestSessionWriteExistingFile(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(10)})
+
+	err := newTestClient(network, addr).put("foo", testData(20))
+	if e, ok := err.(*testClientError); !ok || e.code != FileExists {
+		t.Errorf("Expected a file exists error, received: %v", err)
+	}
+}
+
+// A file server denying every read
+type deniedFileServer struct {
+	*InMemFileServer
+}
+
+func (s *deniedFileServer) Read(file string) (*File, error) {
+	return nil, NewError(ErrPermission, fmt.Sprintf("Reading '%v' is not allowed", file))
+}
+
+func TestSessionFileServerErrors(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	server := NewServerWithTransport(&deniedFileServer{NewBoundedMemFileServer(1000, 0)}, network)
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(conn)
+
+	err = newTestClient(network, conn.LocalAddr()).put("big", testData(2000))
+	if e, ok := err.(*testClientError); !ok || e.code != DiskFull {
+		t.Errorf("Expected a disk full error, received: %v", err)
+	}
+
+	_, err = newTestClient(network, conn.LocalAddr()).get("secret")
+	if e, ok := err.(*testClientError); !ok || e.code != AccessViolation || e.msg != "Reading 'secret' is not allowed" {
+		t.Errorf("Expected an access violation, received: %v", err)
+	}
+
+	waitForSessions(t, server)
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code uint16
+	}{
+		{&Error{Code: NoSuchUser, Msg: "Who?"}, NoSuchUser},
+		{fmt.Errorf("Wrapped: %w", &Error{Code: IllegalOperation}), IllegalOperation},
+		{NewError(ErrNotExist, "Gone"), FileNotFound},
+		{NewError(ErrExist, "Taken"), FileExists},
+		{NewError(ErrPermission, "Denied"), AccessViolation},
+		{fmt.Errorf("Full: %w", ErrNoSpace), DiskFull},
+		{errors.New("Something else"), UndefinedError},
+	}
+
+	for _, test := range tests {
+		if code := ErrorCode(test.err); code != test.code {
+			t.Errorf("Expected code %v for '%v', received %v", test.code, test.err, code)
+		}
+	}
+
+	var tftpErr *Error
+	if err := (&ReadSession{}).Err(FileNotFound, "Missing"); !errors.As(err, &tftpErr) || tftpErr.Code != FileNotFound || tftpErr.Msg != "Missing" {
+		t.Errorf("Expected a received error packet to be an *Error, received %v", err)
+	}
+}
+
+func TestSessionUnknownTid(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(2000)})
+
+	var strayReply []byte
+	client := newTestClient(network, addr)
+	client.onTid = func(tid net.Addr) {
+		stray, _ := network.ListenUDP(nil)
+		defer stray.Close()
+
+		stray.WriteTo(blockBytes(ACK, 1, nil), tid)
+		buf := make([]byte, 1024)
+		stray.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _, err := stray.ReadFrom(buf); err == nil {
+			strayReply = buf[:n]
+		}
+	}
+
+	data, err := client.get("foo")
+	if err != nil || !bytes.Equal(data, testData(2000)) {
+		t.Errorf("Transfer was disturbed by a stray packet: %v", err)
+	}
+
+	if len(strayReply) < 4 || strayReply[1] != ERROR || strayReply[3] != UnknownTid {
+		t.Errorf("Expected an unknown transfer ID error, received: %v", strayReply)
+	}
+
+	waitForSessions(t, server)
+}
+
+func TestSessionEndsWhenClientVanishes(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(2000)})
+
+	client, _ := network.ListenUDP(nil)
+	client.WriteTo(requestBytes(RRQ, "foo"), addr)
+	client.Close()
+
+	for len(server.Sessions()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waitForSessions(t, server)
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(2000)})
+
+	if err := server.SetTimeouts(0, 1); err == nil {
+		t.Errorf("Expected a zero timeout to be rejected")
+	}
+
+	if err := server.SetTimeouts(10*time.Second, 2); err != nil {
+		t.Fatalf("Failed to set timeouts: %v", err)
+	}
+
+	start := network.Now()
+	client, _ := network.ListenUDP(nil)
+	client.WriteTo(requestBytes(RRQ, "foo"), addr)
+	client.Close()
+
+	for len(server.Sessions()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waitForSessions(t, server)
+
+	// Two timeouts of 10s each
+	if elapsed := network.Now().Sub(start); elapsed < 19*time.Second || elapsed >= 30*time.Second {
+		t.Errorf("Expected the session to give up after 20s, took %v", elapsed)
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(20000)})
+
+	client := newTestClient(network, addr)
+	client.retries = 2
+	done := make(chan error)
+	cancelled := false
+
+	client.onTid = func(tid net.Addr) {
+		for _, session := range server.Sessions() {
+			if err := server.CancelSession(session.Client); err == nil {
+				cancelled = true
+			}
+		}
+	}
+
+	go func() {
+		_, err := client.get("foo")
+		done <- err
+	}()
+
+	if err := <-done; err == nil || !cancelled {
+		t.Errorf("Expected the cancelled transfer to fail, cancelled: %v, err: %v", cancelled, err)
+	}
+
+	waitForSessions(t, server)
+}
+
+func TestSessionRegistry(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(20000)})
+
+	// The client cancels the session once it is under way
+	client := newTestClient(network, addr)
+	var cancelErr error
+	var info SessionInfo
+	blocks := 0
+	err := client.exchange(requestBytes(RRQ, "foo"), func(opcode uint16, block uint16, payload []byte) ([]byte, bool) {
+		if opcode != DATA {
+			return nil, true
+		}
+
+		if blocks++; blocks == 3 {
+			sessions := server.Sessions()
+			if len(sessions) != 1 {
+				t.Fatalf("Expected one session, received %v", sessions)
+			}
+			info, _ = server.Session(sessions[0].ID)
+			cancelErr = server.CancelSessionByID(info.ID)
+		}
+
+		return blockBytes(ACK, block, nil), false
+	})
+
+	if info.ID == 0 || info.File != "foo" || info.State != SessionTransferring || info.Block != 2 || info.Bytes != 2*dataBlockSize || info.Start.IsZero() {
+		t.Errorf("Unexpected session info: %+v", info)
+	}
+
+	if cancelErr != nil {
+		t.Errorf("Failed to cancel: %v", cancelErr)
+	}
+
+	if e, ok := err.(*testClientError); !ok || e.code != UndefinedError {
+		t.Errorf("Expected the client to be told of the cancellation, received: %v", err)
+	}
+
+	waitForSessions(t, server)
+
+	if _, ok := server.Session(info.ID); ok {
+		t.Errorf("Expected the cancelled session to be gone")
+	}
+
+	if err := server.CancelSessionByID(info.ID); err == nil {
+		t.Errorf("Expected cancelling a finished session to fail")
+	}
+}
+
+// Write the first blocks of file, calling during with the server part way
+// through, then end the transfer with an error packet
+func abandonPut(network *memnet.Network, addr net.Addr, file string, during func()) error {
+	return newTestClient(network, addr).exchange(requestBytes(WRQ, file), func(opcode uint16, block uint16, payload []byte) ([]byte, bool) {
+		if opcode != ACK {
+			return nil, false
+		}
+
+		if block == 3 {
+			during()
+			return append(blockBytes(ERROR, UndefinedError, []byte("Giving up")), 0), true
+		}
+
+		return blockBytes(DATA, block+1, testData(dataBlockSize)), false
+	})
+}
+
+func TestSessionStagedWrite(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTestServer(t, network)
+
+	abandonPut(network, addr, "foo", func() {
+		_, err := newTestClient(network, addr).get("foo")
+		if e, ok := err.(*testClientError); !ok || e.code != FileNotFound {
+			t.Errorf("Expected an upload in progress to be invisible, received: %v", err)
+		}
+
+		err = newTestClient(network, addr).put("foo", testData(10))
+		if e, ok := err.(*testClientError); !ok || e.code != FileExists {
+			t.Errorf("Expected a second upload of the same file to be refused, received: %v", err)
+		}
+	})
+
+	waitForSessions(t, server)
+
+	if server.FileServer().FileExists("foo") || server.FileServer().Reap() != 0 {
+		t.Errorf("Expected the abandoned upload to be aborted")
+	}
+
+	if err := newTestClient(network, addr).put("foo", testData(10)); err != nil {
+		t.Errorf("Failed to write after the abandoned upload: %v", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server := NewServerWithTransport(NewMemFileServer(), network)
+
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(conn) }()
+	addr := conn.LocalAddr()
+
+	client := newTestClient(network, addr)
+	client.retries = 2
+	var shutdownErr error
+	err = client.exchange(requestBytes(WRQ, "foo"), func(opcode uint16, block uint16, payload []byte) ([]byte, bool) {
+		if opcode == ACK && block == 2 {
+			shutdownErr = server.Shutdown(5 * time.Second)
+		}
+
+		return blockBytes(DATA, block+1, testData(dataBlockSize)), false
+	})
+
+	if shutdownErr != nil {
+		t.Errorf("Failed to shut down: %v", shutdownErr)
+	}
+
+	if e, ok := err.(*testClientError); !ok || e.code != UndefinedError {
+		t.Errorf("Expected the client to be told of the shutdown, received: %v", err)
+	}
+
+	if len(server.Sessions()) != 0 || server.FileServer().FileExists("foo") || server.FileServer().Reap() != 0 {
+		t.Errorf("Expected the upload to be aborted by the shutdown")
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected serving to end with %v, received: %v", ErrServerClosed, err)
+	}
+
+	// No request is served once shut down
+	conn, _ = network.Listen("127.0.0.1:70")
+	if err := server.Serve(conn); err != ErrServerClosed {
+		t.Errorf("Expected serving after the shutdown to fail, received: %v", err)
+	}
+}
+
+// Sessions starting while the server shuts down are cancelled at once
+func TestSessionTableDrainCancelsLateSessions(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	conn, _ := network.Listen("127.0.0.1:69")
+	table := newSessionTable()
+	table.drain(0)
+
+	session := table.add(SessionInfo{Client: "127.0.0.1:1000"}, NewTftpReaderWriterFromConn(conn, nil, true))
+	if !table.isCancelled(session) {
+		t.Errorf("Expected a session started while draining to be cancelled")
+	}
+}
+
+// Uploads staged before serving starts were abandoned by a previous run
+func TestServeReapsUploads(t *testing.T) {
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+
+	fileServ := NewMemFileServer()
+	fileServ.Stage("foo")
+	server := NewServerWithTransport(fileServ, network)
+
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(conn)
+
+	if err := newTestClient(network, conn.LocalAddr()).put("foo", testData(10)); err != nil {
+		t.Errorf("Expected the abandoned upload to be reaped, received: %v", err)
+	}
+}
+
+func TestSessionUnixTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tftp-test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	transport := &UnixTransport{Dir: dir}
+	server := NewServerWithTransport(NewMemFileServer(), transport)
+	server.FileServer().Write(&File{Name: "foo", Data: testData(2000)})
+
+	conn, err := transport.Listen(filepath.Join(dir, "server"))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go server.Serve(conn)
+
+	client := &testClient{
+		listen: func() (net.PacketConn, error) {
+			return transport.SessionConn(nil, nil)
+		},
+		server:  conn.LocalAddr(),
+		timeout: time.Second,
+		retries: 3,
+	}
+
+	data, err := client.get("foo")
+	if err != nil || !bytes.Equal(data, testData(2000)) {
+		t.Errorf("Read over Unix sockets returned %v bytes, expected 2000: %v", len(data), err)
+	}
+}
@@ -0,0 +1,274 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"time"
+)
+
+// Tracer sees every packet a server sends or receives
+type Tracer interface {
+	Trace(packet *TracedPacket)
+}
+
+type TracedPacket struct {
+	Time time.Time
+	From net.Addr
+	To   net.Addr
+
+	// Whether the server sent the packet rather than received it
+	Sent bool
+
+	// Name of the file being transferred, empty when not known, e.g. for
+	// packets to the listening port other than requests
+	File string
+
+	// The packet, only valid during the call to Trace
+	Bytes []byte
+}
+
+// The client end of the packet
+func (p *TracedPacket) Client() net.Addr {
+	if p.Sent {
+		return p.To
+	}
+
+	return p.From
+}
+
+// TraceFilter selects the packets a PacketTracer records
+type TraceFilter struct {
+	// IP address of the only client to trace, or a CIDR subnet of clients
+	Client string
+
+	// A path.Match pattern for the files to trace
+	File string
+}
+
+// PacketTracer writes packets to a pcap file readable by Wireshark and
+// tcpdump, and decoded one per line to a log.  Either may be nil.
+type PacketTracer struct {
+	mutex  sync.Mutex
+	pcap   io.Writer
+	log    io.Writer
+	filter TraceFilter
+	subnet *net.IPNet
+	buf    []byte
+	record [16]byte
+}
+
+// pcap link type for packets starting with an IPv4 or IPv6 header
+const linkTypeRaw = 101
+
+func NewPacketTracer(pcap io.Writer, log io.Writer, filter TraceFilter) (*PacketTracer, error) {
+	t := &PacketTracer{
+		pcap:   pcap,
+		log:    log,
+		filter: filter,
+	}
+
+	subnet, err := parseClientSubnet(filter.Client)
+	if err != nil {
+		return nil, err
+	}
+	t.subnet = subnet
+
+	if _, err := path.Match(filter.File, ""); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid file pattern '%v': %v", filter.File, err))
+	}
+
+	if pcap != nil {
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], 65535)
+		binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+		if _, err := pcap.Write(header); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *PacketTracer) Trace(p *TracedPacket) {
+	file := p.File
+	if file == "" {
+		file = requestedFile(p.Bytes)
+	}
+
+	if !t.matches(p.Client(), file) {
+		return
+	}
+
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	if t.log != nil {
+		fmt.Fprintf(t.log, "%v %v -> %v %v\n", p.Time.Format("15:04:05.000000"), p.From, p.To, decode(p.Bytes))
+	}
+
+	if t.pcap != nil {
+		t.writePcap(p)
+	}
+}
+
+func (t *PacketTracer) matches(client net.Addr, file string) bool {
+	if !subnetContains(t.subnet, client) {
+		return false
+	}
+
+	if t.filter.File != "" {
+		if ok, _ := path.Match(t.filter.File, file); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parse an IP address or CIDR subnet of clients, nil for every client
+// when empty
+func parseClientSubnet(client string) (*net.IPNet, error) {
+	if client == "" {
+		return nil, nil
+	}
+
+	if _, subnet, err := net.ParseCIDR(client); err == nil {
+		return subnet, nil
+	} else if ip := net.ParseIP(client); ip != nil {
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Invalid client '%v', expected an IP address or CIDR subnet", client))
+}
+
+// Whether client is in subnet, which holds every client when nil
+func subnetContains(subnet *net.IPNet, client net.Addr) bool {
+	if subnet == nil {
+		return true
+	}
+
+	udpAddr, ok := client.(*net.UDPAddr)
+	return ok && subnet.Contains(udpAddr.IP)
+}
+
+// Packets are wrapped in made up IP and UDP headers.  Only UDP packets
+// can be written this way, others only go to the log.
+func (t *PacketTracer) writePcap(p *TracedPacket) {
+	from, okFrom := p.From.(*net.UDPAddr)
+	to, okTo := p.To.(*net.UDPAddr)
+	if !okFrom || !okTo {
+		return
+	}
+
+	t.buf = appendIPPacket(t.buf[:0], from, to, p.Bytes)
+
+	record := t.record[:]
+	binary.LittleEndian.PutUint32(record[0:], uint32(p.Time.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(p.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(t.buf)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(t.buf)))
+	t.pcap.Write(record)
+	t.pcap.Write(t.buf)
+}
+
+// Packets are written as IPv4 whenever the client is IPv4.  An end on an
+// unspecified address, like a socket listening on "::" serving IPv4
+// clients, takes the address family of the other end.
+func appendIPPacket(b []byte, from *net.UDPAddr, to *net.UDPAddr, payload []byte) []byte {
+	src, dst := from.IP.To4(), to.IP.To4()
+	v4 := (src != nil || dst != nil) && (src != nil || unspecified(from.IP)) && (dst != nil || unspecified(to.IP))
+	if !v4 {
+		src, dst = from.IP.To16(), to.IP.To16()
+	}
+
+	if src == nil || src.IsUnspecified() {
+		src = make(net.IP, len(dst))
+	}
+
+	if dst == nil || dst.IsUnspecified() {
+		dst = make(net.IP, len(src))
+	}
+
+	udpLen := 8 + len(payload)
+	if v4 {
+		b = append(b, 0x45, 0, byte((20+udpLen)>>8), byte(20+udpLen), 0, 0, 0x40, 0, 64, 17, 0, 0)
+		b = append(append(b, src...), dst...)
+		sum := checksum(0, b[len(b)-20:])
+		b[len(b)-10], b[len(b)-9] = byte(sum>>8), byte(sum)
+	} else {
+		b = append(b, 0x60, 0, 0, 0, byte(udpLen>>8), byte(udpLen), 17, 64)
+		b = append(append(b, src...), dst...)
+	}
+
+	udp := len(b)
+	b = appendTwoByteInt(b, uint16(from.Port))
+	b = appendTwoByteInt(b, uint16(to.Port))
+	b = appendTwoByteInt(b, uint16(udpLen))
+	b = append(b, 0, 0)
+	b = append(b, payload...)
+
+	// The UDP checksum covers a pseudo header of the addresses, protocol
+	// and length
+	pseudo := append(append(append([]byte{}, src...), dst...), 0, 17, byte(udpLen>>8), byte(udpLen))
+	sum := checksum(checksumAdd(0, pseudo), b[udp:])
+	if sum == 0 {
+		sum = 0xffff
+	}
+	b[udp+6], b[udp+7] = byte(sum>>8), byte(sum)
+
+	return b
+}
+
+func unspecified(ip net.IP) bool {
+	return len(ip) == 0 || ip.IsUnspecified()
+}
+
+// Internet checksum of b continuing from a partial sum
+func checksum(sum uint32, b []byte) uint16 {
+	sum = checksumAdd(sum, b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	return sum
+}
+
+func decode(b []byte) string {
+	if p, err := ParsePacket(b); err == nil {
+		return fmt.Sprint(p)
+	}
+
+	return fmt.Sprintf("malformed %q", b)
+}
+
+// The file named by a request, empty for other packets
+func requestedFile(b []byte) string {
+	switch p, _ := ParsePacket(b); p := p.(type) {
+	case *ReadRequest:
+		return p.Filename
+	case *WriteRequest:
+		return p.Filename
+	}
+
+	return ""
+}
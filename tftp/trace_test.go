@@ -0,0 +1,166 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+	"github.com/gabrielhartmann/tftp/tftp/memnet"
+)
+
+func startTracedServer(t *testing.T, network *memnet.Network, tracer Tracer) (*Server, net.Addr) {
+	server := NewServerWithTransport(NewMemFileServer(), network)
+	server.SetTracer(tracer)
+
+	conn, err := network.Listen("127.0.0.1:69")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	go server.Serve(conn)
+	return server, conn.LocalAddr()
+}
+
+func TestTracePcap(t *testing.T) {
+	pcap := &bytes.Buffer{}
+	tracer, err := NewPacketTracer(pcap, nil, TraceFilter{})
+	if err != nil {
+		t.Fatalf("Failed to create tracer: %v", err)
+	}
+
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTracedServer(t, network, tracer)
+	server.FileServer().Write(&File{Name: "kernel", Data: testData(1000)})
+
+	if _, err := newTestClient(network, addr).get("kernel"); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	waitForSessions(t, server)
+
+	b := pcap.Bytes()
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != linkTypeRaw {
+		t.Fatalf("Invalid pcap header: %v", b)
+	}
+
+	// RRQ, two DATA blocks and their ACKs
+	expected := []string{"RRQ 'kernel' octet", "DATA 1 of 512 bytes", "ACK 1", "DATA 2 of 488 bytes", "ACK 2"}
+	received := []string{}
+	for b = b[24:]; len(b) >= 16; {
+		length := int(binary.LittleEndian.Uint32(b[8:]))
+		packet := b[16 : 16+length]
+		b = b[16+length:]
+
+		if packet[0] != 0x45 || packet[9] != 17 || checksum(0, packet[:20]) != 0 {
+			t.Fatalf("Invalid IPv4 header: %v", packet[:20])
+		}
+
+		udp := packet[20:]
+		pseudo := append(append([]byte{}, packet[12:20]...), 0, 17, udp[4], udp[5])
+		if checksum(checksumAdd(0, pseudo), udp) != 0 {
+			t.Errorf("Invalid UDP checksum in %v", udp)
+		}
+
+		if int(binary.BigEndian.Uint16(udp[4:])) != len(udp) {
+			t.Errorf("UDP length %v of %v bytes", binary.BigEndian.Uint16(udp[4:]), len(udp))
+		}
+
+		received = append(received, decode(udp[8:]))
+	}
+
+	if strings.Join(received, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected packets %v, received %v", expected, received)
+	}
+}
+
+// A server listening on "::" traces its IPv4 clients as IPv4
+func TestTraceIPv4ClientOfDualStackSocket(t *testing.T) {
+	server := &net.UDPAddr{IP: net.IPv6unspecified, Port: 69}
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.5"), Port: 2000}
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 2000}
+	v6 := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 2000}
+
+	for _, c := range []struct {
+		from, to *net.UDPAddr
+		version  byte
+	}{
+		{client, server, 4},
+		{server, mapped, 4},
+		{mapped, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 69}, 4},
+		{v6, server, 6},
+		{server, v6, 6},
+	} {
+		packet := appendIPPacket(nil, c.from, c.to, []byte{0, 4, 0, 1})
+		if packet[0]>>4 != c.version {
+			t.Errorf("Expected IPv%v from %v to %v, received %v", c.version, c.from, c.to, packet)
+		}
+
+		if c.version != 4 {
+			continue
+		}
+
+		// The client keeps its address, mapped or not
+		v4 := client.IP.To4()
+		if checksum(0, packet[:20]) != 0 || !bytes.Equal(packet[12:16], v4) && !bytes.Equal(packet[16:20], v4) {
+			t.Errorf("Invalid IPv4 header from %v to %v: %v", c.from, c.to, packet[:20])
+		}
+	}
+}
+
+func TestTraceLogFilteredByFile(t *testing.T) {
+	log := &bytes.Buffer{}
+	tracer, err := NewPacketTracer(nil, log, TraceFilter{File: "boot/*"})
+	if err != nil {
+		t.Fatalf("Failed to create tracer: %v", err)
+	}
+
+	network := memnet.NewNetwork(1, memnet.Conditions{})
+	defer network.Close()
+	server, addr := startTracedServer(t, network, tracer)
+
+	newTestClient(network, addr).put("boot/kernel", testData(100))
+	newTestClient(network, addr).put("other", testData(100))
+	newTestClient(network, addr).get("boot/missing")
+	waitForSessions(t, server)
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	expected := []string{"WRQ 'boot/kernel' octet", "ACK 0", "DATA 1 of 100 bytes", "ACK 1", "RRQ 'boot/missing' octet", "ERROR 1"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %v lines, received:\n%v", len(expected), log)
+	}
+
+	for i, line := range lines {
+		if !strings.Contains(line, expected[i]) || !strings.Contains(line, " -> ") {
+			t.Errorf("Expected line %v to hold %v, received: %v", i, expected[i], line)
+		}
+	}
+}
+
+func TestTraceFilteredByClient(t *testing.T) {
+	log := &bytes.Buffer{}
+	tracer, err := NewPacketTracer(nil, log, TraceFilter{Client: "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Failed to create tracer: %v", err)
+	}
+
+	server := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 69}
+	for _, client := range []*net.UDPAddr{{IP: net.IPv4(10, 1, 2, 3), Port: 5000}, {IP: net.IPv4(11, 1, 2, 3), Port: 5000}} {
+		tracer.Trace(&TracedPacket{From: client, To: server, Bytes: []byte{0, ACK, 0, 1}})
+		tracer.Trace(&TracedPacket{From: server, To: client, Sent: true, Bytes: []byte{0, ACK, 0, 2}})
+	}
+
+	if lines := strings.Count(log.String(), "\n"); lines != 2 || strings.Contains(log.String(), "11.1.2.3") {
+		t.Errorf("Expected both packets of 10.1.2.3 and none of 11.1.2.3, received:\n%v", log)
+	}
+}
+
+func TestTraceFilterNegative(t *testing.T) {
+	for _, filter := range []TraceFilter{{Client: "nonsense"}, {Client: "10.0.0.0/99"}, {File: "["}} {
+		if _, err := NewPacketTracer(nil, nil, filter); err == nil {
+			t.Errorf("Expected filter %+v to be rejected", filter)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Transport opens the packet connections the server runs on: one per
+// listening address for requests, and one per read or write session whose
+// address becomes the transfer ID of the session.  localAddr is the
+// address the request was sent to, which the session should answer from.
+type Transport interface {
+	Listen(addr string) (net.PacketConn, error)
+	SessionConn(localAddr net.Addr, remoteAddr net.Addr) (net.PacketConn, error)
+}
+
+// UDPTransport is the default transport.  Each session gets its own UDP
+// port, an ephemeral one unless MinPort and MaxPort restrict sessions to
+// that inclusive range, e.g. to allow tight firewall rules.  Session
+// sockets are bound to the IP address the request arrived on, which
+// multi-homed hosts need as clients reject replies from other addresses.
+type UDPTransport struct {
+	MinPort int
+	MaxPort int
+
+	mutex    sync.Mutex
+	nextPort int
+	inUse    map[int]bool
+}
+
+// Implemented by transports which can listen on sockets they didn't open
+type connAdopter interface {
+	Adopt(conn net.PacketConn) (net.PacketConn, error)
+}
+
+var ErrPortRangeExhausted = errors.New("No free transfer port left in the configured range")
+
+// ParsePortRange parses an inclusive range of ports such as 50000-50100
+// into the MinPort and MaxPort of a UDPTransport
+func ParsePortRange(s string) (int, int, error) {
+	var min, max int
+	if _, err := fmt.Sscanf(s, "%d-%d", &min, &max); err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("Invalid port range '%v', expected e.g. 50000-50100", s))
+	}
+
+	if min <= 0 || min > max || max > 65535 {
+		return 0, 0, errors.New(fmt.Sprintf("Invalid port range '%v'", s))
+	}
+
+	return min, max, nil
+}
+
+func (t *UDPTransport) Listen(addr string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket(udpNetwork(addr), addr)
+	if err != nil {
+		logrus.Infof("Failed to UDP listen: %v", err)
+		return nil, err
+	}
+
+	return withPktinfo(conn), nil
+}
+
+// Adopt prepares a socket opened elsewhere, e.g. inherited from systemd
+// or inetd, for listening as if it was opened by Listen
+func (t *UDPTransport) Adopt(conn net.PacketConn) (net.PacketConn, error) {
+	return withPktinfo(conn), nil
+}
+
+func (t *UDPTransport) SessionConn(localAddr net.Addr, remoteAddr net.Addr) (net.PacketConn, error) {
+	host := ""
+	if udpAddr, ok := localAddr.(*net.UDPAddr); ok && !udpAddr.IP.IsUnspecified() {
+		host = udpAddr.IP.String()
+		if udpAddr.Zone != "" {
+			host += "%" + udpAddr.Zone
+		}
+	}
+
+	if t.MinPort <= 0 || t.MaxPort <= 0 {
+		return t.listenSession(host, 0)
+	}
+
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	if t.inUse == nil {
+		t.inUse = make(map[int]bool)
+	}
+
+	// Walk the range once starting after the last allocated port, skipping
+	// ports held by our own sessions and retrying ports taken by others
+	total := t.MaxPort - t.MinPort + 1
+	for i := 0; i < total; i++ {
+		if t.nextPort < t.MinPort || t.nextPort > t.MaxPort {
+			t.nextPort = t.MinPort
+		}
+
+		port := t.nextPort
+		t.nextPort++
+
+		if t.inUse[port] {
+			continue
+		}
+
+		conn, err := t.listenSession(host, port)
+		if err != nil {
+			logrus.Infof("Transfer port %v unavailable: %v", port, err)
+			continue
+		}
+
+		t.inUse[port] = true
+		return &rangePortConn{PacketConn: conn, transport: t, port: port}, nil
+	}
+
+	logrus.Errorf("All %v transfer ports between %v and %v are in use", total, t.MinPort, t.MaxPort)
+	return nil, ErrPortRangeExhausted
+}
+
+func (t *UDPTransport) listenSession(host string, port int) (net.PacketConn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	return net.ListenPacket(udpNetwork(addr), addr)
+}
+
+// PortUsage reports how many ports of the range are held by sessions and
+// how large the range is.  Without a range both are 0.
+func (t *UDPTransport) PortUsage() (inUse int, total int) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	if t.MinPort <= 0 || t.MaxPort <= 0 {
+		return 0, 0
+	}
+
+	return len(t.inUse), t.MaxPort - t.MinPort + 1
+}
+
+func (t *UDPTransport) release(port int) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+
+	delete(t.inUse, port)
+}
+
+// Returns its port to the range when closed
+type rangePortConn struct {
+	net.PacketConn
+	transport *UDPTransport
+	port      int
+	closeOnce sync.Once
+}
+
+func (c *rangePortConn) Close() error {
+	err := c.PacketConn.Close()
+	c.closeOnce.Do(func() {
+		c.transport.release(c.port)
+	})
+
+	return err
+}
+
+// UnixTransport runs TFTP over Unix datagram sockets, e.g. for local
+// tooling.  Session sockets are created in Dir, or the system's temporary
+// directory if Dir is empty, and removed when closed.  Clients must bind
+// their own socket to receive replies.
+type UnixTransport struct {
+	Dir string
+}
+
+func (t *UnixTransport) Listen(addr string) (net.PacketConn, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &removingUnixConn{UnixConn: conn, path: addr}, nil
+}
+
+func (t *UnixTransport) SessionConn(localAddr net.Addr, remoteAddr net.Addr) (net.PacketConn, error) {
+	// Reserve a unique name, then replace the placeholder file with the socket
+	file, err := ioutil.TempFile(t.Dir, "tftp-session-")
+	if err != nil {
+		return nil, err
+	}
+
+	path := file.Name()
+	file.Close()
+	if err = os.Remove(path); err != nil {
+		return nil, err
+	}
+
+	return t.Listen(filepath.Clean(path))
+}
+
+// Unlike stream listeners, datagram sockets leave their file behind
+type removingUnixConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *removingUnixConn) Close() error {
+	err := c.UnixConn.Close()
+	if removeErr := os.Remove(c.path); removeErr != nil && err == nil && !os.IsNotExist(removeErr) {
+		return errors.New(fmt.Sprintf("Failed to remove socket '%v': %v", c.path, removeErr))
+	}
+
+	return err
+}
@@ -0,0 +1,116 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/gabrielhartmann/tftp/fileserv"
+)
+
+// Find a free port to base a range on
+func freePort(t *testing.T) int {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestPortRangeAllocation(t *testing.T) {
+	port := freePort(t)
+	transport := &UDPTransport{MinPort: port, MaxPort: port + 2}
+
+	// A port taken by someone else is skipped
+	other, err := net.ListenPacket("udp", fmt.Sprintf(":%v", port+1))
+	if err != nil {
+		t.Fatalf("Failed to occupy port %v: %v", port+1, err)
+	}
+	defer other.Close()
+
+	first, err := transport.SessionConn(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to allocate a port: %v", err)
+	}
+
+	second, err := transport.SessionConn(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to allocate a port: %v", err)
+	}
+
+	ports := []int{first.LocalAddr().(*net.UDPAddr).Port, second.LocalAddr().(*net.UDPAddr).Port}
+	if ports[0] != port || ports[1] != port+2 {
+		t.Errorf("Expected ports %v and %v, received %v", port, port+2, ports)
+	}
+
+	if inUse, total := transport.PortUsage(); inUse != 2 || total != 3 {
+		t.Errorf("Expected 2 of 3 ports in use, received %v of %v", inUse, total)
+	}
+
+	if _, err = transport.SessionConn(nil, nil); err != ErrPortRangeExhausted {
+		t.Errorf("Expected the range to be exhausted, received: %v", err)
+	}
+
+	first.Close()
+	if inUse, _ := transport.PortUsage(); inUse != 1 {
+		t.Errorf("Expected 1 port in use after close, received %v", inUse)
+	}
+
+	third, err := transport.SessionConn(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to reallocate a released port: %v", err)
+	}
+	third.Close()
+	second.Close()
+}
+
+func TestPortRangeExhaustedRequestFails(t *testing.T) {
+	port := freePort(t)
+	server := NewServerWithTransport(NewMemFileServer(), &UDPTransport{MinPort: port, MaxPort: port})
+	server.FileServer().Write(&File{Name: "foo", Data: testData(2000)})
+	auditor := make(recordingAuditor, 10)
+	server.SetAuditor(auditor)
+
+	conn, err := server.Transport().Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+	go server.Serve(conn)
+
+	// The first client takes the only port and stalls after the first block
+	stalled, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer stalled.Close()
+	stalled.WriteTo(requestBytes(RRQ, "foo"), conn.LocalAddr())
+
+	buf := make([]byte, 1024)
+	stalled.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = stalled.ReadFrom(buf); err != nil {
+		t.Fatalf("Expected the first block, received: %v", err)
+	}
+
+	_, err = newUDPTestClient(conn.LocalAddr()).get("foo")
+	if e, ok := err.(*testClientError); !ok || e.code != UndefinedError || !strings.Contains(e.msg, ErrPortRangeExhausted.Error()) {
+		t.Errorf("Expected a port range exhausted error, received: %v", err)
+	}
+	record := auditor.next(t)
+	if record.File != "foo" || record.Outcome != OutcomeFailed || record.ErrorCode == nil || *record.ErrorCode != UndefinedError {
+		t.Errorf("Unexpected record of a refused read: %+v", record)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	if min, max, err := ParsePortRange("50000-50100"); err != nil || min != 50000 || max != 50100 {
+		t.Errorf("Expected 50000 to 50100, received %v to %v with error %v", min, max, err)
+	}
+
+	for _, s := range []string{"", "50000", "a-b", "0-10", "100-50", "65000-65536"} {
+		if _, _, err := ParsePortRange(s); err == nil {
+			t.Errorf("Expected port range '%v' to be rejected", s)
+		}
+	}
+}
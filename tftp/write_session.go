@@ -11,45 +11,87 @@ import (
 
 type WriteSession struct {
 	rw           *TftpReaderWriter
-	fileServ     FileServer
+	server       *Server
+	tracked      *trackedSession
+	upload       Upload
 	block        uint16
 	fileName     string
-	dataBuffer   []byte
+	bytes        int
+	digests      uploadDigests
+	ackBuf       [4]byte
 	fileComplete bool
 	timeoutCount int
 }
 
-var logPrefix string
+// StartNewWriteSession runs a write session over rw, which the session
+// closes when done.  The file is staged until its last block arrives, so
+// it is only ever seen complete, and a session ending any other way
+// aborts it.
+func StartNewWriteSession(rw *TftpReaderWriter, file string, mode string, server *Server) (err error) {
+	fileServ := server.FileServer()
+	remoteAddr := rw.remoteAddr
+	defer rw.release()
+	defer rw.Close()
+
+	var writeSession *WriteSession
+	record := newAuditRecord(remoteAddr, file, DirectionWrite, mode)
+	defer func() {
+		bytes := 0
+		if writeSession != nil {
+			bytes = writeSession.bytes
+		}
+		server.audit(record, bytes, err)
+	}()
 
-func StartNewWriteSession(remoteAddr *net.UDPAddr, file string, fileServ FileServer) error {
-	// Create TftpReaderWriter
-	rw, err := NewTftpReaderWriter(remoteAddr, true)
+	digests, err := newUploadDigests(server.integrity)
 	if err != nil {
-		return err
+		return HandleError(rw, UndefinedError, err.Error())
 	}
 
-	if fileServ.FileExists(file) {
-		return HandleError(rw, FileExists, fmt.Sprintf("File '%v' already exists", file))
+	tracked := server.sessions.add(SessionInfo{
+		Client:    remoteAddr.String(),
+		File:      file,
+		Direction: DirectionWrite,
+	}, rw)
+	defer server.sessions.remove(tracked)
+
+	upload, err := fileServ.Stage(file)
+	if err != nil {
+		// A duplicated request finds the file staged by the session of
+		// the original, which is left to serve the client
+		if errors.Is(err, ErrExist) && server.sessions.duplicate(tracked) {
+			logrus.Infof("%v: Ignoring duplicate request for '%v'", tracked.logPrefix("Write Session"), file)
+			return errors.New(fmt.Sprintf("Duplicate request for '%v'", file))
+		}
+
+		return handleFileError(rw, err)
 	}
+	defer upload.Abort()
 
-	writeSession := &WriteSession{
+	writeSession = &WriteSession{
 		rw:           rw,
-		fileServ:     fileServ,
+		server:       server,
+		tracked:      tracked,
+		upload:       upload,
 		block:        0,
 		fileName:     file,
-		dataBuffer:   []byte{},
+		digests:      digests,
 		fileComplete: false,
 		timeoutCount: 0,
 	}
 
-	logrus.Infof("[Write Session %v]: Start for file '%v'", remoteAddr.Port, file)
+	logrus.Infof("%v: Start for file '%v'", tracked.logPrefix("Write Session"), file)
 
 	// Main work loop with bounded timeouts
-	for writeSession.timeoutCount < timeoutCountMax {
+	for writeSession.timeoutCount < server.retries {
 		if err = writeSession.Start(); err != nil {
 			if isTimeout(err) {
-				logrus.Infof("[Write Session %v]: timeout %d", remoteAddr.Port, writeSession.timeoutCount)
+				logrus.Infof("%v: timeout %d", tracked.logPrefix("Write Session"), writeSession.timeoutCount)
 				writeSession.timeoutCount++
+				server.sessions.retransmit(writeSession.tracked)
+			} else if server.sessions.isCancelled(writeSession.tracked) {
+				logrus.Infof("%v: cancelled", tracked.logPrefix("Write Session"))
+				return errors.New(fmt.Sprintf("Write session for '%v' cancelled", file))
 			} else {
 				return err
 			}
@@ -72,81 +114,104 @@ func (s *WriteSession) Start() error {
 	// with fewer than 512 bytes.  See the Data() method below
 	for {
 		if s.fileComplete {
-			logrus.Infof("[Write Session]: completed file: '%v'", s.fileName)
+			logrus.Infof("%v: completed file: '%v'", s.tracked.logPrefix("Write Session"), s.fileName)
+			s.server.sessions.setState(s.tracked, SessionDallying)
+			s.dally()
 			return nil
 		}
 
 		if bytes, _, err := s.rw.Read(); err != nil {
 			return err
 		} else {
-			if err := HandleTftpPackets(s, s.rw.remoteAddr, bytes); err != nil {
+			if err := HandleTftpPackets(s, s.rw.remoteAddr, bytes); isMalformed(err) {
+				return HandleError(s.rw, IllegalOperation, err.Error())
+			} else if err != nil {
 				return err
 			}
 		}
 	}
 }
 
-// Generate the next ACK packet
-func (s *WriteSession) getAckPacket() (*AckPacket, error) {
-	if bytes, err := convertIntToBytes(s.block); err != nil {
-		return nil, err
-	} else {
-		blockArr := [2]byte{bytes[0], bytes[1]}
-		return NewAckPacket(blockArr), nil
+// Wait out one timeout after the final ACK in case it was lost and the
+// client retransmits its last block
+func (s *WriteSession) dally() {
+	for {
+		if bytes, _, err := s.rw.Read(); err != nil {
+			return
+		} else {
+			HandleTftpPackets(s, s.rw.remoteAddr, bytes)
+		}
 	}
 }
 
 // Write the next ACK packet
 func (s *WriteSession) writeAck() error {
-	if ack, err := s.getAckPacket(); err != nil {
-		return err
-	} else {
-		_, err = s.rw.Write(ack.bytes)
-		return err
-	}
+	_, err := s.rw.Write(appendAckPacket(s.ackBuf[:0], s.block))
+	return err
 }
 
-func (s *WriteSession) ReadReq(addr *net.UDPAddr, file string, mode string) error {
+func (s *WriteSession) ReadReq(addr net.Addr, file string, mode string, options map[string]string) error {
 	return errors.New("ReadReq operations are not supported on read handlers")
 }
 
-func (s *WriteSession) WriteReq(addr *net.UDPAddr, file string, mode string) error {
+func (s *WriteSession) WriteReq(addr net.Addr, file string, mode string, options map[string]string) error {
 	return errors.New("WriteReq operations are not supported on read handlers")
 }
 
 func (s *WriteSession) Data(block uint16, data []byte) error {
-	if block == s.block+1 {
-		s.dataBuffer = append(s.dataBuffer, data...)
-		s.block++
-	} else {
-		return errors.New(fmt.Sprintf("Expected block %v, received %v", s.block+1, block))
+	// A repeat of the last block means our ACK was lost.  Anything
+	// else out of sequence is a stale duplicate and is ignored.
+	if block == s.block {
+		return s.writeAck()
+	} else if block != s.block+1 || s.fileComplete {
+		logrus.Infof("%v: Expected block %v, received %v", s.tracked.logPrefix("Write Session"), s.block+1, block)
+		return nil
+	}
+
+	if len(data) > dataBlockSize {
+		return HandleError(s.rw, IllegalOperation, fmt.Sprintf("Data block of %v bytes exceeds %v bytes", len(data), dataBlockSize))
 	}
 
-	s.writeAck()
+	if err := s.upload.Write(data); err != nil {
+		return handleFileError(s.rw, err)
+	}
+
+	s.bytes += len(data)
+	s.digests.write(data)
+	s.block++
+	s.timeoutCount = 0
+	s.server.sessions.progress(s.tracked, s.block, s.bytes)
+
+	// Holding back the ACK paces the client
+	s.server.limiter.wait(s.rw.remoteAddr, s.tracked.info.ID, s.fileName, len(data), s.tracked.stop, s.rw.deadline/2)
 
+	// The file is committed before the final ACK so that a client seeing
+	// the ACK can rely on the file being there
 	if len(data) < dataBlockSize {
 		s.fileComplete = true
-		file := File{
-			Name: s.fileName,
-			Data: s.dataBuffer,
+		digests := s.digests.sums()
+
+		if err := s.server.verifyUpload(s.fileName, digests); err != nil {
+			logrus.Warnf("%v: %v", s.tracked.logPrefix("Write Session"), err.Msg)
+			s.server.quarantine(s.upload, s.fileName, digests)
+			return HandleError(s.rw, err.Code, err.Msg)
 		}
 
-		if err := s.fileServ.Write(&file); err != nil {
-			return err
+		if err := s.upload.Commit(s.fileName, digests); err != nil {
+			return handleFileError(s.rw, err)
 		}
 
-		logrus.Infof("[Write Session]: Wrote %v to file server %v bytes", file.Name, len(file.Data))
+		logrus.Infof("%v: Wrote %v to file server %v bytes", s.tracked.logPrefix("Write Session"), s.fileName, s.bytes)
 	}
 
-	return nil
+	return s.writeAck()
 }
 
 func (s *WriteSession) Ack(block uint16) error {
 	return errors.New("Ack operations are not supported on this handlers")
-	return nil
 }
 
 func (s *WriteSession) Err(code uint16, msg string) error {
-	logrus.Infof("Received Error with code %v and message %v", code, msg)
-	return errors.New(fmt.Sprintf("Received Error with code %v and message %v", code, msg))
+	logrus.Infof("%v: Received Error with code %v and message %v", s.tracked.logPrefix("Write Session"), code, msg)
+	return &Error{Code: code, Msg: msg}
 }